@@ -0,0 +1,222 @@
+package account
+
+import (
+	"errors"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"itsm/audit"
+	"itsm/authn"
+	"itsm/mailer"
+	"itsm/middleware"
+	"itsm/models"
+	"itsm/password"
+	"itsm/rbac"
+	"itsm/session"
+	"itsm/twofactor"
+	"itsm/utils"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Учетная запись текущего пользователя: пароль, адрес почты, двухфакторная
+// аутентификация и API-токены
+
+var db *gorm.DB
+
+func SetupRoutes(r *mux.Router, database *gorm.DB) {
+	db = database
+	r.HandleFunc("/account/password", passwordPageHandler).Methods("GET")
+	r.HandleFunc("/account/password", changePasswordHandler).Methods("POST")
+	r.HandleFunc("/account/email", changeEmailHandler).Methods("POST")
+	middleware.SessionOnly(r.HandleFunc("/api/v1/account/password", apiChangePasswordHandler).Methods("POST"))
+
+	r.HandleFunc("/account/tokens", tokensPageHandler).Methods("GET")
+	r.HandleFunc("/account/tokens", createTokenHandler).Methods("POST")
+	r.HandleFunc("/account/tokens/{id:[0-9]+}/revoke", revokeTokenHandler).Methods("POST")
+	middleware.SessionOnly(r.HandleFunc("/api/v1/account/tokens", apiListTokensHandler).Methods("GET"))
+	middleware.SessionOnly(r.HandleFunc("/api/v1/account/tokens", apiCreateTokenHandler).Methods("POST"))
+	middleware.SessionOnly(r.HandleFunc("/api/v1/account/tokens/{id:[0-9]+}", apiRevokeTokenHandler).Methods("DELETE"))
+
+	// Пользователь, обязанный включить защиту, попадает на эту страницу при любом запросе
+	middleware.AllowWithoutTwoFactor(r.HandleFunc(twofactor.SetupPath, twoFactorPageHandler).Methods("GET"))
+	middleware.AllowWithoutTwoFactor(r.HandleFunc(twofactor.SetupPath+"/enable", enableTwoFactorHandler).Methods("POST"))
+	r.HandleFunc(twofactor.SetupPath+"/recovery-codes", recoveryCodesHandler).Methods("POST")
+	r.HandleFunc(twofactor.SetupPath+"/disable", disableTwoFactorHandler).Methods("POST")
+}
+
+// changePassword проверяет текущий пароль и требования к новому, сохраняет
+// новый пароль и завершает остальные сессии пользователя. Текущая сессия
+// остается открытой
+func changePassword(w http.ResponseWriter, r *http.Request, current, next string) error {
+	user, ok := middleware.CurrentUser(r)
+	if !ok {
+		return utils.NewRequestError(http.StatusUnauthorized, "Пользователь не авторизован")
+	}
+	if !authn.IsLocal(user) {
+		return utils.NewRequestError(http.StatusUnprocessableEntity, "Пароль вашей учетной записи меняется в корпоративном каталоге")
+	}
+
+	if err := checkPassword(user, current); err != nil {
+		return err
+	}
+	if current == next {
+		return utils.NewRequestError(http.StatusUnprocessableEntity, "Новый пароль должен отличаться от текущего")
+	}
+	if err := password.Validate(next, user.Username); err != nil {
+		return utils.NewRequestError(http.StatusUnprocessableEntity, "%s", err.Error())
+	}
+
+	hash, err := password.Hash(next)
+	if err != nil {
+		return err
+	}
+
+	curSession, err := utils.GetCurSession(r)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.User{ID: user.ID}).
+			Updates(map[string]interface{}{"password": hash, "password_changed_at": now}).Error
+		if err != nil {
+			return err
+		}
+		if session.Revocable() {
+			if err := session.RevokeOtherSessions(tx, user.ID, curSession.ID); err != nil {
+				return err
+			}
+		}
+		return audit.Record(tx, r, audit.Event{ActorID: user.ID, Action: audit.ActionUserPasswordChange, TargetID: user.ID})
+	})
+	if err != nil {
+		return err
+	}
+
+	// Остальные сессии отсекаются по времени входа, поэтому текущая
+	// получает новое время, чтобы остаться действительной
+	curSession.Values["authTime"] = now.Unix()
+	return curSession.Save(r, w)
+}
+
+// checkPassword проверяет текущий пароль пользователя, в том числе пользователя каталога
+func checkPassword(user models.User, current string) error {
+	_, err := authn.Authenticate(&user, user.Username, current)
+	if errors.Is(err, authn.ErrInvalidCredentials) {
+		return utils.NewRequestError(http.StatusUnprocessableEntity, "Текущий пароль указан неверно")
+	}
+	return err
+}
+
+// changeEmail меняет адрес почты для восстановления пароля. Нужен текущий
+// пароль: иначе открытая сессия позволила бы перехватить учетную запись
+func changeEmail(r *http.Request, address, current string) error {
+	user, ok := middleware.CurrentUser(r)
+	if !ok {
+		return utils.NewRequestError(http.StatusUnauthorized, "Пользователь не авторизован")
+	}
+	if !authn.IsLocal(user) {
+		return utils.NewRequestError(http.StatusUnprocessableEntity, "Адрес почты вашей учетной записи задается в корпоративном каталоге")
+	}
+	if err := checkPassword(user, current); err != nil {
+		return err
+	}
+	email, err := mailer.ParseAddress(address)
+	if err != nil {
+		return utils.NewRequestError(http.StatusUnprocessableEntity, "%s", err.Error())
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&models.User{}).Where("email = ? AND id <> ?", email, user.ID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return utils.NewRequestError(http.StatusUnprocessableEntity, "Этот адрес почты указан у другого пользователя")
+		}
+		if err := tx.Model(&models.User{ID: user.ID}).Update("email", email).Error; err != nil {
+			return err
+		}
+		return audit.Record(tx, r, audit.Event{ActorID: user.ID, Action: audit.ActionUserEmail, TargetID: user.ID, Details: email})
+	})
+}
+
+func passwordPageHandler(w http.ResponseWriter, r *http.Request) {
+	renderPasswordPage(w, r, "", "")
+}
+
+func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	err := changePassword(w, r, r.FormValue("current_password"), r.FormValue("new_password"))
+	respondPasswordPage(w, r, err, "Пароль изменен. Сессии на других устройствах завершены.")
+}
+
+func changeEmailHandler(w http.ResponseWriter, r *http.Request) {
+	err := changeEmail(r, r.FormValue("email"), r.FormValue("current_password"))
+	respondPasswordPage(w, r, err, "Адрес почты изменен.")
+}
+
+// respondPasswordPage выводит страницу с результатом изменения. Ошибки
+// проверки показываются на странице, остальные - отдельным ответом
+func respondPasswordPage(w http.ResponseWriter, r *http.Request, err error, success string) {
+	if err != nil {
+		code, message := utils.ErrorStatus(err)
+		if code != http.StatusUnprocessableEntity {
+			http.Error(w, message, code)
+			return
+		}
+		renderPasswordPage(w, r, "", message)
+		return
+	}
+	renderPasswordPage(w, r, success, "")
+}
+
+func renderPasswordPage(w http.ResponseWriter, r *http.Request, message, errorMessage string) {
+	user, _ := middleware.CurrentUser(r)
+	// Пользователь в контексте загружен до изменения
+	if err := db.Select("email").First(&user, user.ID).Error; err != nil {
+		log.Println("Ошибка при выполнении запроса:", err)
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl, err := utils.ParsePage(r, "templates/account/password.html", nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.Execute(w, map[string]interface{}{
+		"IsClient":     rbac.IsClient(user),
+		"Requirements": password.Requirements(),
+		"Email":        user.Email,
+		"Local":        authn.IsLocal(user),
+		"Message":      message,
+		"ErrorMessage": errorMessage,
+	})
+	if err != nil {
+		log.Println("Ошибка при выполнении шаблона:", err)
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+	}
+}
+
+// passwordRequest - тело запроса смены пароля
+type passwordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+func apiChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req passwordRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	if err := changePassword(w, r, req.CurrentPassword, req.NewPassword); err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
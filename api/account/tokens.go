@@ -0,0 +1,207 @@
+package account
+
+import (
+	"errors"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"itsm/apitoken"
+	"itsm/audit"
+	"itsm/middleware"
+	"itsm/models"
+	"itsm/rbac"
+	"itsm/utils"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Личные API-токены пользователя. Управлять токенами можно только из сессии,
+// чтобы утекший токен нельзя было использовать для выпуска новых
+
+// tokenExpiryDays - сроки действия, которые предлагает форма; 0 - бессрочно
+var tokenExpiryDays = []int{30, 90, 365, 0}
+
+// tokensPage - данные страницы токенов
+type tokensPage struct {
+	IsClient     bool
+	Tokens       []models.APIToken
+	Scopes       map[string]string
+	ExpiryDays   []int
+	NewToken     string // показывается один раз
+	Message      string
+	ErrorMessage string
+}
+
+func (tokensPage) Expired(token models.APIToken) bool {
+	return apitoken.Expired(token)
+}
+
+// tokenRequest - параметры нового токена
+type tokenRequest struct {
+	Name          string `json:"name"`
+	Scope         string `json:"scope"`
+	ExpiresInDays int    `json:"expires_in_days"` // 0 - бессрочно
+}
+
+// createdTokenResponse - новый токен; значение token больше не показывается
+type createdTokenResponse struct {
+	models.APIToken
+	Token string `json:"token"`
+}
+
+// createToken выпускает токен текущему пользователю
+func createToken(r *http.Request, req tokenRequest) (string, models.APIToken, error) {
+	user, ok := middleware.CurrentUser(r)
+	if !ok {
+		return "", models.APIToken{}, utils.NewRequestError(http.StatusUnauthorized, "Пользователь не авторизован")
+	}
+	if req.ExpiresInDays < 0 {
+		return "", models.APIToken{}, utils.NewRequestError(http.StatusUnprocessableEntity, "Срок действия не может быть отрицательным")
+	}
+
+	var token string
+	var record models.APIToken
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		ttl := time.Duration(req.ExpiresInDays) * 24 * time.Hour
+		if token, record, err = apitoken.Create(tx, user.ID, req.Name, req.Scope, ttl); err != nil {
+			return tokenError(err)
+		}
+		return audit.Record(tx, r, audit.Event{
+			ActorID:  user.ID,
+			Action:   audit.ActionTokenCreate,
+			TargetID: user.ID,
+			Details:  record.Name + " (" + apitoken.ScopeTitles[record.Scope] + ")",
+		})
+	})
+	return token, record, err
+}
+
+// revokeToken отзывает токен текущего пользователя
+func revokeToken(r *http.Request, id string) error {
+	user, _ := middleware.CurrentUser(r)
+	tokenID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return utils.NewRequestError(http.StatusNotFound, "Токен не найден")
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		record, found, err := apitoken.Revoke(tx, user.ID, uint(tokenID))
+		if err != nil {
+			return err
+		}
+		if !found {
+			return utils.NewRequestError(http.StatusNotFound, "Токен не найден")
+		}
+		return audit.Record(tx, r, audit.Event{ActorID: user.ID, Action: audit.ActionTokenRevoke, TargetID: user.ID, Details: record.Name})
+	})
+}
+
+// tokenError заменяет ошибки проверки параметров ошибками для пользователя
+func tokenError(err error) error {
+	var validationErr *apitoken.ValidationError
+	if errors.As(err, &validationErr) || errors.Is(err, apitoken.ErrLimit) {
+		return utils.NewRequestError(http.StatusUnprocessableEntity, "%s", err.Error())
+	}
+	return err
+}
+
+func tokensPageHandler(w http.ResponseWriter, r *http.Request) {
+	renderTokensPage(w, r, tokensPage{})
+}
+
+func createTokenHandler(w http.ResponseWriter, r *http.Request) {
+	days, err := strconv.Atoi(r.FormValue("expires_in_days"))
+	if err != nil {
+		writeTokensError(w, r, utils.NewRequestError(http.StatusUnprocessableEntity, "Некорректный срок действия"))
+		return
+	}
+
+	token, record, err := createToken(r, tokenRequest{Name: r.FormValue("name"), Scope: r.FormValue("scope"), ExpiresInDays: days})
+	if err != nil {
+		writeTokensError(w, r, err)
+		return
+	}
+	renderTokensPage(w, r, tokensPage{
+		NewToken: token,
+		Message:  "Токен «" + record.Name + "» создан. Скопируйте его сейчас: больше он показан не будет",
+	})
+}
+
+func revokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if err := revokeToken(r, mux.Vars(r)["id"]); err != nil {
+		writeTokensError(w, r, err)
+		return
+	}
+	renderTokensPage(w, r, tokensPage{Message: "Токен отозван"})
+}
+
+// writeTokensError выводит ошибку. Ошибки проверки показываются на странице токенов
+func writeTokensError(w http.ResponseWriter, r *http.Request, err error) {
+	code, message := utils.ErrorStatus(err)
+	if code != http.StatusUnprocessableEntity {
+		http.Error(w, message, code)
+		return
+	}
+	renderTokensPage(w, r, tokensPage{ErrorMessage: message})
+}
+
+func renderTokensPage(w http.ResponseWriter, r *http.Request, page tokensPage) {
+	user, _ := middleware.CurrentUser(r)
+	tokens, err := apitoken.List(db, user.ID)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	page.IsClient = rbac.IsClient(user)
+	page.Tokens = tokens
+	page.Scopes = apitoken.ScopeTitles
+	page.ExpiryDays = tokenExpiryDays
+
+	tmpl, err := utils.ParsePage(r, "templates/account/tokens.html", nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tmpl.Execute(w, page); err != nil {
+		log.Println("Ошибка при выполнении шаблона:", err)
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+	}
+}
+
+func apiListTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := middleware.CurrentUser(r)
+	tokens, err := apitoken.List(db, user.ID)
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+	if tokens == nil {
+		tokens = []models.APIToken{}
+	}
+	utils.SendJSON(w, tokens)
+}
+
+func apiCreateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req tokenRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	token, record, err := createToken(r, req)
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+	utils.WriteJSON(w, http.StatusCreated, createdTokenResponse{record, token})
+}
+
+func apiRevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if err := revokeToken(r, mux.Vars(r)["id"]); err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
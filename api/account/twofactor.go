@@ -0,0 +1,215 @@
+package account
+
+import (
+	"encoding/base64"
+	"errors"
+	"gorm.io/gorm"
+	"html/template"
+	"itsm/audit"
+	"itsm/middleware"
+	"itsm/models"
+	"itsm/rbac"
+	"itsm/twofactor"
+	"itsm/utils"
+	"log"
+	"net/http"
+)
+
+// Настройка двухфакторной аутентификации. Новый секрет хранится в сессии,
+// пока пользователь не подтвердит его кодом из приложения
+
+// Ключ сессии для секрета, который еще не подтвержден
+const setupSecretKey = "totpSetupSecret"
+
+// twoFactorPage - данные страницы настройки
+type twoFactorPage struct {
+	IsClient      bool
+	User          models.User
+	Required      bool
+	Secret        string
+	URI           template.URL // ссылка otpauth:// не считается безопасной без явного типа
+	QRCode        template.URL
+	RecoveryCodes []string // показываются один раз
+	Remaining     int64
+	Message       string
+	ErrorMessage  string
+}
+
+func twoFactorPageHandler(w http.ResponseWriter, r *http.Request) {
+	renderTwoFactorPage(w, r, twoFactorPage{})
+}
+
+// renderTwoFactorPage дополняет данные страницы состоянием защиты пользователя.
+// Пока защита выключена, показывается секрет для добавления в приложение
+func renderTwoFactorPage(w http.ResponseWriter, r *http.Request, page twoFactorPage) {
+	user, _ := middleware.CurrentUser(r)
+	if page.User.ID == 0 {
+		page.User = user
+	}
+	page.IsClient = rbac.IsClient(user)
+	page.Required = twofactor.Required(user)
+
+	if twofactor.Enabled(page.User) {
+		remaining, err := twofactor.RemainingRecoveryCodes(db, user.ID)
+		if err != nil {
+			utils.WriteError(w, err)
+			return
+		}
+		page.Remaining = remaining
+	} else if err := prepareSetup(w, r, &page); err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	tmpl, err := utils.ParsePage(r, "templates/account/twofactor.html", nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tmpl.Execute(w, page); err != nil {
+		log.Println("Ошибка при выполнении шаблона:", err)
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+	}
+}
+
+// prepareSetup берет неподтвержденный секрет из сессии или создает новый
+func prepareSetup(w http.ResponseWriter, r *http.Request, page *twoFactorPage) error {
+	curSession, err := utils.GetCurSession(r)
+	if err != nil {
+		return err
+	}
+
+	secret, _ := curSession.Values[setupSecretKey].(string)
+	if secret == "" {
+		if secret, err = twofactor.NewSecret(); err != nil {
+			return err
+		}
+		curSession.Values[setupSecretKey] = secret
+		if err := curSession.Save(r, w); err != nil {
+			return err
+		}
+	}
+
+	page.Secret = secret
+	uri := twofactor.ProvisioningURI(secret, page.User.Username)
+	page.URI = template.URL(uri)
+	png, err := twofactor.QRCode(uri)
+	if err != nil {
+		return err
+	}
+	page.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	return nil
+}
+
+// writeTwoFactorError выводит ошибку. Ошибки проверки показываются на странице настройки
+func writeTwoFactorError(w http.ResponseWriter, r *http.Request, err error) {
+	code, message := utils.ErrorStatus(err)
+	if code != http.StatusUnprocessableEntity {
+		http.Error(w, message, code)
+		return
+	}
+	renderTwoFactorPage(w, r, twoFactorPage{ErrorMessage: message})
+}
+
+// invalidCode заменяет ошибку неверного кода ошибкой для пользователя
+func invalidCode(err error) error {
+	if errors.Is(err, twofactor.ErrInvalidCode) {
+		return utils.NewRequestError(http.StatusUnprocessableEntity, "Неверный код. Проверьте время на телефоне и введите новый код")
+	}
+	return err
+}
+
+func enableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := middleware.CurrentUser(r)
+	if twofactor.Enabled(user) {
+		writeTwoFactorError(w, r, utils.NewRequestError(http.StatusConflict, "Двухфакторная аутентификация уже включена"))
+		return
+	}
+
+	curSession, err := utils.GetCurSession(r)
+	if err != nil {
+		writeTwoFactorError(w, r, err)
+		return
+	}
+	secret, _ := curSession.Values[setupSecretKey].(string)
+	if secret == "" {
+		writeTwoFactorError(w, r, utils.NewRequestError(http.StatusUnprocessableEntity, "Секрет устарел. Добавьте учетную запись в приложение заново"))
+		return
+	}
+
+	var codes []string
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if codes, err = twofactor.Enable(tx, &user, secret, r.FormValue("code")); err != nil {
+			return invalidCode(err)
+		}
+		return audit.Record(tx, r, audit.Event{ActorID: user.ID, Action: audit.ActionUserTwoFactorEnable, TargetID: user.ID})
+	})
+	if err != nil {
+		writeTwoFactorError(w, r, err)
+		return
+	}
+
+	delete(curSession.Values, setupSecretKey)
+	if err := curSession.Save(r, w); err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	renderTwoFactorPage(w, r, twoFactorPage{
+		User:          user,
+		RecoveryCodes: codes,
+		Message:       "Двухфакторная аутентификация включена",
+	})
+}
+
+func recoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := middleware.CurrentUser(r)
+
+	var codes []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := twofactor.Verify(tx, &user, r.FormValue("code")); err != nil {
+			return invalidCode(err)
+		}
+		var err error
+		if codes, err = twofactor.RegenerateRecoveryCodes(tx, user.ID); err != nil {
+			return err
+		}
+		return audit.Record(tx, r, audit.Event{ActorID: user.ID, Action: audit.ActionUserRecoveryCodes, TargetID: user.ID})
+	})
+	if err != nil {
+		writeTwoFactorError(w, r, err)
+		return
+	}
+
+	renderTwoFactorPage(w, r, twoFactorPage{
+		User:          user,
+		RecoveryCodes: codes,
+		Message:       "Созданы новые резервные коды. Прежние коды больше не действуют",
+	})
+}
+
+func disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := middleware.CurrentUser(r)
+	if twofactor.Required(user) {
+		writeTwoFactorError(w, r, utils.NewRequestError(http.StatusUnprocessableEntity,
+			"Для ваших ролей двухфакторная аутентификация обязательна. Отключить ее может администратор"))
+		return
+	}
+	if err := checkPassword(user, r.FormValue("password")); err != nil {
+		writeTwoFactorError(w, r, err)
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := twofactor.Disable(tx, &user); err != nil {
+			return err
+		}
+		return audit.Record(tx, r, audit.Event{ActorID: user.ID, Action: audit.ActionUserTwoFactorDisable, TargetID: user.ID})
+	})
+	if err != nil {
+		writeTwoFactorError(w, r, err)
+		return
+	}
+
+	renderTwoFactorPage(w, r, twoFactorPage{User: user, Message: "Двухфакторная аутентификация отключена"})
+}
@@ -0,0 +1,506 @@
+package admin
+
+import (
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"html/template"
+	"itsm/apitoken"
+	"itsm/audit"
+	"itsm/filter"
+	"itsm/loginguard"
+	"itsm/middleware"
+	"itsm/models"
+	"itsm/rbac"
+	"itsm/session"
+	"itsm/twofactor"
+	"itsm/utils"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Консоль администратора: пользователи, их роли и команды, журнал аудита.
+// Все страницы доступны только с разрешением user.manage
+
+var db *gorm.DB
+
+// Размер страницы журнала аудита и число записей на странице пользователя
+const (
+	auditPageSize    = 100
+	userAuditEntries = 20
+)
+
+func SetupRoutes(r *mux.Router, database *gorm.DB) {
+	db = database
+
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.HandleFunc("/users", usersHandler).Methods("GET")
+	admin.HandleFunc("/users", createUserHandler).Methods("POST")
+	admin.HandleFunc("/users/{id:[0-9]+}", userHandler).Methods("GET")
+	admin.HandleFunc("/users/{id:[0-9]+}/roles", setRolesHandler).Methods("POST")
+	admin.HandleFunc("/users/{id:[0-9]+}/team", setTeamHandler).Methods("POST")
+	admin.HandleFunc("/users/{id:[0-9]+}/password", resetPasswordHandler).Methods("POST")
+	admin.HandleFunc("/users/{id:[0-9]+}/deactivate", setActiveHandler(false)).Methods("POST")
+	admin.HandleFunc("/users/{id:[0-9]+}/activate", setActiveHandler(true)).Methods("POST")
+	admin.HandleFunc("/users/{id:[0-9]+}/sessions/revoke", revokeSessionsHandler).Methods("POST")
+	admin.HandleFunc("/users/{id:[0-9]+}/sessions/{sid:[0-9]+}/revoke", revokeSessionHandler).Methods("POST")
+	admin.HandleFunc("/users/{id:[0-9]+}/tokens/revoke", revokeTokensHandler).Methods("POST")
+	admin.HandleFunc("/users/{id:[0-9]+}/unlock", unlockHandler).Methods("POST")
+	admin.HandleFunc("/users/{id:[0-9]+}/2fa/reset", resetTwoFactorHandler).Methods("POST")
+	admin.HandleFunc("/teams", createTeamHandler).Methods("POST")
+	admin.HandleFunc("/audit", auditHandler).Methods("GET")
+	admin.HandleFunc("/logins", loginsHandler).Methods("GET")
+	restrict(admin)
+
+	setupAPIRoutes(r)
+}
+
+// restrict требует разрешение user.manage для всех маршрутов подмаршрутизатора
+func restrict(router *mux.Router) {
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		middleware.RequirePermission(route, rbac.PermUserManage)
+		return nil
+	})
+}
+
+func renderTemplate(w http.ResponseWriter, r *http.Request, tmpl string, data interface{}) {
+	t, err := utils.ParsePage(r, tmpl, template.FuncMap{
+		"actionTitle": actionTitle,
+		"resultTitle": resultTitle,
+		"scopeTitle":  scopeTitle,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := t.Execute(w, data); err != nil {
+		log.Println("Ошибка при выполнении шаблона:", err)
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+	}
+}
+
+func actionTitle(action string) string {
+	if title, ok := audit.ActionTitles[action]; ok {
+		return title
+	}
+	return action
+}
+
+func resultTitle(result string) string {
+	if title, ok := loginguard.ResultTitles[result]; ok {
+		return title
+	}
+	return result
+}
+
+func scopeTitle(scope string) string {
+	if title, ok := apitoken.ScopeTitles[scope]; ok {
+		return title
+	}
+	return scope
+}
+
+// pageData - общие данные страниц консоли
+type pageData struct {
+	IsClient bool
+	Roles    []models.Role
+	Teams    []models.Team
+}
+
+func newPageData(r *http.Request) (pageData, error) {
+	user, _ := middleware.CurrentUser(r)
+	data := pageData{IsClient: rbac.IsClient(user)}
+	if err := db.Order("name").Find(&data.Roles).Error; err != nil {
+		return data, err
+	}
+	if err := db.Order("name").Find(&data.Teams).Error; err != nil {
+		return data, err
+	}
+	return data, nil
+}
+
+func usersHandler(w http.ResponseWriter, r *http.Request) {
+	renderUsers(w, r, "")
+}
+
+// renderUsers выводит список пользователей; createError - ошибка формы создания
+func renderUsers(w http.ResponseWriter, r *http.Request, createError string) {
+	q, err := parseUserQuery(r.URL.Query())
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	common, err := newPageData(r)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	users, page, err := findUsers(q)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	renderTemplate(w, r, "templates/admin/users.html", struct {
+		pageData
+		Users       []models.User
+		Query       userQuery
+		Page        filter.Page
+		RoleNone    string
+		CreateError string
+	}{common, users, q, page, roleNone, createError})
+}
+
+func createUserHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		utils.WriteError(w, utils.NewRequestError(http.StatusBadRequest, "Некорректная форма"))
+		return
+	}
+	input := userInput{
+		Username: r.PostForm.Get("username"),
+		Email:    r.PostForm.Get("email"),
+		Password: r.PostForm.Get("password"),
+		Roles:    r.PostForm["roles"],
+	}
+	teamID, err := formTeamID(r)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	input.TeamID = teamID
+
+	// Ошибки проверки выводятся над формой, как при регистрации
+	user, password, err := newChange(r).createUser(input)
+	if err != nil {
+		code, message := utils.ErrorStatus(err)
+		if code == http.StatusInternalServerError {
+			utils.WriteError(w, err)
+			return
+		}
+		renderUsers(w, r, message)
+		return
+	}
+
+	if password == "" {
+		http.Redirect(w, r, userURL(user.ID), http.StatusSeeOther)
+		return
+	}
+	renderUser(w, r, user, password)
+}
+
+func userHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := findUser(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	renderUser(w, r, user, "")
+}
+
+// renderUser выводит карточку пользователя. Временный пароль показывается
+// один раз - сразу после создания или сброса
+func renderUser(w http.ResponseWriter, r *http.Request, user models.User, tempPassword string) {
+	common, err := newPageData(r)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	var events []models.AuditEvent
+	err = db.Preload("Actor").Where("target_id = ?", user.ID).
+		Order("created_at DESC, id DESC").Limit(userAuditEntries).Find(&events).Error
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	var sessions []models.UserSession
+	if session.Revocable() {
+		if sessions, err = session.ListUserSessions(db, user.ID); err != nil {
+			utils.WriteError(w, err)
+			return
+		}
+	}
+
+	tokens, err := apitoken.List(db, user.ID)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	var attempts []models.LoginAttempt
+	err = db.Where("user_id = ?", user.ID).Order("created_at DESC, id DESC").Limit(userAuditEntries).Find(&attempts).Error
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	current, _ := middleware.CurrentUser(r)
+	renderTemplate(w, r, "templates/admin/user.html", userPage{
+		pageData:          common,
+		User:              user,
+		TempPassword:      tempPassword,
+		Events:            events,
+		IsSelf:            current.ID == user.ID,
+		Sessions:          sessions,
+		Revocable:         session.Revocable(),
+		Tokens:            tokens,
+		Attempts:          attempts,
+		IsLocked:          loginguard.IsLocked(user),
+		TwoFactorRequired: twofactor.Required(user),
+	})
+}
+
+// userPage - данные карточки пользователя
+type userPage struct {
+	pageData
+	User              models.User
+	TempPassword      string
+	Events            []models.AuditEvent
+	IsSelf            bool
+	Sessions          []models.UserSession
+	Revocable         bool // сессии хранятся в базе и их можно завершить
+	Tokens            []models.APIToken
+	Attempts          []models.LoginAttempt
+	IsLocked          bool
+	TwoFactorRequired bool
+}
+
+func (p userPage) HasRole(name string) bool {
+	return rbac.HasRole(p.User, name)
+}
+
+func (p userPage) InTeam(teamID uint) bool {
+	return p.User.TeamID != nil && *p.User.TeamID == teamID
+}
+
+func userIDString(id uint) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+func userURL(id uint) string {
+	return "/admin/users/" + userIDString(id)
+}
+
+// formTeamID разбирает поле team формы; пустое значение - без команды
+func formTeamID(r *http.Request) (*uint, error) {
+	value := r.FormValue("team")
+	if value == "" {
+		return nil, nil
+	}
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return nil, utils.NewRequestError(http.StatusBadRequest, "Некорректный ID команды")
+	}
+	teamID := uint(id)
+	return &teamID, nil
+}
+
+func setRolesHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := findUser(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		utils.WriteError(w, utils.NewRequestError(http.StatusBadRequest, "Некорректная форма"))
+		return
+	}
+	if err := newChange(r).setRoles(&user, r.PostForm["roles"]); err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	http.Redirect(w, r, userURL(user.ID), http.StatusSeeOther)
+}
+
+func setTeamHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := findUser(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	teamID, err := formTeamID(r)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	if err := newChange(r).setTeam(&user, teamID); err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	http.Redirect(w, r, userURL(user.ID), http.StatusSeeOther)
+}
+
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := findUser(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	password, err := newChange(r).resetPassword(&user)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	renderUser(w, r, user, password)
+}
+
+func setActiveHandler(active bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := findUser(mux.Vars(r)["id"])
+		if err != nil {
+			utils.WriteError(w, err)
+			return
+		}
+		if err := newChange(r).setActive(&user, active); err != nil {
+			utils.WriteError(w, err)
+			return
+		}
+		http.Redirect(w, r, userURL(user.ID), http.StatusSeeOther)
+	}
+}
+
+func revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := findUser(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	sessionID, err := strconv.ParseUint(mux.Vars(r)["sid"], 10, 64)
+	if err != nil {
+		utils.WriteError(w, utils.NewRequestError(http.StatusBadRequest, "Некорректный ID сессии"))
+		return
+	}
+	if err := newChange(r).revokeSession(user, uint(sessionID)); err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	http.Redirect(w, r, userURL(user.ID), http.StatusSeeOther)
+}
+
+func revokeSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := findUser(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	if err := newChange(r).revokeSessions(user); err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	http.Redirect(w, r, userURL(user.ID), http.StatusSeeOther)
+}
+
+func revokeTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := findUser(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	if err := newChange(r).revokeTokens(user); err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	http.Redirect(w, r, userURL(user.ID), http.StatusSeeOther)
+}
+
+func unlockHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := findUser(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	if err := newChange(r).unlock(&user); err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	http.Redirect(w, r, userURL(user.ID), http.StatusSeeOther)
+}
+
+func resetTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := findUser(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	if err := newChange(r).resetTwoFactor(&user); err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	http.Redirect(w, r, userURL(user.ID), http.StatusSeeOther)
+}
+
+func loginsHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := parseAttemptQuery(r.URL.Query())
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	common, err := newPageData(r)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	attempts, page, err := findAttempts(q)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	renderTemplate(w, r, "templates/admin/logins.html", struct {
+		pageData
+		Attempts []models.LoginAttempt
+		Query    attemptQuery
+		Page     filter.Page
+		Results  map[string]string
+	}{common, attempts, q, page, loginguard.ResultTitles})
+}
+
+func createTeamHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := newChange(r).createTeam(r.FormValue("name")); err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	pageNumber := 1
+	if value := r.URL.Query().Get("page"); value != "" {
+		var err error
+		if pageNumber, err = strconv.Atoi(value); err != nil || pageNumber < 1 {
+			utils.WriteError(w, utils.NewRequestError(http.StatusBadRequest, "Некорректный номер страницы"))
+			return
+		}
+	}
+
+	common, err := newPageData(r)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	var total int64
+	if err := db.Model(&models.AuditEvent{}).Count(&total).Error; err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	var events []models.AuditEvent
+	err = db.Preload("Actor").Preload("Target").Order("created_at DESC, id DESC").
+		Offset((pageNumber - 1) * auditPageSize).Limit(auditPageSize).Find(&events).Error
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	renderTemplate(w, r, "templates/admin/audit.html", struct {
+		pageData
+		Events []models.AuditEvent
+		Page   filter.Page
+	}{common, events, filter.NewPage(pageNumber, auditPageSize, total)})
+}
@@ -0,0 +1,289 @@
+package admin
+
+import (
+	"github.com/gorilla/mux"
+	"itsm/models"
+	"itsm/session"
+	"itsm/utils"
+	"net/http"
+	"strconv"
+)
+
+// JSON API управления пользователями. Ответы содержат пользователя
+// в том же виде, что и models.User, вместе с ролями
+
+func setupAPIRoutes(r *mux.Router) {
+	users := r.PathPrefix("/api/v1/users").Subrouter()
+	users.HandleFunc("", apiListUsersHandler).Methods("GET")
+	users.HandleFunc("", apiCreateUserHandler).Methods("POST")
+	users.HandleFunc("/{id:[0-9]+}", apiGetUserHandler).Methods("GET")
+	users.HandleFunc("/{id:[0-9]+}/roles", apiSetRolesHandler).Methods("PUT")
+	users.HandleFunc("/{id:[0-9]+}/password", apiResetPasswordHandler).Methods("POST")
+	users.HandleFunc("/{id:[0-9]+}/deactivate", apiSetActiveHandler(false)).Methods("POST")
+	users.HandleFunc("/{id:[0-9]+}/activate", apiSetActiveHandler(true)).Methods("POST")
+	users.HandleFunc("/{id:[0-9]+}/unlock", apiUnlockHandler).Methods("POST")
+	users.HandleFunc("/{id:[0-9]+}/2fa/reset", apiResetTwoFactorHandler).Methods("POST")
+	users.HandleFunc("/{id:[0-9]+}/sessions", apiListSessionsHandler).Methods("GET")
+	users.HandleFunc("/{id:[0-9]+}/sessions", apiRevokeSessionsHandler).Methods("DELETE")
+	users.HandleFunc("/{id:[0-9]+}/sessions/{sid:[0-9]+}", apiRevokeSessionHandler).Methods("DELETE")
+	users.HandleFunc("/{id:[0-9]+}/tokens", apiRevokeTokensHandler).Methods("DELETE")
+	restrict(users)
+
+	attempts := r.PathPrefix("/api/v1/login-attempts").Subrouter()
+	attempts.HandleFunc("", apiListAttemptsHandler).Methods("GET")
+	restrict(attempts)
+}
+
+type userListResponse struct {
+	Items      []models.User `json:"items"`
+	Page       int           `json:"page"`
+	PageSize   int           `json:"page_size"`
+	Total      int64         `json:"total"`
+	TotalPages int           `json:"total_pages"`
+}
+
+// createdUserResponse - созданный пользователь и сгенерированный пароль, если он не был задан
+type createdUserResponse struct {
+	models.User
+	TemporaryPassword string `json:"temporary_password,omitempty"`
+}
+
+type attemptListResponse struct {
+	Items      []models.LoginAttempt `json:"items"`
+	Page       int                   `json:"page"`
+	PageSize   int                   `json:"page_size"`
+	Total      int64                 `json:"total"`
+	TotalPages int                   `json:"total_pages"`
+}
+
+type passwordResponse struct {
+	TemporaryPassword string `json:"temporary_password"`
+}
+
+type rolesRequest struct {
+	Roles []string `json:"roles"`
+}
+
+func apiListUsersHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := parseUserQuery(r.URL.Query())
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	users, page, err := findUsers(q)
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+	if users == nil {
+		users = []models.User{}
+	}
+
+	utils.SendJSON(w, userListResponse{
+		Items:      users,
+		Page:       page.Number,
+		PageSize:   usersPageSize,
+		Total:      page.Total,
+		TotalPages: page.TotalPages,
+	})
+}
+
+func apiCreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input userInput
+	if err := utils.DecodeJSON(w, r, &input); err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	user, password, err := newChange(r).createUser(input)
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/api/v1/users/"+userIDString(user.ID))
+	utils.WriteJSON(w, http.StatusCreated, createdUserResponse{User: user, TemporaryPassword: password})
+}
+
+func apiGetUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := findUser(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+	utils.SendJSON(w, user)
+}
+
+func apiSetRolesHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := findUser(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	var req rolesRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	if err := newChange(r).setRoles(&user, req.Roles); err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+	utils.SendJSON(w, user)
+}
+
+func apiResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := findUser(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	password, err := newChange(r).resetPassword(&user)
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+	utils.SendJSON(w, passwordResponse{TemporaryPassword: password})
+}
+
+func apiSetActiveHandler(active bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := findUser(mux.Vars(r)["id"])
+		if err != nil {
+			utils.WriteJSONError(w, err)
+			return
+		}
+
+		if err := newChange(r).setActive(&user, active); err != nil {
+			utils.WriteJSONError(w, err)
+			return
+		}
+		utils.SendJSON(w, user)
+	}
+}
+
+func apiListSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := findUser(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+	if err := requireRevocable(); err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	sessions, err := session.ListUserSessions(db, user.ID)
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+	if sessions == nil {
+		sessions = []models.UserSession{}
+	}
+	utils.SendJSON(w, sessions)
+}
+
+func apiRevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := findUser(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+	sessionID, err := strconv.ParseUint(mux.Vars(r)["sid"], 10, 64)
+	if err != nil {
+		utils.WriteJSONError(w, utils.NewRequestError(http.StatusBadRequest, "Некорректный ID сессии"))
+		return
+	}
+
+	if err := newChange(r).revokeSession(user, uint(sessionID)); err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiRevokeSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := findUser(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	if err := newChange(r).revokeSessions(user); err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiRevokeTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := findUser(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	if err := newChange(r).revokeTokens(user); err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiUnlockHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := findUser(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	if err := newChange(r).unlock(&user); err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+	utils.SendJSON(w, user)
+}
+
+func apiResetTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := findUser(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	if err := newChange(r).resetTwoFactor(&user); err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+	utils.SendJSON(w, user)
+}
+
+func apiListAttemptsHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := parseAttemptQuery(r.URL.Query())
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	attempts, page, err := findAttempts(q)
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+	if attempts == nil {
+		attempts = []models.LoginAttempt{}
+	}
+
+	utils.SendJSON(w, attemptListResponse{
+		Items:      attempts,
+		Page:       page.Number,
+		PageSize:   attemptsPageSize,
+		Total:      page.Total,
+		TotalPages: page.TotalPages,
+	})
+}
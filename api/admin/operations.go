@@ -0,0 +1,583 @@
+package admin
+
+import (
+	"errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"itsm/apitoken"
+	"itsm/audit"
+	"itsm/authn"
+	"itsm/filter"
+	"itsm/loginguard"
+	"itsm/mailer"
+	"itsm/middleware"
+	"itsm/models"
+	"itsm/password"
+	"itsm/rbac"
+	"itsm/session"
+	"itsm/twofactor"
+	"itsm/utils"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Операции управления пользователями, общие для HTML-страниц и JSON API.
+// Каждое изменение записывается в журнал аудита в той же транзакции
+
+// Размеры страниц списка пользователей и журнала входов
+const (
+	usersPageSize    = 50
+	attemptsPageSize = 100
+)
+
+// change - изменение, выполняемое администратором по запросу r
+type change struct {
+	r       *http.Request
+	actorID uint
+}
+
+func newChange(r *http.Request) change {
+	user, _ := middleware.CurrentUser(r)
+	return change{r: r, actorID: user.ID}
+}
+
+// record записывает событие в журнал в транзакции tx
+func (c change) record(tx *gorm.DB, action string, targetID uint, details string) error {
+	return audit.Record(tx, c.r, audit.Event{ActorID: c.actorID, Action: action, TargetID: targetID, Details: details})
+}
+
+// userQuery - условия поиска пользователей
+type userQuery struct {
+	Search string // часть логина
+	Role   string // имя роли; "none" - пользователи без ролей
+	Active string // "active", "inactive" или пусто - все
+	Page   int
+}
+
+// roleNone - значение фильтра по роли для клиентов без ролей
+const roleNone = "none"
+
+func parseUserQuery(values url.Values) (userQuery, error) {
+	q := userQuery{
+		Search: strings.TrimSpace(values.Get("q")),
+		Role:   values.Get("role"),
+		Active: values.Get("active"),
+		Page:   1,
+	}
+	if q.Active != "" && q.Active != "active" && q.Active != "inactive" {
+		return q, utils.NewRequestError(http.StatusBadRequest, "Параметр active должен быть active или inactive")
+	}
+	if value := values.Get("page"); value != "" {
+		page, err := strconv.Atoi(value)
+		if err != nil || page < 1 {
+			return q, utils.NewRequestError(http.StatusBadRequest, "Некорректный номер страницы")
+		}
+		q.Page = page
+	}
+	return q, nil
+}
+
+func (q userQuery) apply(query *gorm.DB) *gorm.DB {
+	if q.Search != "" {
+		pattern := "%" + utils.EscapeLike(q.Search) + "%"
+		query = query.Where("users.username LIKE ? OR users.email LIKE ?", pattern, pattern)
+	}
+
+	holders := db.Table("user_roles").Select("user_roles.user_id")
+	switch q.Role {
+	case "":
+	case roleNone:
+		query = query.Where("users.id NOT IN (?)", holders)
+	default:
+		holders = holders.Joins("JOIN roles ON roles.id = user_roles.role_id").Where("roles.name = ?", q.Role)
+		query = query.Where("users.id IN (?)", holders)
+	}
+
+	switch q.Active {
+	case "active":
+		query = query.Where("users.deactivated_at IS NULL")
+	case "inactive":
+		query = query.Where("users.deactivated_at IS NOT NULL")
+	}
+	return query
+}
+
+// URL - ссылка на страницу page списка с теми же условиями
+func (q userQuery) URL(page int) string {
+	values := url.Values{}
+	if q.Search != "" {
+		values.Set("q", q.Search)
+	}
+	if q.Role != "" {
+		values.Set("role", q.Role)
+	}
+	if q.Active != "" {
+		values.Set("active", q.Active)
+	}
+	if page > 1 {
+		values.Set("page", strconv.Itoa(page))
+	}
+	if len(values) == 0 {
+		return "/admin/users"
+	}
+	return "/admin/users?" + values.Encode()
+}
+
+// findUsers возвращает страницу пользователей, подходящих под условия
+func findUsers(q userQuery) ([]models.User, filter.Page, error) {
+	query := q.apply(db.Model(&models.User{}))
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, filter.Page{}, err
+	}
+
+	var users []models.User
+	err := rbac.PreloadRoles(query).Order("users.username").
+		Offset((q.Page - 1) * usersPageSize).Limit(usersPageSize).Find(&users).Error
+	if err != nil {
+		return nil, filter.Page{}, err
+	}
+	return users, filter.NewPage(q.Page, usersPageSize, total), nil
+}
+
+// findUser загружает пользователя с ролями и разрешениями
+func findUser(id string) (models.User, error) {
+	var user models.User
+	if err := rbac.PreloadRoles(db).First(&user, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return user, utils.NewRequestError(http.StatusNotFound, "Пользователь не найден")
+		}
+		return user, err
+	}
+	return user, nil
+}
+
+// findRoles загружает роли по именам; неизвестное имя - ошибка
+func findRoles(tx *gorm.DB, names []string) ([]models.Role, error) {
+	var roles []models.Role
+	if len(names) == 0 {
+		return roles, nil
+	}
+	if err := tx.Preload("Permissions").Where("name IN ?", names).Find(&roles).Error; err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if !rbac.HasRole(models.User{Roles: roles}, name) {
+			return nil, utils.NewRequestError(http.StatusUnprocessableEntity, "Роль «%s» не существует", name)
+		}
+	}
+	return roles, nil
+}
+
+func roleNames(roles []models.Role) string {
+	names := make([]string, 0, len(roles))
+	for _, role := range roles {
+		names = append(names, role.Name)
+	}
+	if len(names) == 0 {
+		return "без ролей"
+	}
+	return strings.Join(names, ", ")
+}
+
+// guardLastAdmin запрещает изменение, после которого не останется активного
+// пользователя с правом управлять пользователями. Назначения ролей всех таких
+// пользователей блокируются до конца транзакции: параллельное изменение другого
+// администратора дождется ее завершения и учтет результат
+func guardLastAdmin(tx *gorm.DB, target models.User) error {
+	if target.DeactivatedAt != nil || !rbac.Can(target, rbac.PermUserManage) {
+		return nil
+	}
+
+	var holders []uint
+	err := tx.Table("user_roles").
+		Joins("JOIN role_permissions ON role_permissions.role_id = user_roles.role_id").
+		Joins("JOIN permissions ON permissions.id = role_permissions.permission_id").
+		Joins("JOIN users ON users.id = user_roles.user_id").
+		Where("permissions.code = ? AND users.deactivated_at IS NULL", rbac.PermUserManage).
+		Clauses(clause.Locking{Strength: "UPDATE"}).
+		Pluck("user_roles.user_id", &holders).Error
+	if err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(holders, func(id uint) bool { return id != target.ID }) {
+		return utils.NewRequestError(http.StatusConflict, "Нельзя лишить прав последнего администратора")
+	}
+	return nil
+}
+
+// userInput - данные нового пользователя. Без пароля создается временный
+type userInput struct {
+	Username string   `json:"username"`
+	Email    string   `json:"email"`
+	Password string   `json:"password"`
+	Roles    []string `json:"roles"`
+	TeamID   *uint    `json:"team_id"`
+}
+
+// createUser создает пользователя и возвращает сгенерированный пароль,
+// если он не был указан
+func (c change) createUser(input userInput) (models.User, string, error) {
+	var user models.User
+	username := strings.TrimSpace(input.Username)
+	if username == "" {
+		return user, "", utils.NewRequestError(http.StatusUnprocessableEntity, "Логин не указан")
+	}
+
+	var email *string
+	if input.Email != "" {
+		address, err := mailer.ParseAddress(input.Email)
+		if err != nil {
+			return user, "", utils.NewRequestError(http.StatusUnprocessableEntity, "%s", err.Error())
+		}
+		email = &address
+	}
+
+	secret, generated := input.Password, ""
+	if secret == "" {
+		var err error
+		if secret, err = password.Generate(); err != nil {
+			return user, "", err
+		}
+		generated = secret
+	} else if err := password.Validate(secret, username); err != nil {
+		return user, "", utils.NewRequestError(http.StatusUnprocessableEntity, "%s", err.Error())
+	}
+	hash, err := password.Hash(secret)
+	if err != nil {
+		return user, "", err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&models.User{}).Where("username = ?", username).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return utils.NewRequestError(http.StatusConflict, "Пользователь с таким логином уже существует")
+		}
+		if email != nil {
+			if err := tx.Model(&models.User{}).Where("email = ?", *email).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return utils.NewRequestError(http.StatusConflict, "Пользователь с таким адресом почты уже существует")
+			}
+		}
+
+		roles, err := findRoles(tx, input.Roles)
+		if err != nil {
+			return err
+		}
+		if input.TeamID != nil {
+			if err := tx.First(&models.Team{}, *input.TeamID).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					return utils.NewRequestError(http.StatusUnprocessableEntity, "Команда не найдена")
+				}
+				return err
+			}
+		}
+
+		user = models.User{Username: username, Email: email, Password: hash, TeamID: input.TeamID, Roles: roles}
+		if err := tx.Omit("Roles.*").Create(&user).Error; err != nil {
+			return err
+		}
+		return c.record(tx, audit.ActionUserCreate, user.ID, "Роли: "+roleNames(roles))
+	})
+	return user, generated, err
+}
+
+// setRoles заменяет роли пользователя
+func (c change) setRoles(user *models.User, names []string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		roles, err := findRoles(tx, names)
+		if err != nil {
+			return err
+		}
+		if !rbac.Can(models.User{Roles: roles}, rbac.PermUserManage) {
+			if err := guardLastAdmin(tx, *user); err != nil {
+				return err
+			}
+		}
+
+		details := roleNames(user.Roles) + " → " + roleNames(roles)
+		if err := tx.Model(user).Association("Roles").Replace(roles); err != nil {
+			return err
+		}
+		user.Roles = roles
+		return c.record(tx, audit.ActionUserRoles, user.ID, details)
+	})
+}
+
+// resetPassword заменяет пароль пользователя временным и возвращает его
+func (c change) resetPassword(user *models.User) (string, error) {
+	if user.AuthSource == authn.SourceOIDC {
+		return "", utils.NewRequestError(http.StatusConflict, "Пользователь входит через провайдера единого входа и не имеет пароля")
+	}
+	if !authn.IsLocal(*user) {
+		return "", utils.NewRequestError(http.StatusConflict, "Пароль пользователя задается в каталоге %s", user.AuthSource)
+	}
+
+	secret, err := password.Generate()
+	if err != nil {
+		return "", err
+	}
+	hash, err := password.Hash(secret)
+	if err != nil {
+		return "", err
+	}
+
+	// Сессии, открытые со старым паролем, завершаются
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(user).Updates(map[string]interface{}{"password": hash, "password_changed_at": time.Now()}).Error
+		if err != nil {
+			return err
+		}
+		if _, err := session.RevokeUserSessions(tx, user.ID); err != nil {
+			return err
+		}
+		return c.record(tx, audit.ActionUserPasswordReset, user.ID, "")
+	})
+	return secret, err
+}
+
+// setActive включает или отключает учетную запись. Отключить себя нельзя,
+// чтобы администратор случайно не потерял доступ
+func (c change) setActive(user *models.User, active bool) error {
+	if active == (user.DeactivatedAt == nil) {
+		return nil
+	}
+	if !active && user.ID == c.actorID {
+		return utils.NewRequestError(http.StatusConflict, "Нельзя отключить собственную учетную запись")
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		action := audit.ActionUserActivate
+		var deactivatedAt *time.Time
+		if !active {
+			if err := guardLastAdmin(tx, *user); err != nil {
+				return err
+			}
+			if _, err := session.RevokeUserSessions(tx, user.ID); err != nil {
+				return err
+			}
+			now := time.Now()
+			deactivatedAt = &now
+			action = audit.ActionUserDeactivate
+		}
+
+		if err := tx.Model(user).Update("deactivated_at", deactivatedAt).Error; err != nil {
+			return err
+		}
+		user.DeactivatedAt = deactivatedAt
+		return c.record(tx, action, user.ID, "")
+	})
+}
+
+// setTeam переводит пользователя в команду; nil - без команды
+func (c change) setTeam(user *models.User, teamID *uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		details := "без команды"
+		if teamID != nil {
+			var team models.Team
+			if err := tx.First(&team, *teamID).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					return utils.NewRequestError(http.StatusUnprocessableEntity, "Команда не найдена")
+				}
+				return err
+			}
+			details = team.Name
+		}
+
+		if err := tx.Model(user).Update("team_id", teamID).Error; err != nil {
+			return err
+		}
+		user.TeamID = teamID
+		return c.record(tx, audit.ActionUserTeam, user.ID, details)
+	})
+}
+
+// unlock снимает блокировку входа после неудачных попыток
+func (c change) unlock(user *models.User) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := loginguard.Unlock(tx, user); err != nil {
+			return err
+		}
+		return c.record(tx, audit.ActionUserUnlock, user.ID, "")
+	})
+}
+
+// resetTwoFactor выключает двухфакторную аутентификацию, например после потери
+// телефона. Если она обязательна для ролей пользователя, при следующем входе
+// ее придется настроить заново
+func (c change) resetTwoFactor(user *models.User) error {
+	if !twofactor.Enabled(*user) {
+		return utils.NewRequestError(http.StatusConflict, "Двухфакторная аутентификация не включена")
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := twofactor.Disable(tx, user); err != nil {
+			return err
+		}
+		return c.record(tx, audit.ActionUserTwoFactorReset, user.ID, "")
+	})
+}
+
+// attemptQuery - условия выборки попыток входа
+type attemptQuery struct {
+	Username string
+	IP       string
+	Result   string
+	Page     int
+}
+
+func parseAttemptQuery(values url.Values) (attemptQuery, error) {
+	q := attemptQuery{
+		Username: strings.TrimSpace(values.Get("username")),
+		IP:       strings.TrimSpace(values.Get("ip")),
+		Result:   values.Get("result"),
+		Page:     1,
+	}
+	if _, ok := loginguard.ResultTitles[q.Result]; q.Result != "" && !ok {
+		return q, utils.NewRequestError(http.StatusBadRequest, "Неизвестный результат «%s»", q.Result)
+	}
+	if value := values.Get("page"); value != "" {
+		page, err := strconv.Atoi(value)
+		if err != nil || page < 1 {
+			return q, utils.NewRequestError(http.StatusBadRequest, "Некорректный номер страницы")
+		}
+		q.Page = page
+	}
+	return q, nil
+}
+
+// URL - ссылка на страницу page журнала входов с теми же условиями
+func (q attemptQuery) URL(page int) string {
+	values := url.Values{}
+	if q.Username != "" {
+		values.Set("username", q.Username)
+	}
+	if q.IP != "" {
+		values.Set("ip", q.IP)
+	}
+	if q.Result != "" {
+		values.Set("result", q.Result)
+	}
+	if page > 1 {
+		values.Set("page", strconv.Itoa(page))
+	}
+	if len(values) == 0 {
+		return "/admin/logins"
+	}
+	return "/admin/logins?" + values.Encode()
+}
+
+// WithIP - ссылка на первую страницу журнала входов с адреса ip
+func (q attemptQuery) WithIP(ip string) string {
+	q.IP = ip
+	return q.URL(1)
+}
+
+// findAttempts возвращает страницу попыток входа, новые первыми
+func findAttempts(q attemptQuery) ([]models.LoginAttempt, filter.Page, error) {
+	query := db.Model(&models.LoginAttempt{})
+	if q.Username != "" {
+		query = query.Where("username = ?", q.Username)
+	}
+	if q.IP != "" {
+		query = query.Where("ip = ?", q.IP)
+	}
+	if q.Result != "" {
+		query = query.Where("result = ?", q.Result)
+	}
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, filter.Page{}, err
+	}
+
+	var attempts []models.LoginAttempt
+	err := query.Order("created_at DESC, id DESC").
+		Offset((q.Page - 1) * attemptsPageSize).Limit(attemptsPageSize).Find(&attempts).Error
+	if err != nil {
+		return nil, filter.Page{}, err
+	}
+	return attempts, filter.NewPage(q.Page, attemptsPageSize, total), nil
+}
+
+// requireRevocable - просматривать и завершать можно только сессии в базе
+func requireRevocable() error {
+	if !session.Revocable() {
+		return utils.NewRequestError(http.StatusConflict, "Сессии хранятся в cookie и не могут быть завершены на сервере")
+	}
+	return nil
+}
+
+// revokeSession завершает одну сессию пользователя
+func (c change) revokeSession(user models.User, sessionID uint) error {
+	if err := requireRevocable(); err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		found, err := session.RevokeUserSession(tx, user.ID, sessionID)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return utils.NewRequestError(http.StatusNotFound, "Сессия не найдена")
+		}
+		return c.record(tx, audit.ActionSessionRevoke, user.ID, "Сессия "+strconv.FormatUint(uint64(sessionID), 10))
+	})
+}
+
+// revokeSessions завершает все сессии пользователя
+func (c change) revokeSessions(user models.User) error {
+	if err := requireRevocable(); err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		count, err := session.RevokeUserSessions(tx, user.ID)
+		if err != nil {
+			return err
+		}
+		return c.record(tx, audit.ActionSessionRevoke, user.ID, "Все сессии: "+strconv.FormatInt(count, 10))
+	})
+}
+
+// revokeTokens отзывает все API-токены пользователя
+func (c change) revokeTokens(user models.User) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		count, err := apitoken.RevokeAll(tx, user.ID)
+		if err != nil {
+			return err
+		}
+		return c.record(tx, audit.ActionTokenRevoke, user.ID, "Все токены: "+strconv.FormatInt(count, 10))
+	})
+}
+
+// createTeam создает команду с уникальным названием
+func (c change) createTeam(name string) (models.Team, error) {
+	team := models.Team{Name: strings.TrimSpace(name)}
+	if team.Name == "" {
+		return team, utils.NewRequestError(http.StatusUnprocessableEntity, "Название команды не указано")
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&models.Team{}).Where("name = ?", team.Name).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return utils.NewRequestError(http.StatusConflict, "Команда с таким названием уже существует")
+		}
+		if err := tx.Create(&team).Error; err != nil {
+			return err
+		}
+		return c.record(tx, audit.ActionTeamCreate, 0, team.Name)
+	})
+	return team, err
+}
@@ -4,14 +4,22 @@ import (
 	"errors"
 	"github.com/gorilla/mux"
 	_ "github.com/gorilla/sessions"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 	"html/template"
+	"itsm/authn"
+	"itsm/loginguard"
+	"itsm/mailer"
+	"itsm/middleware"
 	"itsm/models"
+	"itsm/password"
 	_ "itsm/session"
+	"itsm/sso"
+	"itsm/twofactor"
 	"itsm/utils"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 )
 
 var db *gorm.DB
@@ -21,9 +29,16 @@ type user models.User
 
 func SetupRoutes(r *mux.Router, database *gorm.DB) {
 	db = database
-	r.HandleFunc("/", authHandler)
-	r.HandleFunc("/register", registerHandler)
-	r.HandleFunc("/logout", logoutHandler)
+	middleware.Public(r.HandleFunc("/", authHandler))
+	middleware.Public(r.HandleFunc("/login/2fa", secondFactorHandler))
+	middleware.Public(r.HandleFunc("/login/sso/{provider}", ssoLoginHandler).Methods("GET"))
+	middleware.Public(r.HandleFunc("/login/sso/{provider}/callback", ssoCallbackHandler).Methods("GET"))
+	middleware.Public(r.HandleFunc("/password/forgot", forgotPasswordHandler))
+	middleware.Public(r.HandleFunc("/password/reset", resetPasswordHandler))
+	middleware.Public(r.HandleFunc("/register", registerHandler))
+	// Выход только POST-запросом с CSRF-токеном: иначе чужая страница
+	// могла бы завершить сессию ссылкой на картинку
+	middleware.Public(r.HandleFunc("/logout", logoutHandler).Methods("POST"))
 }
 
 func authHandler(w http.ResponseWriter, r *http.Request) {
@@ -33,30 +48,27 @@ func authHandler(w http.ResponseWriter, r *http.Request) {
 		var user user
 		user, errorMessage = authUser(r)
 
-		// Успешная авторизация
+		// Пароль верен. При включенной двухфакторной аутентификации вход
+		// завершается после ввода кода
 		if len(errorMessage) == 0 {
-			curSession, err := utils.GetCurSession(r)
-			if err != nil {
-				http.Error(w, "Ошибка получения сессии: "+err.Error(), http.StatusUnauthorized)
+			if twofactor.Enabled(models.User(user)) {
+				beginSecondFactor(w, r, user.ID)
+				return
 			}
-
-			curSession.Values["userID"] = user.ID
-			curSession.Values["isAdmin"] = user.IsAdmin
-			curSession.Values["isTechOfficer"] = user.IsTechOfficer
-			curSession.Values["isDefaultOfficer"] = user.IsDefaultOfficer // Сохраняем права доступа
-			err = curSession.Save(r, w)
-			if err != nil {
-				http.Error(w, "Ошибка сохранения сессии", http.StatusUnauthorized)
-			}
-
-			http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+			startSession(w, r, user.ID)
 			return
 		}
 	}
 
+	renderLoginPage(w, errorMessage)
+}
+
+// renderLoginPage выводит форму входа с кнопками провайдеров единого входа
+func renderLoginPage(w http.ResponseWriter, errorMessage string) {
 	tmpl := template.Must(template.ParseFiles("templates/auth/auth.html"))
 	err := tmpl.Execute(w, map[string]interface{}{
 		"Register":     false,
+		"Providers":    sso.Providers(),
 		"ErrorMessage": errorMessage})
 
 	if err != nil {
@@ -69,22 +81,94 @@ func authUser(r *http.Request) (user, string) {
 	username := r.FormValue("username")
 	password := r.FormValue("password")
 
+	guard := loginguard.Begin(db, r, username)
+	defer guard.End()
+
 	var user user
-	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return user, "Неверный логин или пароль"
-		}
+	var account *models.User
+	if err := db.Where("username = ?", username).First(&user).Error; err == nil {
+		account = (*models.User)(&user)
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
 		log.Println("Ошибка при выполнении запроса:", err)
 		return user, serverErrorText
 	}
 
-	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
-	if err != nil {
+	if err := guard.Check(account); err != nil {
+		var denied *loginguard.Denied
+		if errors.As(err, &denied) {
+			return user, denied.Error()
+		}
+		log.Println("Ошибка при проверке попыток входа:", err)
+		return user, serverErrorText
+	}
+
+	identity, err := authn.Authenticate(account, username, password)
+	if errors.Is(err, authn.ErrInvalidCredentials) {
+		if err := guard.Failure(account, loginguard.ResultInvalid); err != nil {
+			log.Println("Ошибка при записи попытки входа:", err)
+		}
 		return user, "Неверный логин или пароль"
 	}
+	if err != nil {
+		log.Println("Ошибка при проверке пароля:", err)
+		return user, "Каталог пользователей недоступен. Попробуйте позже"
+	}
+
+	// Пользователь каталога создается при первом входе, его роли обновляются по группам
+	if identity != nil {
+		provisioned, err := authn.Provision(db, r, account, *identity)
+		if err != nil {
+			log.Println("Ошибка при создании пользователя каталога:", err)
+			return user, serverErrorText
+		}
+		account = (*models.User)(&user)
+		*account = provisioned
+	}
+
+	if user.DeactivatedAt != nil {
+		if err := guard.Failure(account, loginguard.ResultDeactivated); err != nil {
+			log.Println("Ошибка при записи попытки входа:", err)
+		}
+		return user, "Учетная запись отключена. Обратитесь к администратору"
+	}
+
+	// Счетчик неудач сбрасывается только после второго фактора, иначе
+	// знающий пароль мог бы подбирать код, чередуя его с верным паролем
+	if twofactor.Enabled(*account) {
+		return user, ""
+	}
+	if err := guard.Success(account); err != nil {
+		log.Println("Ошибка при записи попытки входа:", err)
+	}
 	return user, ""
 }
 
+// startSession завершает вход: открывает сессию пользователя и переходит на главную
+func startSession(w http.ResponseWriter, r *http.Request, userID uint) {
+	// Недействительная cookie, например подписанная старым ключом,
+	// заменяется новой сессией
+	curSession, err := utils.GetCurSession(r)
+	if err != nil {
+		log.Println("Не удалось прочитать сессию:", err)
+	}
+
+	// Права доступа загружаются из базы при каждом запросе, в сессии только ID.
+	// Новый токен при входе защищает от фиксации сессии
+	curSession.ID = ""
+	delete(curSession.Values, pendingUserKey)
+	delete(curSession.Values, pendingTimeKey)
+	curSession.Values["userID"] = userID
+	curSession.Values["authTime"] = time.Now().Unix()
+	err = curSession.Save(r, w)
+	if err != nil {
+		log.Println("Ошибка сохранения сессии:", err)
+		http.Error(w, "Ошибка сохранения сессии", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
+
 func registerHandler(w http.ResponseWriter, r *http.Request) {
 	errorMessage := ""
 	if r.Method == http.MethodPost {
@@ -99,6 +183,7 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 	tmpl := template.Must(template.ParseFiles("templates/auth/auth.html"))
 	err := tmpl.Execute(w, map[string]interface{}{
 		"Register":     true,
+		"Requirements": password.Requirements(),
 		"ErrorMessage": errorMessage})
 
 	if err != nil {
@@ -108,8 +193,24 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func registerUser(r *http.Request) string {
-	username := r.FormValue("username")
-	password := r.FormValue("password")
+	username := strings.TrimSpace(r.FormValue("username"))
+	secret := r.FormValue("password")
+
+	if username == "" {
+		return "Логин не указан"
+	}
+	// Адрес почты необязателен: без него пароль восстанавливает администратор
+	var email *string
+	if address := strings.TrimSpace(r.FormValue("email")); address != "" {
+		address, err := mailer.ParseAddress(address)
+		if err != nil {
+			return err.Error()
+		}
+		email = &address
+	}
+	if err := password.Validate(secret, username); err != nil {
+		return err.Error()
+	}
 
 	var count int64
 	if err := db.Model(&user{}).Where("username = ?", username).Count(&count).Error; err != nil {
@@ -121,13 +222,24 @@ func registerUser(r *http.Request) string {
 		return "Пользователь с таким логином уже существует"
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if email != nil {
+		if err := db.Model(&user{}).Where("email = ?", *email).Count(&count).Error; err != nil {
+			log.Println("Ошибка при выполнении запроса:", err)
+			return serverErrorText
+		}
+
+		if count > 0 {
+			return "Пользователь с таким адресом почты уже существует"
+		}
+	}
+
+	hashedPassword, err := password.Hash(secret)
 	if err != nil {
 		log.Println("Ошибка при хешировании пароля:", err)
 		return serverErrorText
 	}
 
-	newUser := user{Username: username, Password: string(hashedPassword)}
+	newUser := user{Username: username, Email: email, Password: hashedPassword}
 	if err := db.Create(&newUser).Error; err != nil {
 		log.Println("Ошибка при добавлении пользователя:", err)
 		return serverErrorText
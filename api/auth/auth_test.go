@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"itsm/models"
+	"itsm/testenv"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func register(username, email string) string {
+	form := url.Values{"username": {username}, "email": {email}, "password": {newPassword}}
+	r := httptest.NewRequest("POST", "/register", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return registerUser(r)
+}
+
+func TestRegisterEmailOptional(t *testing.T) {
+	db = testenv.Open(t)
+
+	if message := register("ivanov", ""); message != "" {
+		t.Fatalf("register without email: %s", message)
+	}
+	if message := register("petrov", ""); message != "" {
+		t.Fatalf("second register without email: %s", message)
+	}
+	var user models.User
+	if err := db.Where("username = ?", "ivanov").First(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != nil {
+		t.Errorf("email = %q, want none", *user.Email)
+	}
+
+	if message := register("sidorov", "sidorov@example.com"); message != "" {
+		t.Fatalf("register with email: %s", message)
+	}
+	for _, tc := range []struct{ username, email, want string }{
+		{"kozlov", "not an address", "Некорректный адрес"},
+		{"kozlov", "sidorov@example.com", "адресом почты уже существует"},
+	} {
+		if message := register(tc.username, tc.email); !strings.Contains(message, tc.want) {
+			t.Errorf("register(%q, %q) = %q, want %q", tc.username, tc.email, message, tc.want)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"html/template"
+	"itsm/audit"
+	"itsm/authn"
+	"itsm/listener"
+	"itsm/loginguard"
+	"itsm/mailer"
+	"itsm/models"
+	"itsm/password"
+	"itsm/session"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Восстановление пароля по почте. Пользователь получает ссылку с одноразовым
+// токеном; в базе хранится только хеш токена. Новая ссылка отменяет прежние
+
+// Длина токена в байтах и минимальный интервал между письмами одному пользователю
+const (
+	resetTokenLength = 32
+	resetInterval    = time.Minute
+)
+
+var (
+	// publicURL - адрес сервера для ссылок в письмах. Заголовок Host запроса
+	// не используется: его подмена отправила бы ссылку на чужой сервер
+	publicURL = "http://localhost"
+	resetTTL  = time.Hour
+)
+
+// ConfigurePasswordReset задает адрес сервера для ссылок и срок их действия
+func ConfigurePasswordReset(baseURL string, ttl time.Duration) {
+	publicURL = strings.TrimSuffix(baseURL, "/")
+	resetTTL = ttl
+}
+
+// forgotMessage показывается всегда, чтобы ответ не выдавал, есть ли такой пользователь
+const forgotMessage = "Если учетная запись существует и для нее указан адрес почты, " +
+	"на него отправлена ссылка для восстановления пароля"
+
+// errNoRecoveryAddress - у найденной по логину учетной записи нет адреса почты.
+// Адрес при регистрации необязателен, и без этого ответа пользователь ждал бы
+// письма, которое не придет. Занятость логина и так видна при регистрации
+var errNoRecoveryAddress = errors.New("Для учетной записи не указан адрес почты для восстановления. " +
+	"Обратитесь к администратору, чтобы сбросить пароль")
+
+func forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	message, errorMessage := "", ""
+	if r.Method == http.MethodPost {
+		if login := strings.TrimSpace(r.FormValue("login")); login == "" {
+			errorMessage = "Укажите логин или адрес почты"
+		} else if err := requestPasswordReset(r, login); errors.Is(err, errNoRecoveryAddress) {
+			errorMessage = err.Error()
+		} else if err != nil {
+			log.Println("Ошибка при восстановлении пароля:", err)
+			errorMessage = serverErrorText
+		} else {
+			message = forgotMessage
+		}
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/auth/forgot.html"))
+	err := tmpl.Execute(w, map[string]interface{}{
+		"Message":      message,
+		"ErrorMessage": errorMessage})
+
+	if err != nil {
+		log.Println("Ошибка при выполнении шаблона:", err)
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+	}
+}
+
+// requestPasswordReset создает токен и отправляет письмо пользователю с логином
+// или адресом login. Отсутствие пользователя ошибкой не считается, для локального
+// пользователя без адреса почты возвращается errNoRecoveryAddress
+func requestPasswordReset(r *http.Request, login string) error {
+	var user models.User
+	err := db.Where("username = ? OR email = ?", login, login).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Пароль пользователя каталога восстанавливается в самом каталоге
+	if user.DeactivatedAt != nil || !authn.IsLocal(user) {
+		return nil
+	}
+	if user.Email == nil {
+		return errNoRecoveryAddress
+	}
+
+	// Повторные запросы не должны заваливать ящик пользователя письмами
+	var recent int64
+	err = db.Model(&models.PasswordResetToken{}).
+		Where("user_id = ? AND created_at > ?", user.ID, time.Now().Add(-resetInterval)).
+		Count(&recent).Error
+	if err != nil || recent > 0 {
+		return err
+	}
+
+	token, err := newResetToken()
+	if err != nil {
+		return err
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ? AND used_at IS NULL", user.ID).Delete(&models.PasswordResetToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.PasswordResetToken{
+			UserID:    user.ID,
+			TokenHash: hashResetToken(token),
+			IP:        audit.ClientIP(r),
+			ExpiresAt: time.Now().Add(resetTTL),
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	// Письмо отправляется в фоне, чтобы время ответа не выдавало, есть ли пользователь
+	msg := resetMessage(baseURL(r), *user.Email, user.Username, token)
+	go func() {
+		if err := mailer.Send(msg); err != nil {
+			log.Println("Ошибка при отправке письма:", err)
+		}
+	}()
+	return nil
+}
+
+// baseURL - адрес для ссылок: внешний адрес слушателя, принявшего запрос, или общий
+func baseURL(r *http.Request) string {
+	if u := listener.PublicURL(r); u != "" {
+		return u
+	}
+	return publicURL
+}
+
+func resetMessage(base, to, username, token string) mailer.Message {
+	link := base + "/password/reset?" + url.Values{"token": {token}}.Encode()
+	return mailer.Message{
+		To:      to,
+		Subject: "Восстановление пароля",
+		Body: fmt.Sprintf("Здравствуйте, %s!\n\n"+
+			"Для вашей учетной записи запрошено восстановление пароля. Чтобы задать новый пароль, откройте ссылку:\n\n"+
+			"%s\n\n"+
+			"Ссылка действует до %s и только один раз. Если вы не запрашивали восстановление, просто удалите это письмо.\n",
+			username, link, time.Now().Add(resetTTL).Format("02.01.2006 15:04")),
+	}
+}
+
+func newResetToken() (string, error) {
+	buf := make([]byte, resetTokenLength)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// errInvalidResetToken - токен не найден, уже использован или истек
+var errInvalidResetToken = errors.New("Ссылка недействительна или устарела. Запросите восстановление пароля заново")
+
+// findResetToken находит действующий токен и его пользователя
+func findResetToken(tx *gorm.DB, token string) (models.PasswordResetToken, models.User, error) {
+	var record models.PasswordResetToken
+	var user models.User
+	err := tx.Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", hashResetToken(token), time.Now()).
+		First(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return record, user, errInvalidResetToken
+	}
+	if err != nil {
+		return record, user, err
+	}
+
+	if err := tx.First(&user, record.UserID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return record, user, errInvalidResetToken
+		}
+		return record, user, err
+	}
+	if user.DeactivatedAt != nil || !authn.IsLocal(user) {
+		return record, user, errInvalidResetToken
+	}
+	return record, user, nil
+}
+
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+
+	var err error
+	if r.Method == http.MethodPost {
+		err = resetPassword(r, token, r.FormValue("password"))
+	} else {
+		_, _, err = findResetToken(db, token)
+	}
+
+	done := r.Method == http.MethodPost && err == nil
+	errorMessage := ""
+	if err != nil {
+		errorMessage = resetErrorText(err)
+	}
+	// После ошибки форма остается, только если не подошел сам пароль
+	var policyErr *password.Error
+	showForm := !done && (err == nil || errors.As(err, &policyErr))
+
+	tmpl := template.Must(template.ParseFiles("templates/auth/reset.html"))
+	err = tmpl.Execute(w, map[string]interface{}{
+		"Token":        token,
+		"Requirements": password.Requirements(),
+		"Done":         done,
+		"ShowForm":     showForm,
+		"ErrorMessage": errorMessage})
+
+	if err != nil {
+		log.Println("Ошибка при выполнении шаблона:", err)
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+	}
+}
+
+// resetPassword задает новый пароль по токену. Как и смена пароля, завершает
+// все сессии пользователя и снимает блокировку входа. Двухфакторная
+// аутентификация при этом не отключается
+func resetPassword(r *http.Request, token, secret string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		record, user, err := findResetToken(tx, token)
+		if err != nil {
+			return err
+		}
+		if err := password.Validate(secret, user.Username); err != nil {
+			return err
+		}
+		hash, err := password.Hash(secret)
+		if err != nil {
+			return err
+		}
+
+		// Условие в запросе не дает использовать токен дважды параллельными запросами
+		result := tx.Model(&record).Where("used_at IS NULL").Update("used_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errInvalidResetToken
+		}
+
+		err = tx.Model(&user).Updates(map[string]interface{}{"password": hash, "password_changed_at": time.Now()}).Error
+		if err != nil {
+			return err
+		}
+		if session.Revocable() {
+			if _, err := session.RevokeUserSessions(tx, user.ID); err != nil {
+				return err
+			}
+		}
+		if err := loginguard.Unlock(tx, &user); err != nil {
+			return err
+		}
+		return audit.Record(tx, r, audit.Event{ActorID: user.ID, Action: audit.ActionUserPasswordRecover, TargetID: user.ID})
+	})
+}
+
+// resetErrorText - текст ошибки для пользователя. Внутренние ошибки только записываются в лог
+func resetErrorText(err error) string {
+	var policyErr *password.Error
+	if errors.Is(err, errInvalidResetToken) || errors.As(err, &policyErr) {
+		return err.Error()
+	}
+	log.Println("Ошибка при восстановлении пароля:", err)
+	return serverErrorText
+}
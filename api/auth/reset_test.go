@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"errors"
+	"itsm/mailer"
+	"itsm/models"
+	"itsm/password"
+	"itsm/testenv"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const newPassword = "Zelenyj-Kot-42"
+
+// resetTest - база с пользователем, у которого указан адрес почты, и приемник писем
+func resetTest(t *testing.T) (models.User, *mailer.MemorySink) {
+	db = testenv.Open(t)
+	user := testenv.User(t, db, "ivanov")
+	if err := db.Model(&user).Update("email", "ivanov@example.com").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	sink := mailer.NewMemorySink()
+	mailer.Configure(sink)
+	ConfigurePasswordReset("https://itsm.example.com", time.Hour)
+	return user, sink
+}
+
+func requestReset(t *testing.T, login string) {
+	t.Helper()
+	if err := requestPasswordReset(httptest.NewRequest("POST", "/password/forgot", nil), login); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitMessages ждет count писем: письмо отправляется в фоне
+func waitMessages(t *testing.T, sink *mailer.MemorySink, count int) []mailer.Message {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if messages := sink.Messages(); len(messages) >= count {
+			return messages
+		}
+	}
+	t.Fatalf("sent %d messages, want %d", len(sink.Messages()), count)
+	return nil
+}
+
+// linkToken достает токен из ссылки в письме
+func linkToken(t *testing.T, msg mailer.Message) string {
+	t.Helper()
+	const prefix = "https://itsm.example.com/password/reset?"
+	start := strings.Index(msg.Body, prefix)
+	if start < 0 {
+		t.Fatalf("no reset link in message:\n%s", msg.Body)
+	}
+	link, _, _ := strings.Cut(msg.Body[start+len(prefix):], "\n")
+	query, err := url.ParseQuery(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query.Get("token")
+}
+
+func reset(token string) error {
+	return resetPassword(httptest.NewRequest("POST", "/password/reset", nil), token, newPassword)
+}
+
+func tokenCount(t *testing.T) int64 {
+	t.Helper()
+	var count int64
+	if err := db.Model(&models.PasswordResetToken{}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestPasswordResetFlow(t *testing.T) {
+	user, sink := resetTest(t)
+
+	requestReset(t, "ivanov@example.com")
+	msg := waitMessages(t, sink, 1)[0]
+	if msg.To != "ivanov@example.com" {
+		t.Errorf("To = %q", msg.To)
+	}
+	token := linkToken(t, msg)
+
+	if err := reset(token); err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+	if err := db.First(&user, user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !password.Matches(user.Password, newPassword) {
+		t.Error("password was not changed")
+	}
+
+	if err := reset(token); !errors.Is(err, errInvalidResetToken) {
+		t.Errorf("second reset = %v, want %v", err, errInvalidResetToken)
+	}
+}
+
+func TestPasswordResetWeakPassword(t *testing.T) {
+	_, sink := resetTest(t)
+
+	requestReset(t, "ivanov")
+	token := linkToken(t, waitMessages(t, sink, 1)[0])
+
+	var policyErr *password.Error
+	err := resetPassword(httptest.NewRequest("POST", "/password/reset", nil), token, "short")
+	if !errors.As(err, &policyErr) {
+		t.Fatalf("reset with weak password = %v, want policy error", err)
+	}
+	// Неподходящий пароль не расходует ссылку
+	if err := reset(token); err != nil {
+		t.Errorf("reset after weak password: %v", err)
+	}
+}
+
+func TestPasswordResetExpired(t *testing.T) {
+	_, sink := resetTest(t)
+
+	requestReset(t, "ivanov")
+	token := linkToken(t, waitMessages(t, sink, 1)[0])
+
+	err := db.Model(&models.PasswordResetToken{}).Where("token_hash = ?", hashResetToken(token)).
+		Update("expires_at", time.Now().Add(-time.Minute)).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reset(token); !errors.Is(err, errInvalidResetToken) {
+		t.Errorf("reset with expired token = %v, want %v", err, errInvalidResetToken)
+	}
+}
+
+func TestPasswordResetInterval(t *testing.T) {
+	_, sink := resetTest(t)
+
+	requestReset(t, "ivanov")
+	first := linkToken(t, waitMessages(t, sink, 1)[0])
+
+	// Повторный запрос в течение минуты не создает ссылку и не отправляет письмо
+	requestReset(t, "ivanov")
+	if count := tokenCount(t); count != 1 {
+		t.Fatalf("tokens after repeated request = %d, want 1", count)
+	}
+
+	err := db.Model(&models.PasswordResetToken{}).Where("1 = 1").
+		Update("created_at", time.Now().Add(-resetInterval-time.Second)).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestReset(t, "ivanov")
+	messages := waitMessages(t, sink, 2)
+	if len(messages) != 2 {
+		t.Fatalf("sent %d messages, want 2", len(messages))
+	}
+	second := linkToken(t, messages[1])
+
+	// Новая ссылка отменяет прежнюю
+	if err := reset(first); !errors.Is(err, errInvalidResetToken) {
+		t.Errorf("reset with replaced token = %v, want %v", err, errInvalidResetToken)
+	}
+	if err := reset(second); err != nil {
+		t.Errorf("reset with new token: %v", err)
+	}
+}
+
+func TestPasswordResetUnknownLogin(t *testing.T) {
+	resetTest(t)
+
+	requestReset(t, "nobody@example.com")
+	if count := tokenCount(t); count != 0 {
+		t.Errorf("tokens for unknown login = %d, want 0", count)
+	}
+}
+
+func TestPasswordResetNoRecoveryAddress(t *testing.T) {
+	_, sink := resetTest(t)
+	testenv.User(t, db, "petrov")
+
+	err := requestPasswordReset(httptest.NewRequest("POST", "/password/forgot", nil), "petrov")
+	if !errors.Is(err, errNoRecoveryAddress) {
+		t.Errorf("reset without email = %v, want %v", err, errNoRecoveryAddress)
+	}
+	if count := tokenCount(t); count != 0 || len(sink.Messages()) != 0 {
+		t.Errorf("tokens = %d, messages = %d, want none", count, len(sink.Messages()))
+	}
+}
@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"github.com/gorilla/mux"
+	"itsm/listener"
+	"itsm/loginguard"
+	"itsm/sso"
+	"itsm/twofactor"
+	"itsm/utils"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Вход через провайдера OpenID Connect. Параметры запроса авторизации хранятся
+// в сессии до возврата пользователя: state защищает от подделки ответа, nonce -
+// от подмены ID-токена, verifier - от перехвата кода (PKCE)
+
+// Ключи сессии для незавершенного входа через провайдера
+const (
+	ssoProviderKey = "ssoProvider"
+	ssoStateKey    = "ssoState"
+	ssoNonceKey    = "ssoNonce"
+	ssoVerifierKey = "ssoVerifier"
+	ssoRedirectKey = "ssoRedirect"
+	ssoTimeKey     = "ssoTime"
+)
+
+// Сколько ждать возврата пользователя от провайдера
+const ssoTimeout = 10 * time.Minute
+
+var ssoKeys = []string{ssoProviderKey, ssoStateKey, ssoNonceKey, ssoVerifierKey, ssoRedirectKey, ssoTimeKey}
+
+func ssoLoginHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := sso.Find(mux.Vars(r)["provider"])
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Пользователь возвращается на тот же слушатель: state хранится в его cookie
+	redirectURL := ""
+	if base := listener.PublicURL(r); base != "" {
+		redirectURL = base + "/login/sso/" + provider.Name() + "/callback"
+	}
+	url, req, err := provider.AuthURL(r.Context(), redirectURL)
+	if err != nil {
+		log.Println("Ошибка при обращении к провайдеру входа:", err)
+		renderLoginPage(w, "Провайдер входа недоступен. Попробуйте позже")
+		return
+	}
+
+	curSession, err := utils.GetCurSession(r)
+	if err != nil {
+		log.Println("Не удалось прочитать сессию:", err)
+	}
+	curSession.Values[ssoProviderKey] = provider.Name()
+	curSession.Values[ssoStateKey] = req.State
+	curSession.Values[ssoNonceKey] = req.Nonce
+	curSession.Values[ssoVerifierKey] = req.Verifier
+	curSession.Values[ssoRedirectKey] = req.RedirectURL
+	curSession.Values[ssoTimeKey] = time.Now().Unix()
+	if err := curSession.Save(r, w); err != nil {
+		log.Println("Ошибка сохранения сессии:", err)
+		http.Error(w, "Ошибка сохранения сессии", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+func ssoCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := sso.Find(mux.Vars(r)["provider"])
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	curSession, err := utils.GetCurSession(r)
+	if err != nil {
+		log.Println("Не удалось прочитать сессию:", err)
+	}
+	name, _ := curSession.Values[ssoProviderKey].(string)
+	req := sso.Request{}
+	req.State, _ = curSession.Values[ssoStateKey].(string)
+	req.Nonce, _ = curSession.Values[ssoNonceKey].(string)
+	req.Verifier, _ = curSession.Values[ssoVerifierKey].(string)
+	req.RedirectURL, _ = curSession.Values[ssoRedirectKey].(string)
+	started, _ := curSession.Values[ssoTimeKey].(int64)
+	// Запрос авторизации одноразовый
+	for _, key := range ssoKeys {
+		delete(curSession.Values, key)
+	}
+
+	state := r.URL.Query().Get("state")
+	if name != provider.Name() || req.State == "" || time.Since(time.Unix(started, 0)) > ssoTimeout ||
+		subtle.ConstantTimeCompare([]byte(state), []byte(req.State)) != 1 {
+		saveSession(w, r)
+		renderLoginPage(w, "Время входа истекло. Попробуйте еще раз")
+		return
+	}
+	if r.URL.Query().Get("error") != "" {
+		log.Printf("Провайдер %s отказал во входе: %s %s", provider.Name(),
+			r.URL.Query().Get("error"), r.URL.Query().Get("error_description"))
+		saveSession(w, r)
+		renderLoginPage(w, "Вход через провайдера отменен")
+		return
+	}
+
+	claims, err := provider.Exchange(r.Context(), r.URL.Query().Get("code"), req)
+	if err != nil {
+		log.Println("Ошибка при входе через провайдера:", err)
+		saveSession(w, r)
+		renderLoginPage(w, "Не удалось войти через провайдера. Попробуйте еще раз")
+		return
+	}
+
+	user, err := provider.Resolve(db, r, claims)
+	if err != nil {
+		var loginErr *sso.LoginError
+		if !errors.As(err, &loginErr) {
+			log.Println("Ошибка при входе через провайдера:", err)
+			loginErr = &sso.LoginError{Message: serverErrorText}
+		}
+		saveSession(w, r)
+		renderLoginPage(w, loginErr.Message)
+		return
+	}
+
+	guard := loginguard.Begin(db, r, user.Username)
+	defer guard.End()
+	errorMessage := ""
+	if err := guard.Check(&user); err != nil {
+		var denied *loginguard.Denied
+		if errors.As(err, &denied) {
+			errorMessage = denied.Error()
+		} else {
+			log.Println("Ошибка при проверке попыток входа:", err)
+			errorMessage = serverErrorText
+		}
+	} else if user.DeactivatedAt != nil {
+		if err := guard.Failure(&user, loginguard.ResultDeactivated); err != nil {
+			log.Println("Ошибка при записи попытки входа:", err)
+		}
+		errorMessage = "Учетная запись отключена. Обратитесь к администратору"
+	}
+	if errorMessage != "" {
+		saveSession(w, r)
+		renderLoginPage(w, errorMessage)
+		return
+	}
+
+	// Двухфакторная аутентификация системы действует и при входе через провайдера
+	if twofactor.Enabled(user) {
+		beginSecondFactor(w, r, user.ID)
+		return
+	}
+	if err := guard.Success(&user); err != nil {
+		log.Println("Ошибка при записи попытки входа:", err)
+	}
+	startSession(w, r, user.ID)
+}
+
+// saveSession сохраняет сессию после удаления параметров входа
+func saveSession(w http.ResponseWriter, r *http.Request) {
+	curSession, err := utils.GetCurSession(r)
+	if err != nil {
+		return
+	}
+	if err := curSession.Save(r, w); err != nil {
+		log.Println("Ошибка сохранения сессии:", err)
+	}
+}
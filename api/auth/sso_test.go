@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"github.com/gorilla/mux"
+	"itsm/models"
+	"itsm/sso"
+	"itsm/sso/ssotest"
+	"itsm/testenv"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+// ssoTest - маршруты входа и провайдер, через который входит пользователь
+type ssoTest struct {
+	t      *testing.T
+	router *mux.Router
+	idp    *ssotest.IdP
+}
+
+func newSSOTest(t *testing.T) *ssoTest {
+	// Страница входа загружает шаблоны относительно корня репозитория
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir("../.."); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	database := testenv.Open(t)
+	router := mux.NewRouter()
+	SetupRoutes(router, database)
+
+	idp := ssotest.New(t, "itsm")
+	config := sso.DefaultConfig
+	config.Name = "corp"
+	config.Title = "Corp"
+	config.Issuer = idp.Issuer()
+	config.ClientID = "itsm"
+	config.RedirectURL = "https://itsm.example.com/login/sso/corp/callback"
+	sso.Configure(config)
+	t.Cleanup(func() { sso.Configure() })
+	idp.Claims = map[string]interface{}{"sub": "subject-1", "preferred_username": "ivanov"}
+
+	return &ssoTest{t: t, router: router, idp: idp}
+}
+
+func (s *ssoTest) do(path string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	s.t.Helper()
+	req := httptest.NewRequest("GET", path, nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w
+}
+
+// begin начинает вход и возвращает cookie сессии и адрес возврата от провайдера
+func (s *ssoTest) begin() ([]*http.Cookie, *url.URL) {
+	s.t.Helper()
+	w := s.do("/login/sso/corp", nil)
+	if w.Code != http.StatusFound {
+		s.t.Fatalf("login: status %d, body %s", w.Code, w.Body)
+	}
+	return w.Result().Cookies(), s.idp.Authorize(s.t, w.Header().Get("Location"))
+}
+
+// withState заменяет state в адресе возврата
+func withState(callback *url.URL, state string) string {
+	query := callback.Query()
+	query.Set("state", state)
+	return callback.Path + "?" + query.Encode()
+}
+
+func expectLoginError(t *testing.T, w *httptest.ResponseRecorder, message string) {
+	t.Helper()
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), message) {
+		t.Errorf("status %d, want login page with %q; body:\n%s", w.Code, message, w.Body)
+	}
+}
+
+func TestSSOCallback(t *testing.T) {
+	s := newSSOTest(t)
+
+	cookies, callback := s.begin()
+	w := s.do(callback.RequestURI(), cookies)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/dashboard" {
+		t.Fatalf("callback: status %d, location %q, body %s", w.Code, w.Header().Get("Location"), w.Body)
+	}
+
+	var user models.User
+	if err := db.Where("username = ?", "ivanov").First(&user).Error; err != nil {
+		t.Fatalf("user was not created: %v", err)
+	}
+
+	// Код авторизации одноразовый: повтор ответа провайдера со старой cookie отклоняется
+	expectLoginError(t, s.do(callback.RequestURI(), cookies), "Не удалось войти через провайдера")
+}
+
+func TestSSOCallbackStateMismatch(t *testing.T) {
+	s := newSSOTest(t)
+
+	cookies, callback := s.begin()
+	w := s.do(withState(callback, "forged-state"), cookies)
+	expectLoginError(t, w, "Время входа истекло")
+	if len(s.idp.Verifiers()) != 0 {
+		t.Error("code was exchanged despite state mismatch")
+	}
+
+	// После отказа параметры входа удалены из сессии, и верный state уже не подходит
+	expectLoginError(t, s.do(callback.RequestURI(), w.Result().Cookies()), "Время входа истекло")
+}
+
+func TestSSOCallbackWithoutSession(t *testing.T) {
+	s := newSSOTest(t)
+
+	_, callback := s.begin()
+	expectLoginError(t, s.do(callback.RequestURI(), nil), "Время входа истекло")
+	if len(s.idp.Verifiers()) != 0 {
+		t.Error("code was exchanged without a login session")
+	}
+}
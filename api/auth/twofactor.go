@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"errors"
+	"html/template"
+	"itsm/loginguard"
+	"itsm/models"
+	"itsm/twofactor"
+	"itsm/utils"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Второй шаг входа. После проверки пароля в сессии запоминается только ID
+// пользователя, ожидающего ввода кода; вошедшим он становится после проверки кода
+
+// Ключи сессии для незавершенного входа
+const (
+	pendingUserKey = "pendingUserID"
+	pendingTimeKey = "pendingTime"
+)
+
+// Сколько ждать код после ввода пароля
+const pendingTimeout = 5 * time.Minute
+
+// beginSecondFactor запоминает пользователя, прошедшего проверку пароля,
+// и переходит к вводу кода
+func beginSecondFactor(w http.ResponseWriter, r *http.Request, userID uint) {
+	curSession, err := utils.GetCurSession(r)
+	if err != nil {
+		log.Println("Не удалось прочитать сессию:", err)
+	}
+
+	curSession.ID = ""
+	delete(curSession.Values, "userID")
+	curSession.Values[pendingUserKey] = userID
+	curSession.Values[pendingTimeKey] = time.Now().Unix()
+	if err := curSession.Save(r, w); err != nil {
+		log.Println("Ошибка сохранения сессии:", err)
+		http.Error(w, "Ошибка сохранения сессии", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+}
+
+// pendingUser возвращает ID пользователя, ожидающего ввода кода
+func pendingUser(r *http.Request) (uint, bool) {
+	curSession, err := utils.GetCurSession(r)
+	if err != nil {
+		return 0, false
+	}
+	userID, ok := curSession.Values[pendingUserKey].(uint)
+	started, _ := curSession.Values[pendingTimeKey].(int64)
+	if !ok || time.Since(time.Unix(started, 0)) > pendingTimeout {
+		return 0, false
+	}
+	return userID, true
+}
+
+func secondFactorHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := pendingUser(r)
+	if !ok {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	errorMessage := ""
+	if r.Method == http.MethodPost {
+		var done bool
+		done, errorMessage = verifySecondFactor(r, userID)
+		if done {
+			startSession(w, r, userID)
+			return
+		}
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/auth/twofactor.html"))
+	err := tmpl.Execute(w, map[string]interface{}{
+		"ErrorMessage": errorMessage})
+
+	if err != nil {
+		log.Println("Ошибка при выполнении шаблона:", err)
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+	}
+}
+
+// verifySecondFactor проверяет код из приложения или резервный код.
+// Неудачи учитываются вместе с неудачами ввода пароля
+func verifySecondFactor(r *http.Request, userID uint) (bool, string) {
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		log.Println("Ошибка при выполнении запроса:", err)
+		return false, serverErrorText
+	}
+	if user.DeactivatedAt != nil {
+		return false, "Учетная запись отключена. Обратитесь к администратору"
+	}
+
+	guard := loginguard.Begin(db, r, user.Username)
+	defer guard.End()
+
+	if err := guard.Check(&user); err != nil {
+		var denied *loginguard.Denied
+		if errors.As(err, &denied) {
+			return false, denied.Error()
+		}
+		log.Println("Ошибка при проверке попыток входа:", err)
+		return false, serverErrorText
+	}
+
+	if err := twofactor.Verify(db, &user, r.FormValue("code")); err != nil {
+		if !errors.Is(err, twofactor.ErrInvalidCode) {
+			log.Println("Ошибка при проверке кода:", err)
+			return false, serverErrorText
+		}
+		if err := guard.Failure(&user, loginguard.ResultInvalidCode); err != nil {
+			log.Println("Ошибка при записи попытки входа:", err)
+		}
+		return false, "Неверный код"
+	}
+
+	if err := guard.Success(&user); err != nil {
+		log.Println("Ошибка при записи попытки входа:", err)
+	}
+	return true, ""
+}
@@ -3,12 +3,18 @@ package dashboard
 import (
 	"github.com/gorilla/mux"
 	"gorm.io/gorm"
-	"html/template"
+	"itsm/calendar"
+	"itsm/filter"
+	"itsm/middleware"
 	"itsm/models"
+	"itsm/openapi"
+	"itsm/rbac"
+	"itsm/sla"
+	"itsm/utils"
 	"log"
+	"time"
 
 	_ "itsm/session"
-	"itsm/utils"
 	"net/http"
 )
 
@@ -18,33 +24,35 @@ type IncidentWithUser struct {
 	models.Incident
 	AuthorUsername      string
 	ResponsibleUsername string
+	SLA                 sla.Status `gorm:"-"`
 }
 
 func SetupRoutes(r *mux.Router, database *gorm.DB) {
 	db = database
 	r.HandleFunc("/dashboard", dashboardHandler)
 	r.HandleFunc("/business-services", businessServicesHandler)
-	r.HandleFunc("/technical-services", technicalServicesHandler)
+	middleware.RequirePermission(r.HandleFunc("/technical-services", technicalServicesHandler), rbac.PermServiceViewTech)
 	r.HandleFunc("/incidents", incidentsHandler)
-	r.HandleFunc("/messenger", messengerHandler)
+	middleware.RequirePermission(r.HandleFunc("/messenger", messengerHandler), rbac.PermMessengerUse)
+	r.HandleFunc("/incidents/views", saveViewHandler).Methods("POST")
+	r.HandleFunc("/incidents/views/{id:[0-9]+}/delete", deleteViewHandler).Methods("POST")
+	r.HandleFunc("/incidents/views/{id:[0-9]+}/default", defaultViewHandler).Methods("POST")
+	openapi.JSON(r.HandleFunc("/incidents/queues/counts", queueCountsHandler).Methods("GET"))
 }
 
 func dashboardHandler(w http.ResponseWriter, r *http.Request) {
-	isClient, err := utils.IsClientUser(r)
-	if err != nil {
-		http.Error(w, "Ошибка получения сессии: "+err.Error(), http.StatusUnauthorized)
-		return
-	}
+	user, _ := middleware.CurrentUser(r)
+	isClient := rbac.IsClient(user)
 
-	tmpl, err := template.ParseFiles("templates/dashboard/dashboard.html",
-		"templates/header/header.html")
+	tmpl, err := utils.ParsePage(r, "templates/dashboard/dashboard.html", nil)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	err = tmpl.Execute(w, map[string]interface{}{
-		"IsClient": isClient,
+		"IsClient":       isClient,
+		"CanManageUsers": rbac.Can(user, rbac.PermUserManage),
 	})
 	if err != nil {
 		http.Error(w, "Ошибка при выполнении шаблона", http.StatusInternalServerError)
@@ -53,45 +61,126 @@ func dashboardHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func incidentsHandler(w http.ResponseWriter, r *http.Request) {
-	curSession, err := utils.GetCurSession(r)
+	user, _ := middleware.CurrentUser(r)
+	isClient := rbac.IsClient(user)
+	canViewAll := rbac.Can(user, rbac.PermIncidentViewAll)
+	userID := user.ID
+
+	loc, err := time.LoadLocation(calendar.DefaultTimezone)
 	if err != nil {
-		http.Error(w, "Ошибка при получении сессии", http.StatusInternalServerError)
+		loc = time.Local
+	}
+
+	values, activeViewID, err := viewQuery(user, r)
+	if err != nil {
+		http.Error(w, "Сохраненный фильтр не найден", http.StatusNotFound)
 		return
 	}
 
-	isAdmin := curSession.Values["isAdmin"].(bool)
-	isTechOfficer := curSession.Values["isTechOfficer"].(bool)
-	isClient, _ := utils.IsClientUser(r)
-	userID := curSession.Values["userID"].(uint)
+	incidentFilter, err := filter.Parse(values, loc)
+	if err != nil {
+		http.Error(w, "Некорректные параметры фильтра: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	incidentFilter = incidentFilter.WithUser(userID)
+
+	views, err := accessibleViews(user)
+	if err != nil {
+		http.Error(w, "Ошибка при получении сохраненных фильтров", http.StatusInternalServerError)
+		return
+	}
+
+	saveFilter := incidentFilter
+	saveFilter.Page = 1
+
+	var defaultViewID uint
+	if user.DefaultViewID != nil {
+		defaultViewID = *user.DefaultViewID
+	}
 
 	var incidentsWithUsers []IncidentWithUser
 	var query *gorm.DB
 
-	query = db.Table("incidents").
+	query = db.Table("incidents")
+	if !canViewAll {
+		query = query.Where("incidents.user_id = ?", userID)
+	}
+	query = incidentFilter.Apply(query)
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		log.Printf("Ошибка при подсчете инцидентов: %v", err)
+		http.Error(w, "Ошибка при получении инцидентов", http.StatusInternalServerError)
+		return
+	}
+
+	query = query.
 		Select("incidents.*, users.username AS author_username, responsible_users.username AS responsible_username").
 		Joins("JOIN users ON users.id = incidents.user_id").
 		Joins("LEFT JOIN users AS responsible_users ON responsible_users.id = incidents.responsible_user_id")
 
-	if !isAdmin && !isTechOfficer {
-		query = query.Where("incidents.user_id = ?", userID)
-	}
-
+	query = incidentFilter.Paginate(incidentFilter.Order(query))
 	if err := query.Scan(&incidentsWithUsers).Error; err != nil {
 		log.Printf("Ошибка при получении инцидентов: %v", err)
 		http.Error(w, "Ошибка при получении инцидентов", http.StatusInternalServerError)
 		return
 	}
 
-	tmpl, err := template.ParseFiles("templates/incidents/incidents.html",
-		"templates/header/header.html")
+	// Списки для полей фильтра
+	var officers, authors []models.User
+	var services []models.Service
+	if canViewAll {
+		if err := db.Scopes(rbac.WithPermission(rbac.PermIncidentWork)).Order("username").Find(&officers).Error; err != nil {
+			http.Error(w, "Ошибка при загрузке пользователей", http.StatusInternalServerError)
+			return
+		}
+		if err := db.Order("username").Find(&authors).Error; err != nil {
+			http.Error(w, "Ошибка при загрузке пользователей", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := db.Order("name").Find(&services).Error; err != nil {
+		http.Error(w, "Ошибка при получении услуг", http.StatusInternalServerError)
+		return
+	}
+
+	incidentsList := make([]models.Incident, len(incidentsWithUsers))
+	for i, incident := range incidentsWithUsers {
+		incidentsList[i] = incident.Incident
+	}
+	slaStatuses, err := sla.EvaluateMany(db, incidentsList, time.Now())
+	if err != nil {
+		log.Printf("Ошибка при расчете SLA: %v", err)
+		http.Error(w, "Ошибка при расчете SLA", http.StatusInternalServerError)
+		return
+	}
+	for i := range incidentsWithUsers {
+		incidentsWithUsers[i].SLA = slaStatuses[incidentsWithUsers[i].ID]
+	}
+
+	tmpl, err := utils.ParsePage(r, "templates/incidents/incidents.html", nil)
 	if err != nil {
 		http.Error(w, "Ошибка при загрузке шаблона", http.StatusInternalServerError)
 		return
 	}
 
 	data := map[string]interface{}{
-		"Incidents": incidentsWithUsers,
-		"IsClient":  isClient,
+		"Incidents":     incidentsWithUsers,
+		"IsClient":      isClient,
+		"IsStaff":       canViewAll,
+		"Filter":        incidentFilter,
+		"Page":          incidentFilter.NewPage(total),
+		"Statuses":      models.IncidentStatuses,
+		"Priorities":    []int{1, 2, 3, 4, 5},
+		"Officers":      officers,
+		"Authors":       authors,
+		"Services":      services,
+		"Queues":        filter.Queues,
+		"Views":         views,
+		"ViewID":        activeViewID,
+		"DefaultViewID": defaultViewID,
+		"User":          user,
+		"SaveQuery":     saveFilter.Values().Encode(),
 	}
 
 	if err := tmpl.Execute(w, data); err != nil {
@@ -103,27 +192,17 @@ func incidentsHandler(w http.ResponseWriter, r *http.Request) {
 func businessServicesHandler(w http.ResponseWriter, r *http.Request) {
 	var services []models.Service
 
-	curSession, err := utils.GetCurSession(r)
-	if err != nil {
-		http.Error(w, "Ошибка получения сессии: "+err.Error(), http.StatusUnauthorized)
-		return
-	}
-
-	isClient, err := utils.IsClientUser(r)
-	if err != nil {
-		http.Error(w, "Ошибка получения сессии: "+err.Error(), http.StatusUnauthorized)
-		return
-	}
-
-	isAdmin := curSession.Values["isAdmin"].(bool)
+	user, _ := middleware.CurrentUser(r)
+	isClient := rbac.IsClient(user)
+	canManage := rbac.CanAny(user, rbac.PermServiceUpdate, rbac.PermServiceDelete)
+	canCreate := rbac.Can(user, rbac.PermServiceCreate)
 
 	if err := db.Where("is_business = ?", true).Find(&services).Error; err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	tmpl, err := template.ParseFiles("templates/services/services.html",
-		"templates/header/header.html")
+	tmpl, err := utils.ParsePage(r, "templates/services/services.html", nil)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -133,7 +212,8 @@ func businessServicesHandler(w http.ResponseWriter, r *http.Request) {
 	// Передаем данные в шаблон, включая права доступа
 	err = tmpl.Execute(w, map[string]interface{}{
 		"Services":   services,
-		"IsAdmin":    isAdmin,
+		"CanManage":  canManage,
+		"CanCreate":  canCreate,
 		"IsBusiness": true,
 		"IsClient":   isClient,
 	})
@@ -145,21 +225,16 @@ func businessServicesHandler(w http.ResponseWriter, r *http.Request) {
 func technicalServicesHandler(w http.ResponseWriter, r *http.Request) {
 	var services []models.Service
 
-	curSession, err := utils.GetCurSession(r)
-	if err != nil {
-		http.Error(w, "Ошибка получения сессии: "+err.Error(), http.StatusUnauthorized)
-		return
-	}
-
-	isAdmin := curSession.Values["isAdmin"].(bool)
+	user, _ := middleware.CurrentUser(r)
+	canManage := rbac.CanAny(user, rbac.PermServiceUpdate, rbac.PermServiceDelete)
+	canCreate := rbac.Can(user, rbac.PermServiceCreate)
 
 	if err := db.Where("is_technical = ?", true).Find(&services).Error; err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	tmpl, err := template.ParseFiles("templates/services/services.html",
-		"templates/header/header.html")
+	tmpl, err := utils.ParsePage(r, "templates/services/services.html", nil)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -169,7 +244,8 @@ func technicalServicesHandler(w http.ResponseWriter, r *http.Request) {
 	// Передаем данные в шаблон, включая права доступа
 	err = tmpl.Execute(w, map[string]interface{}{
 		"Services":    services,
-		"IsAdmin":     isAdmin, // Передаем информацию о правах доступа
+		"CanManage":   canManage, // Передаем информацию о правах доступа
+		"CanCreate":   canCreate,
 		"IsTechnical": true,
 	})
 	if err != nil {
@@ -178,28 +254,17 @@ func technicalServicesHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func messengerHandler(w http.ResponseWriter, r *http.Request) {
-	curSession, err := utils.GetCurSession(r)
-	if err != nil {
-		http.Error(w, "Ошибка получения сессии: "+err.Error(), http.StatusUnauthorized)
-		return
-	}
-
-	userID, ok := curSession.Values["userID"].(uint)
-	if !ok {
-		http.Error(w, "User not found in session", http.StatusUnauthorized)
-		return
-	}
+	user, _ := middleware.CurrentUser(r)
 
 	data := struct {
 		UserID   uint
 		IsClient bool
 	}{
-		UserID:   userID,
+		UserID:   user.ID,
 		IsClient: false,
 	}
 
-	tmpl, err := template.ParseFiles("templates/messenger/messenger.html",
-		"templates/header/header.html")
+	tmpl, err := utils.ParsePage(r, "templates/messenger/messenger.html", nil)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
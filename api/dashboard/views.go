@@ -0,0 +1,200 @@
+package dashboard
+
+import (
+	"errors"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"itsm/filter"
+	"itsm/middleware"
+	"itsm/models"
+	"itsm/rbac"
+	"itsm/utils"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// accessibleViews возвращает личные фильтры пользователя и фильтры его команды
+func accessibleViews(user models.User) ([]models.SavedView, error) {
+	query := db.Preload("Owner").Where("owner_id = ?", user.ID)
+	if user.TeamID != nil {
+		query = query.Or("team_id = ?", *user.TeamID)
+	}
+
+	var views []models.SavedView
+	err := query.Order("name").Find(&views).Error
+	return views, err
+}
+
+// findAccessibleView загружает фильтр, если он доступен пользователю
+func findAccessibleView(user models.User, viewID string) (models.SavedView, error) {
+	var view models.SavedView
+	if err := db.First(&view, viewID).Error; err != nil {
+		return view, err
+	}
+
+	if view.OwnerID != user.ID && (view.TeamID == nil || user.TeamID == nil || *view.TeamID != *user.TeamID) {
+		return view, gorm.ErrRecordNotFound
+	}
+	return view, nil
+}
+
+// viewQuery возвращает параметры списка инцидентов с учетом выбранного
+// или используемого по умолчанию сохраненного фильтра
+func viewQuery(user models.User, r *http.Request) (url.Values, uint, error) {
+	values := r.URL.Query()
+
+	viewID := values.Get("view")
+	if viewID == "" && len(values) == 0 && user.DefaultViewID != nil {
+		view, err := findAccessibleView(user, strconv.FormatUint(uint64(*user.DefaultViewID), 10))
+		if err == nil {
+			viewID = strconv.FormatUint(uint64(view.ID), 10)
+		}
+	}
+	if viewID == "" {
+		return values, 0, nil
+	}
+
+	view, err := findAccessibleView(user, viewID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	saved, err := url.ParseQuery(view.Query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Номер страницы и сортировка из адреса важнее сохраненных
+	for _, key := range []string{"page", "sort"} {
+		if value := values.Get(key); value != "" {
+			saved.Set(key, value)
+		}
+	}
+	return saved, view.ID, nil
+}
+
+func saveViewHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := middleware.CurrentUser(r)
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		http.Error(w, "Название фильтра не указано", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Проверяем, что сохраняемые параметры корректны
+	values, err := url.ParseQuery(r.FormValue("query"))
+	if err != nil {
+		http.Error(w, "Некорректные параметры фильтра", http.StatusBadRequest)
+		return
+	}
+	incidentFilter, err := filter.Parse(values, time.UTC)
+	if err != nil {
+		http.Error(w, "Некорректные параметры фильтра: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	incidentFilter.Page = 1
+
+	view := models.SavedView{
+		OwnerID: user.ID,
+		Name:    name,
+		Query:   incidentFilter.Values().Encode(),
+	}
+
+	if r.FormValue("shared") == "on" {
+		if user.TeamID == nil {
+			http.Error(w, "Вы не состоите в команде", http.StatusUnprocessableEntity)
+			return
+		}
+		view.TeamID = user.TeamID
+	}
+
+	if err := db.Create(&view).Error; err != nil {
+		http.Error(w, "Ошибка при сохранении фильтра", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/incidents?view="+strconv.FormatUint(uint64(view.ID), 10), http.StatusSeeOther)
+}
+
+func deleteViewHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := middleware.CurrentUser(r)
+
+	var view models.SavedView
+	if err := db.First(&view, mux.Vars(r)["id"]).Error; err != nil {
+		http.Error(w, "Фильтр не найден", http.StatusNotFound)
+		return
+	}
+
+	// Удалить фильтр может только его владелец
+	if view.OwnerID != user.ID {
+		http.Error(w, "Недостаточно прав", http.StatusForbidden)
+		return
+	}
+
+	if err := db.Delete(&view).Error; err != nil {
+		http.Error(w, "Ошибка при удалении фильтра", http.StatusInternalServerError)
+		return
+	}
+
+	if err := db.Model(&models.User{}).Where("default_view_id = ?", view.ID).
+		Update("default_view_id", nil).Error; err != nil {
+		http.Error(w, "Ошибка при удалении фильтра", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/incidents", http.StatusSeeOther)
+}
+
+// defaultViewHandler делает фильтр фильтром по умолчанию или сбрасывает его,
+// если фильтр уже выбран по умолчанию
+func defaultViewHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := middleware.CurrentUser(r)
+
+	view, err := findAccessibleView(user, mux.Vars(r)["id"])
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Фильтр не найден", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Ошибка при получении фильтра", http.StatusInternalServerError)
+		return
+	}
+
+	var defaultViewID *uint
+	if user.DefaultViewID == nil || *user.DefaultViewID != view.ID {
+		defaultViewID = &view.ID
+	}
+
+	if err := db.Model(&user).Update("default_view_id", defaultViewID).Error; err != nil {
+		http.Error(w, "Ошибка при сохранении фильтра по умолчанию", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/incidents?view="+strconv.FormatUint(uint64(view.ID), 10), http.StatusSeeOther)
+}
+
+// queueCountsHandler возвращает количество инцидентов во встроенных очередях
+func queueCountsHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := middleware.CurrentUser(r)
+
+	counts := make(map[string]int64, len(filter.Queues))
+	for _, queue := range filter.Queues {
+		query := db.Table("incidents")
+		if !rbac.Can(user, rbac.PermIncidentViewAll) {
+			query = query.Where("incidents.user_id = ?", user.ID)
+		}
+		query = filter.IncidentFilter{Queue: queue.Name}.WithUser(user.ID).Apply(query)
+
+		var count int64
+		if err := query.Count(&count).Error; err != nil {
+			http.Error(w, "Ошибка при подсчете инцидентов", http.StatusInternalServerError)
+			return
+		}
+		counts[queue.Name] = count
+	}
+
+	utils.SendJSON(w, counts)
+}
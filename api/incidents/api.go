@@ -0,0 +1,420 @@
+package incidents
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"itsm/calendar"
+	"itsm/filter"
+	"itsm/models"
+	"itsm/rbac"
+	"itsm/sla"
+	"itsm/utils"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// JSON API инцидентов для систем автоматизации и мониторинга.
+// Проверки прав и данных те же, что у HTML-обработчиков (см. operations.go)
+
+func setupAPIRoutes(r *mux.Router) {
+	api := r.PathPrefix("/api/v1/incidents").Subrouter()
+	api.HandleFunc("", apiListIncidentsHandler).Methods("GET")
+	api.HandleFunc("", apiCreateIncidentHandler).Methods("POST")
+	api.HandleFunc("/{id:[0-9]+}", apiGetIncidentHandler).Methods("GET")
+	api.HandleFunc("/{id:[0-9]+}", apiPatchIncidentHandler).Methods("PATCH")
+	api.HandleFunc("/{id:[0-9]+}/transition", apiTransitionHandler).Methods("POST")
+	api.HandleFunc("/{id:[0-9]+}/assign", apiAssignHandler).Methods("POST")
+	api.HandleFunc("/{id:[0-9]+}/services", apiServicesHandler).Methods("PUT")
+}
+
+// optionalID - ID в теле PATCH-запроса. Позволяет отличить отсутствующее поле
+// от явного null, которым снимается ответственный
+type optionalID struct {
+	Set   bool
+	Value *uint
+}
+
+func (o *optionalID) UnmarshalJSON(data []byte) error {
+	o.Set = true
+	if bytes.Equal(data, []byte("null")) {
+		o.Value = nil
+		return nil
+	}
+	var id uint
+	if err := json.Unmarshal(data, &id); err != nil {
+		return err
+	}
+	o.Value = &id
+	return nil
+}
+
+// Ответы API. Модели не отдаются напрямую, чтобы не раскрыть хеши паролей
+type userResponse struct {
+	ID       uint   `json:"id"`
+	Username string `json:"username"`
+}
+
+type serviceResponse struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+}
+
+type slaTimerResponse struct {
+	State            string     `json:"state"`
+	DueAt            *time.Time `json:"due_at"`
+	RemainingSeconds int64      `json:"remaining_seconds"`
+	Breached         bool       `json:"breached"`
+}
+
+type slaResponse struct {
+	State      string           `json:"state"`
+	Response   slaTimerResponse `json:"response"`
+	Resolution slaTimerResponse `json:"resolution"`
+}
+
+type incidentResponse struct {
+	ID           uint              `json:"id"`
+	Title        string            `json:"title"`
+	Description  string            `json:"description"`
+	Status       string            `json:"status"`
+	Resolution   string            `json:"resolution"`
+	StatusReason string            `json:"status_reason"`
+	Impact       int               `json:"impact"`
+	Urgency      int               `json:"urgency"`
+	Priority     int               `json:"priority"`
+	Author       userResponse      `json:"author"`
+	Responsible  *userResponse     `json:"responsible"`
+	Services     []serviceResponse `json:"services"`
+	SLA          slaResponse       `json:"sla"`
+	Transitions  []string          `json:"transitions,omitempty"`
+	CreatedAt    time.Time         `json:"created_at"`
+	UpdatedAt    time.Time         `json:"updated_at"`
+	RespondedAt  *time.Time        `json:"responded_at"`
+	ResolvedAt   *time.Time        `json:"resolved_at"`
+}
+
+type incidentListResponse struct {
+	Items      []incidentResponse `json:"items"`
+	Page       int                `json:"page"`
+	PageSize   int                `json:"page_size"`
+	Total      int64              `json:"total"`
+	TotalPages int                `json:"total_pages"`
+}
+
+func newSLATimerResponse(t sla.Timer) slaTimerResponse {
+	return slaTimerResponse{
+		State:            t.State(),
+		DueAt:            t.DueAt,
+		RemainingSeconds: int64(t.Remaining / time.Second),
+		Breached:         t.Breached,
+	}
+}
+
+func newIncidentResponse(incident models.Incident, status sla.Status) incidentResponse {
+	response := incidentResponse{
+		ID:           incident.ID,
+		Title:        incident.Title,
+		Description:  incident.Description,
+		Status:       incident.Status,
+		Resolution:   incident.Resolution,
+		StatusReason: incident.StatusReason,
+		Impact:       incident.Impact,
+		Urgency:      incident.Urgency,
+		Priority:     incident.Priority,
+		Author:       userResponse{ID: incident.User.ID, Username: incident.User.Username},
+		Services:     make([]serviceResponse, 0, len(incident.Services)),
+		SLA: slaResponse{
+			State:      status.State(),
+			Response:   newSLATimerResponse(status.Response),
+			Resolution: newSLATimerResponse(status.Resolution),
+		},
+		CreatedAt:   incident.CreatedAt,
+		UpdatedAt:   incident.UpdatedAt,
+		RespondedAt: incident.RespondedAt,
+		ResolvedAt:  incident.ResolvedAt,
+	}
+	if incident.ResponsibleUserID != nil {
+		response.Responsible = &userResponse{ID: incident.ResponsibleUser.ID, Username: incident.ResponsibleUser.Username}
+	}
+	for _, service := range incident.Services {
+		response.Services = append(response.Services, serviceResponse{ID: service.ID, Name: service.Name})
+	}
+	return response
+}
+
+func withRelations(query *gorm.DB) *gorm.DB {
+	return query.Preload("User").Preload("ResponsibleUser").Preload("Services")
+}
+
+// incidentDetails загружает инцидент со связями и SLA для ответа API
+func incidentDetails(a actor, id uint) (incidentResponse, error) {
+	var incident models.Incident
+	if err := withRelations(db).First(&incident, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return incidentResponse{}, utils.NewRequestError(http.StatusNotFound, "Инцидент не найден")
+		}
+		return incidentResponse{}, err
+	}
+	if !a.canView(&incident) {
+		return incidentResponse{}, utils.NewRequestError(http.StatusForbidden, "Недостаточно прав для просмотра инцидента")
+	}
+
+	statuses, err := sla.EvaluateMany(db, []models.Incident{incident}, time.Now())
+	if err != nil {
+		return incidentResponse{}, err
+	}
+
+	response := newIncidentResponse(incident, statuses[incident.ID])
+	for _, t := range availableTransitions(incident.Status, a.roles(&incident)) {
+		response.Transitions = append(response.Transitions, t.To)
+	}
+	return response, nil
+}
+
+// respondWithIncident отправляет актуальное состояние инцидента после изменения
+func respondWithIncident(w http.ResponseWriter, a actor, id uint, code int) {
+	response, err := incidentDetails(a, id)
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+	utils.WriteJSON(w, code, response)
+}
+
+func apiListIncidentsHandler(w http.ResponseWriter, r *http.Request) {
+	curActor, err := actorFromRequest(r)
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	loc, err := time.LoadLocation(calendar.DefaultTimezone)
+	if err != nil {
+		loc = time.Local
+	}
+
+	incidentFilter, err := filter.Parse(r.URL.Query(), loc)
+	if err != nil {
+		utils.SendJSONError(w, http.StatusBadRequest, "Некорректные параметры фильтра: "+err.Error())
+		return
+	}
+	incidentFilter = incidentFilter.WithUser(curActor.ID)
+
+	query := db.Model(&models.Incident{})
+	if !curActor.can(rbac.PermIncidentViewAll) {
+		query = query.Where("incidents.user_id = ?", curActor.ID)
+	}
+	query = incidentFilter.Apply(query)
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	var incidents []models.Incident
+	if err := withRelations(incidentFilter.Paginate(incidentFilter.Order(query))).Find(&incidents).Error; err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	statuses, err := sla.EvaluateMany(db, incidents, time.Now())
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	page := incidentFilter.NewPage(total)
+	response := incidentListResponse{
+		Items:      make([]incidentResponse, 0, len(incidents)),
+		Page:       page.Number,
+		PageSize:   incidentFilter.PageSize,
+		Total:      total,
+		TotalPages: page.TotalPages,
+	}
+	for _, incident := range incidents {
+		response.Items = append(response.Items, newIncidentResponse(incident, statuses[incident.ID]))
+	}
+	utils.SendJSON(w, response)
+}
+
+func apiGetIncidentHandler(w http.ResponseWriter, r *http.Request) {
+	curActor, err := actorFromRequest(r)
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	id, _ := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	respondWithIncident(w, curActor, uint(id), http.StatusOK)
+}
+
+type createIncidentRequest struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Impact      int    `json:"impact"`
+	Urgency     int    `json:"urgency"`
+	ServiceIDs  []uint `json:"service_ids"`
+}
+
+func apiCreateIncidentHandler(w http.ResponseWriter, r *http.Request) {
+	curActor, err := actorFromRequest(r)
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	var req createIncidentRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	incident, err := createIncident(curActor, incidentInput{
+		Title:       req.Title,
+		Description: req.Description,
+		Impact:      req.Impact,
+		Urgency:     req.Urgency,
+		ServiceIDs:  req.ServiceIDs,
+	})
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/api/v1/incidents/"+strconv.FormatUint(uint64(incident.ID), 10))
+	respondWithIncident(w, curActor, incident.ID, http.StatusCreated)
+}
+
+// applyAPIChanges загружает инцидент, применяет изменения и отправляет результат
+func applyAPIChanges(w http.ResponseWriter, r *http.Request, curActor actor, changes incidentChanges) {
+	incident, err := findIncident(curActor, mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	if err := updateIncident(curActor, &incident, changes); err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	respondWithIncident(w, curActor, incident.ID, http.StatusOK)
+}
+
+type patchIncidentRequest struct {
+	ResponsibleUserID optionalID `json:"responsible_user_id"`
+	Impact            *int       `json:"impact"`
+	Urgency           *int       `json:"urgency"`
+	ServiceIDs        *[]uint    `json:"service_ids"`
+	Status            string     `json:"status"`
+	Resolution        string     `json:"resolution"`
+	Reason            string     `json:"reason"`
+}
+
+func apiPatchIncidentHandler(w http.ResponseWriter, r *http.Request) {
+	curActor, err := actorFromRequest(r)
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	var req patchIncidentRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	changes := incidentChanges{
+		SetResponsible:    req.ResponsibleUserID.Set,
+		ResponsibleUserID: req.ResponsibleUserID.Value,
+		Impact:            req.Impact,
+		Urgency:           req.Urgency,
+		ServiceIDs:        req.ServiceIDs,
+	}
+	if req.Status != "" {
+		changes.Transition = &transitionRequest{To: req.Status, Resolution: req.Resolution, Reason: req.Reason}
+	}
+
+	applyAPIChanges(w, r, curActor, changes)
+}
+
+type transitionAPIRequest struct {
+	Status     string `json:"status"`
+	Resolution string `json:"resolution"`
+	Reason     string `json:"reason"`
+}
+
+func apiTransitionHandler(w http.ResponseWriter, r *http.Request) {
+	curActor, err := actorFromRequest(r)
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	var req transitionAPIRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+	if req.Status == "" {
+		utils.SendJSONError(w, http.StatusUnprocessableEntity, "Не указан новый статус")
+		return
+	}
+
+	applyAPIChanges(w, r, curActor, incidentChanges{
+		Transition: &transitionRequest{To: req.Status, Resolution: req.Resolution, Reason: req.Reason},
+	})
+}
+
+type assignRequest struct {
+	ResponsibleUserID optionalID `json:"responsible_user_id"`
+}
+
+func apiAssignHandler(w http.ResponseWriter, r *http.Request) {
+	curActor, err := actorFromRequest(r)
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	var req assignRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+	if !req.ResponsibleUserID.Set {
+		utils.SendJSONError(w, http.StatusUnprocessableEntity, "Не указан ответственный")
+		return
+	}
+
+	applyAPIChanges(w, r, curActor, incidentChanges{
+		SetResponsible:    true,
+		ResponsibleUserID: req.ResponsibleUserID.Value,
+	})
+}
+
+type servicesRequest struct {
+	ServiceIDs []uint `json:"service_ids"`
+}
+
+func apiServicesHandler(w http.ResponseWriter, r *http.Request) {
+	curActor, err := actorFromRequest(r)
+	if err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	var req servicesRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	serviceIDs := req.ServiceIDs
+	applyAPIChanges(w, r, curActor, incidentChanges{ServiceIDs: &serviceIDs})
+}
@@ -0,0 +1,225 @@
+package incidents
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"itsm/middleware"
+	"itsm/models"
+	"itsm/rbac"
+	"itsm/testenv"
+	"itsm/utils"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// apiTest - маршрутизатор с JSON API инцидентов и пользователи с токенами
+type apiTest struct {
+	t      *testing.T
+	db     *gorm.DB
+	router *mux.Router
+	tokens map[string]string
+	users  map[string]models.User
+}
+
+func newAPITest(t *testing.T) *apiTest {
+	database := testenv.Open(t)
+	router := mux.NewRouter()
+	router.Use(middleware.Authenticate(database))
+	SetupRoutes(router, database)
+
+	test := &apiTest{t: t, db: database, router: router, tokens: map[string]string{}, users: map[string]models.User{}}
+	for name, roles := range map[string][]string{
+		"client":  nil,
+		"other":   nil,
+		"officer": {rbac.RoleTechOfficer},
+	} {
+		user := testenv.User(t, database, name, roles...)
+		test.users[name] = user
+		test.tokens[name] = testenv.Token(t, database, user)
+	}
+	return test
+}
+
+// do отправляет запрос от имени пользователя и разбирает JSON-ответ в result
+func (a *apiTest) do(user, method, path, body string, result interface{}) *httptest.ResponseRecorder {
+	a.t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+a.tokens[user])
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	a.router.ServeHTTP(rec, req)
+	if result != nil && rec.Code < 300 {
+		if err := json.Unmarshal(rec.Body.Bytes(), result); err != nil {
+			a.t.Fatalf("%s %s: %v: %s", method, path, err, rec.Body)
+		}
+	}
+	return rec
+}
+
+// create создает инцидент и возвращает его ID
+func (a *apiTest) create(user, title string) uint {
+	a.t.Helper()
+	var incident incidentResponse
+	rec := a.do(user, "POST", "/api/v1/incidents", `{"title":"`+title+`","impact":2,"urgency":2}`, &incident)
+	if rec.Code != http.StatusCreated {
+		a.t.Fatalf("создание инцидента: %d %s", rec.Code, rec.Body)
+	}
+	return incident.ID
+}
+
+func incidentPath(id uint) string {
+	return "/api/v1/incidents/" + strconv.FormatUint(uint64(id), 10)
+}
+
+// expectError проверяет код ответа и JSON с описанием ошибки
+func expectError(t *testing.T, rec *httptest.ResponseRecorder, code int) {
+	t.Helper()
+	if rec.Code != code {
+		t.Fatalf("код ответа %d, ожидался %d: %s", rec.Code, code, rec.Body)
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error == "" {
+		t.Fatalf("ответ без описания ошибки: %s", rec.Body)
+	}
+}
+
+func TestCreateIncident(t *testing.T) {
+	a := newAPITest(t)
+
+	var incident incidentResponse
+	rec := a.do("client", "POST", "/api/v1/incidents", `{"title":" Не работает почта ","impact":1,"urgency":1}`, &incident)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("код ответа %d: %s", rec.Code, rec.Body)
+	}
+	if rec.Header().Get("Location") != incidentPath(incident.ID) {
+		t.Errorf("Location = %q", rec.Header().Get("Location"))
+	}
+	if incident.Title != "Не работает почта" || incident.Status != models.StatusNew ||
+		incident.Author.Username != "client" || incident.Priority != 1 {
+		t.Errorf("неожиданный инцидент: %+v", incident)
+	}
+
+	expectError(t, a.do("client", "POST", "/api/v1/incidents", `{"title":"  "}`, nil), http.StatusUnprocessableEntity)
+	expectError(t, a.do("client", "POST", "/api/v1/incidents", `{"title":"x","service_ids":[999]}`, nil), http.StatusNotFound)
+}
+
+func TestListIncidents(t *testing.T) {
+	a := newAPITest(t)
+	a.create("client", "Printer")
+	mail := a.create("client", "Почта")
+	a.create("other", "Network printer")
+
+	var list incidentListResponse
+	a.do("client", "GET", "/api/v1/incidents", "", &list)
+	if list.Total != 2 || len(list.Items) != 2 {
+		t.Fatalf("клиент видит %d инцидентов, ожидалось 2", list.Total)
+	}
+
+	a.do("officer", "GET", "/api/v1/incidents?q=printer", "", &list)
+	if list.Total != 2 {
+		t.Errorf("поиск сотрудника нашел %d инцидентов, ожидалось 2", list.Total)
+	}
+
+	a.do("officer", "GET", "/api/v1/incidents?page_size=1&sort=created", "", &list)
+	if list.Total != 3 || len(list.Items) != 1 || list.TotalPages != 3 {
+		t.Errorf("страница: total=%d items=%d pages=%d", list.Total, len(list.Items), list.TotalPages)
+	}
+
+	assign := `{"responsible_user_id":` + strconv.FormatUint(uint64(a.users["officer"].ID), 10) + `}`
+	if rec := a.do("officer", "POST", incidentPath(mail)+"/assign", assign, nil); rec.Code != http.StatusOK {
+		t.Fatalf("назначение: %d %s", rec.Code, rec.Body)
+	}
+	a.do("officer", "GET", "/api/v1/incidents?assignee=none", "", &list)
+	if list.Total != 2 {
+		t.Errorf("без ответственного %d инцидентов, ожидалось 2", list.Total)
+	}
+
+	rec := a.do("officer", "GET", "/api/v1/incidents?priority=9", "", nil)
+	expectError(t, rec, http.StatusBadRequest)
+}
+
+func TestGetIncident(t *testing.T) {
+	a := newAPITest(t)
+	id := a.create("client", "Почта")
+
+	var incident incidentResponse
+	if rec := a.do("officer", "GET", incidentPath(id), "", &incident); rec.Code != http.StatusOK {
+		t.Fatalf("код ответа %d: %s", rec.Code, rec.Body)
+	}
+	if incident.ID != id {
+		t.Errorf("получен инцидент %d вместо %d", incident.ID, id)
+	}
+
+	expectError(t, a.do("other", "GET", incidentPath(id), "", nil), http.StatusForbidden)
+	expectError(t, a.do("client", "GET", incidentPath(id+100), "", nil), http.StatusNotFound)
+	expectError(t, a.do("client", "POST", incidentPath(id+100)+"/transition", `{"status":"Отменен","reason":"x"}`, nil),
+		http.StatusNotFound)
+}
+
+func TestTransition(t *testing.T) {
+	a := newAPITest(t)
+	id := a.create("client", "Почта")
+	path := incidentPath(id) + "/transition"
+
+	// Из нового инцидента нельзя сразу перейти в закрытый
+	expectError(t, a.do("officer", "POST", path, `{"status":"Закрыт"}`, nil), http.StatusConflict)
+	// Взять в работу может только сотрудник
+	expectError(t, a.do("client", "POST", path, `{"status":"В работе"}`, nil), http.StatusForbidden)
+	// Без ответственного инцидент нельзя взять в работу
+	expectError(t, a.do("officer", "POST", path, `{"status":"В работе"}`, nil), http.StatusUnprocessableEntity)
+	expectError(t, a.do("officer", "POST", path, `{"status":"unknown"}`, nil), http.StatusUnprocessableEntity)
+	expectError(t, a.do("officer", "POST", path, `{}`, nil), http.StatusUnprocessableEntity)
+
+	assign := `{"responsible_user_id":` + strconv.FormatUint(uint64(a.users["officer"].ID), 10) + `}`
+	if rec := a.do("officer", "POST", incidentPath(id)+"/assign", assign, nil); rec.Code != http.StatusOK {
+		t.Fatalf("назначение: %d %s", rec.Code, rec.Body)
+	}
+	var incident incidentResponse
+	if rec := a.do("officer", "POST", path, `{"status":"В работе"}`, &incident); rec.Code != http.StatusOK {
+		t.Fatalf("перевод в работу: %d %s", rec.Code, rec.Body)
+	}
+	if incident.Status != models.StatusInProgress || incident.Responsible == nil {
+		t.Errorf("неожиданный инцидент: %+v", incident)
+	}
+
+	// Решение требует описания
+	expectError(t, a.do("officer", "POST", path, `{"status":"Решен"}`, nil), http.StatusUnprocessableEntity)
+	if rec := a.do("officer", "POST", path, `{"status":"Решен","resolution":"Перезапущен сервер"}`, &incident); rec.Code != http.StatusOK {
+		t.Fatalf("решение: %d %s", rec.Code, rec.Body)
+	}
+	if incident.Status != models.StatusResolved || incident.ResolvedAt == nil {
+		t.Errorf("неожиданный инцидент: %+v", incident)
+	}
+}
+
+func TestRequestBody(t *testing.T) {
+	a := newAPITest(t)
+	id := a.create("client", "Почта")
+
+	expectError(t, a.do("client", "POST", "/api/v1/incidents", `{"title":"x","owner":1}`, nil), http.StatusBadRequest)
+	expectError(t, a.do("officer", "PATCH", incidentPath(id), `{"prioritet":1}`, nil), http.StatusBadRequest)
+	expectError(t, a.do("client", "POST", "/api/v1/incidents", `{"title":`, nil), http.StatusBadRequest)
+
+	large := `{"title":"x","description":"` + strings.Repeat("a", utils.MaxJSONBody) + `"}`
+	expectError(t, a.do("client", "POST", "/api/v1/incidents", large, nil), http.StatusRequestEntityTooLarge)
+
+	var count int64
+	a.db.Model(&models.Incident{}).Count(&count)
+	if count != 1 {
+		t.Errorf("в базе %d инцидентов, ожидался 1", count)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	a := newAPITest(t)
+	req := httptest.NewRequest("GET", "/api/v1/incidents", nil)
+	rec := httptest.NewRecorder()
+	a.router.ServeHTTP(rec, req)
+	expectError(t, rec, http.StatusUnauthorized)
+}
@@ -0,0 +1,248 @@
+package incidents
+
+import (
+	"errors"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"io"
+	"itsm/models"
+	"itsm/storage"
+	"itsm/utils"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Максимальное количество файлов в одной загрузке
+const maxAttachmentsPerUpload = 10
+
+var files storage.Storage
+var maxAttachmentSize int64 = 10 << 20
+
+// allowedAttachmentTypes - допустимые типы содержимого, определяемые по самому файлу
+var allowedAttachmentTypes = []string{
+	"image/png",
+	"image/jpeg",
+	"image/gif",
+	"image/webp",
+	"image/bmp",
+	"text/plain",
+	"application/pdf",
+	"application/zip",
+	"application/x-gzip",
+}
+
+// ConfigureAttachments задает хранилище вложений и максимальный размер одного файла
+func ConfigureAttachments(store storage.Storage, maxSize int64) {
+	files = store
+	if maxSize > 0 {
+		maxAttachmentSize = maxSize
+	}
+}
+
+// parseUploadForm разбирает multipart-форму, ограничивая общий размер запроса
+func parseUploadForm(w http.ResponseWriter, r *http.Request) error {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		return nil
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentSize*maxAttachmentsPerUpload+1<<20)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return utils.NewRequestError(http.StatusRequestEntityTooLarge, "Превышен допустимый размер загрузки")
+		}
+		return utils.NewRequestError(http.StatusBadRequest, "Ошибка при разборе формы")
+	}
+	return nil
+}
+
+func uploadedFiles(r *http.Request) []*multipart.FileHeader {
+	if r.MultipartForm == nil {
+		return nil
+	}
+
+	var headers []*multipart.FileHeader
+	for _, header := range r.MultipartForm.File["attachments"] {
+		// Пустое поле выбора файла браузер отправляет как файл без имени
+		if header.Filename != "" {
+			headers = append(headers, header)
+		}
+	}
+	return headers
+}
+
+// detectContentType определяет тип файла по его содержимому
+func detectContentType(header *multipart.FileHeader) (string, error) {
+	file, err := header.Open()
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(buf[:n]))
+	return contentType, nil
+}
+
+// validateAttachments проверяет количество, размер и тип файлов до сохранения инцидента
+func validateAttachments(headers []*multipart.FileHeader) error {
+	if len(headers) > maxAttachmentsPerUpload {
+		return utils.NewRequestError(http.StatusBadRequest,
+			"Можно загрузить не более %d файлов", maxAttachmentsPerUpload)
+	}
+	if len(headers) > 0 && files == nil {
+		return utils.NewRequestError(http.StatusServiceUnavailable, "Хранилище вложений не настроено")
+	}
+
+	for _, header := range headers {
+		if header.Size > maxAttachmentSize {
+			return utils.NewRequestError(http.StatusRequestEntityTooLarge,
+				"Файл «%s» превышает %d МБ", header.Filename, maxAttachmentSize>>20)
+		}
+
+		contentType, err := detectContentType(header)
+		if err != nil {
+			return err
+		}
+		if !isAllowedType(contentType) {
+			return utils.NewRequestError(http.StatusUnsupportedMediaType,
+				"Недопустимый тип файла «%s»", header.Filename)
+		}
+	}
+	return nil
+}
+
+func isAllowedType(contentType string) bool {
+	for _, allowed := range allowedAttachmentTypes {
+		if contentType == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// saveAttachments сохраняет проверенные файлы в хранилище и привязывает их
+// к инциденту в транзакции tx. Возвращает ключи сохраненных файлов, в том числе
+// при ошибке: если транзакция не зафиксирована, их удаляет deleteFiles
+func saveAttachments(tx *gorm.DB, headers []*multipart.FileHeader, incidentID uint, commentID *uint, uploaderID uint) ([]string, error) {
+	var keys []string
+	for _, header := range headers {
+		contentType, err := detectContentType(header)
+		if err != nil {
+			return keys, err
+		}
+
+		file, err := header.Open()
+		if err != nil {
+			return keys, err
+		}
+		key, err := files.Save(header.Filename, file)
+		file.Close()
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, key)
+
+		attachment := models.Attachment{
+			IncidentID:  incidentID,
+			CommentID:   commentID,
+			UploaderID:  uploaderID,
+			FileName:    filepath.Base(header.Filename),
+			ContentType: contentType,
+			Size:        header.Size,
+			StorageKey:  key,
+		}
+		if err := tx.Create(&attachment).Error; err != nil {
+			return keys, err
+		}
+	}
+	return keys, nil
+}
+
+// deleteFiles удаляет из хранилища файлы, записи о которых не сохранились
+func deleteFiles(keys []string) {
+	for _, key := range keys {
+		if err := files.Delete(key); err != nil {
+			log.Println("Ошибка при удалении файла вложения:", err)
+		}
+	}
+}
+
+// loadIncidentAttachments возвращает файлы, приложенные к самому инциденту, а не к комментариям
+func loadIncidentAttachments(incidentID uint) ([]models.Attachment, error) {
+	var attachments []models.Attachment
+	err := db.Where("incident_id = ? AND comment_id IS NULL", incidentID).
+		Order("created_at ASC").Find(&attachments).Error
+	return attachments, err
+}
+
+func downloadAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var attachment models.Attachment
+	if err := db.First(&attachment, vars["id"]).Error; err != nil {
+		http.Error(w, "Файл не найден", http.StatusNotFound)
+		return
+	}
+
+	var incident models.Incident
+	if err := db.First(&incident, attachment.IncidentID).Error; err != nil {
+		http.Error(w, "Инцидент не найден", http.StatusNotFound)
+		return
+	}
+
+	curActor, err := actorFromRequest(r)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	if curActor.isClient() {
+		if !curActor.canView(&incident) {
+			http.Error(w, "Недостаточно прав", http.StatusForbidden)
+			return
+		}
+
+		// Вложения рабочих заметок клиенту недоступны
+		if attachment.CommentID != nil {
+			var comment models.IncidentComment
+			if err := db.First(&comment, *attachment.CommentID).Error; err != nil || comment.IsInternal {
+				http.Error(w, "Недостаточно прав", http.StatusForbidden)
+				return
+			}
+		}
+	}
+
+	if files == nil {
+		http.Error(w, "Хранилище вложений не настроено", http.StatusServiceUnavailable)
+		return
+	}
+
+	file, err := files.Open(attachment.StorageKey)
+	if err != nil {
+		log.Println("Ошибка при открытии файла вложения:", err)
+		http.Error(w, "Файл недоступен", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": attachment.FileName}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if _, err := io.Copy(w, file); err != nil {
+		log.Println("Ошибка при отправке файла вложения:", err)
+	}
+}
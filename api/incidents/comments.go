@@ -0,0 +1,92 @@
+package incidents
+
+import (
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"itsm/models"
+	"itsm/utils"
+	"net/http"
+	"strings"
+)
+
+// loadComments возвращает комментарии инцидента; рабочие заметки - только сотрудникам
+func loadComments(incidentID uint, includeInternal bool) ([]models.IncidentComment, error) {
+	query := db.Preload("Author").Preload("Attachments").Where("incident_id = ?", incidentID)
+	if !includeInternal {
+		query = query.Where("is_internal = ?", false)
+	}
+
+	var comments []models.IncidentComment
+	err := query.Order("created_at ASC").Find(&comments).Error
+	return comments, err
+}
+
+func addCommentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	var incident models.Incident
+	if err := db.First(&incident, id).Error; err != nil {
+		http.Error(w, "Инцидент не найден", http.StatusNotFound)
+		return
+	}
+
+	curActor, err := actorFromRequest(r)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	userID := curActor.ID
+	isClient := curActor.isClient()
+
+	// Клиент может комментировать только свои инциденты
+	if !curActor.canView(&incident) {
+		http.Error(w, "Недостаточно прав", http.StatusForbidden)
+		return
+	}
+
+	if err := parseUploadForm(w, r); err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	attachments := uploadedFiles(r)
+	if err := validateAttachments(attachments); err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	content := strings.TrimSpace(r.FormValue("content"))
+	if content == "" {
+		http.Error(w, "Комментарий не может быть пустым", http.StatusUnprocessableEntity)
+		return
+	}
+
+	isInternal := r.FormValue("is_internal") == "on"
+	if isInternal && isClient {
+		http.Error(w, "Клиент не может оставлять рабочие заметки", http.StatusForbidden)
+		return
+	}
+
+	comment := models.IncidentComment{
+		IncidentID: incident.ID,
+		AuthorID:   userID,
+		Content:    content,
+		IsInternal: isInternal,
+	}
+	// Комментарий и его вложения сохраняются вместе
+	var stored []string
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&comment).Error; err != nil {
+			return err
+		}
+		stored, err = saveAttachments(tx, attachments, incident.ID, &comment.ID, userID)
+		return err
+	})
+	if err != nil {
+		deleteFiles(stored)
+		utils.WriteError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/incident/"+id+"#comments", http.StatusSeeOther)
+}
@@ -0,0 +1,185 @@
+package incidents
+
+import (
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"itsm/models"
+	"itsm/priority"
+	"itsm/utils"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Отслеживаемые поля инцидента и их названия для журнала изменений
+const (
+	fieldCreated         = "created"
+	fieldStatus          = "status"
+	fieldResponsibleUser = "responsible_user"
+	fieldServices        = "services"
+	fieldImpact          = "impact"
+	fieldUrgency         = "urgency"
+	fieldPriority        = "priority"
+	fieldResolution      = "resolution"
+	fieldStatusReason    = "status_reason"
+)
+
+var fieldLabels = map[string]string{
+	fieldCreated:         "Инцидент создан",
+	fieldStatus:          "Статус",
+	fieldResponsibleUser: "Ответственный",
+	fieldServices:        "Услуги",
+	fieldImpact:          "Влияние",
+	fieldUrgency:         "Срочность",
+	fieldPriority:        "Приоритет",
+	fieldResolution:      "Решение",
+	fieldStatusReason:    "Причина",
+}
+
+// trackedFields - порядок, в котором изменения попадают в журнал
+var trackedFields = []string{fieldStatus, fieldResponsibleUser, fieldServices, fieldImpact,
+	fieldUrgency, fieldPriority, fieldResolution, fieldStatusReason}
+
+// incidentSnapshot - значения отслеживаемых полей в виде, пригодном для журнала
+type incidentSnapshot map[string]string
+
+func levelName(level int) string {
+	for _, l := range priority.Levels {
+		if l.Value == level {
+			return l.Name
+		}
+	}
+	return strconv.Itoa(level)
+}
+
+// takeSnapshot фиксирует текущие значения полей инцидента, включая связанные услуги
+func takeSnapshot(tx *gorm.DB, incident *models.Incident) (incidentSnapshot, error) {
+	responsible := ""
+	if incident.ResponsibleUserID != nil {
+		var user models.User
+		if err := tx.First(&user, *incident.ResponsibleUserID).Error; err != nil {
+			return nil, err
+		}
+		responsible = user.Username
+	}
+
+	var services []models.Service
+	if err := tx.Model(incident).Association("Services").Find(&services); err != nil {
+		return nil, err
+	}
+	names := make([]string, len(services))
+	for i, service := range services {
+		names[i] = service.Name
+	}
+	sort.Strings(names)
+
+	return incidentSnapshot{
+		fieldStatus:          incident.Status,
+		fieldResponsibleUser: responsible,
+		fieldServices:        strings.Join(names, ", "),
+		fieldImpact:          levelName(incident.Impact),
+		fieldUrgency:         levelName(incident.Urgency),
+		fieldPriority:        "P" + strconv.Itoa(incident.Priority),
+		fieldResolution:      incident.Resolution,
+		fieldStatusReason:    incident.StatusReason,
+	}, nil
+}
+
+// recordChanges добавляет в журнал все поля, значения которых различаются в снимках
+func recordChanges(tx *gorm.DB, incidentID, userID uint, before, after incidentSnapshot) error {
+	var changes []models.IncidentChange
+	for _, field := range trackedFields {
+		if before[field] != after[field] {
+			changes = append(changes, models.IncidentChange{
+				IncidentID: incidentID,
+				UserID:     userID,
+				Field:      field,
+				OldValue:   before[field],
+				NewValue:   after[field],
+			})
+		}
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+	return tx.Create(&changes).Error
+}
+
+// recordCreation добавляет в журнал запись о создании инцидента
+func recordCreation(tx *gorm.DB, incident *models.Incident) error {
+	change := models.IncidentChange{
+		IncidentID: incident.ID,
+		UserID:     incident.UserID,
+		Field:      fieldCreated,
+		NewValue:   incident.Title,
+	}
+	return tx.Create(&change).Error
+}
+
+// historyEntry - запись журнала для вывода на странице и в JSON. Об авторе
+// изменения выводится только логин
+type historyEntry struct {
+	ID         uint      `json:"id"`
+	Field      string    `json:"field"`
+	FieldLabel string    `json:"field_label"`
+	OldValue   string    `json:"old_value"`
+	NewValue   string    `json:"new_value"`
+	UserID     uint      `json:"user_id"`
+	Username   string    `json:"username"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func loadHistory(incidentID uint) ([]historyEntry, error) {
+	var changes []models.IncidentChange
+	if err := db.Preload("User").Where("incident_id = ?", incidentID).
+		Order("created_at ASC, id ASC").Find(&changes).Error; err != nil {
+		return nil, err
+	}
+
+	entries := make([]historyEntry, len(changes))
+	for i, change := range changes {
+		entries[i] = historyEntry{
+			ID:         change.ID,
+			Field:      change.Field,
+			FieldLabel: fieldLabels[change.Field],
+			OldValue:   change.OldValue,
+			NewValue:   change.NewValue,
+			UserID:     change.UserID,
+			Username:   change.User.Username,
+			CreatedAt:  change.CreatedAt,
+		}
+	}
+	return entries, nil
+}
+
+func incidentHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	var incident models.Incident
+	if err := db.First(&incident, id).Error; err != nil {
+		http.Error(w, "Инцидент не найден", http.StatusNotFound)
+		return
+	}
+
+	curActor, err := actorFromRequest(r)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	if !curActor.canView(&incident) {
+		http.Error(w, "Недостаточно прав", http.StatusForbidden)
+		return
+	}
+
+	history, err := loadHistory(incident.ID)
+	if err != nil {
+		http.Error(w, "Ошибка при получении истории изменений", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendJSON(w, history)
+}
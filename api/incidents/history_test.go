@@ -0,0 +1,38 @@
+package incidents
+
+import (
+	"encoding/json"
+	"itsm/testenv"
+	"strings"
+	"testing"
+)
+
+// Журнал изменений отдает об авторе только ID и логин
+func TestHistoryHidesUserDetails(t *testing.T) {
+	db = testenv.Open(t)
+	client := testenv.User(t, db, "client")
+	if err := db.Model(&client).Update("email", "client@example.com").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	incident, err := createIncident(actor{ID: client.ID, user: client}, incidentInput{Title: "Почта", Impact: 2, Urgency: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := loadHistory(incident.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].Field != fieldCreated || history[0].UserID != client.ID ||
+		history[0].Username != "client" || history[0].NewValue != "Почта" {
+		t.Fatalf("история = %+v", history)
+	}
+
+	data, err := json.Marshal(history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "client@example.com") || strings.Contains(string(data), `"user"`) {
+		t.Errorf("история раскрывает данные пользователя: %s", data)
+	}
+}
@@ -3,12 +3,17 @@ package incidents
 import (
 	"github.com/gorilla/mux"
 	"gorm.io/gorm"
-	"html/template"
+	"itsm/middleware"
 	"itsm/models"
+	"itsm/openapi"
+	"itsm/priority"
+	"itsm/rbac"
+	"itsm/sla"
 	"itsm/utils"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var db *gorm.DB
@@ -19,12 +24,18 @@ func SetupRoutes(r *mux.Router, database *gorm.DB) {
 	r.HandleFunc("/incidents/create", createIncidentHandler).Methods("POST")
 	r.HandleFunc("/incident/{id}", incidentHandler).Methods("GET")
 	r.HandleFunc("/incident/{id}/update", updateIncidentsHandler).Methods("POST")
+	r.HandleFunc("/incident/{id}/comments", addCommentHandler).Methods("POST")
+	openapi.JSON(r.HandleFunc("/incident/{id}/history", incidentHistoryHandler).Methods("GET"))
+	r.HandleFunc("/attachments/{id:[0-9]+}", downloadAttachmentHandler).Methods("GET")
+	middleware.RequirePermission(openapi.JSON(r.HandleFunc("/incidents/sla/breaches", slaBreachesHandler).Methods("GET")),
+		rbac.PermSLAView)
+	setupAPIRoutes(r)
 }
 
 func addIncidentHandler(w http.ResponseWriter, r *http.Request) {
-	isClient, err := utils.IsClientUser(r)
+	curActor, err := actorFromRequest(r)
 	if err != nil {
-		http.Error(w, "Ошибка получения сессии: "+err.Error(), http.StatusUnauthorized)
+		utils.WriteError(w, err)
 		return
 	}
 
@@ -38,13 +49,14 @@ func addIncidentHandler(w http.ResponseWriter, r *http.Request) {
 	data := struct {
 		IsClient bool
 		Services []models.Service
+		Levels   []priority.Level
 	}{
-		IsClient: isClient,
+		IsClient: curActor.isClient(),
 		Services: services,
+		Levels:   priority.Levels,
 	}
 
-	tmpl, err := template.ParseFiles("templates/incidents/incident_add/add_incident.html",
-		"templates/header/header.html")
+	tmpl, err := utils.ParsePage(r, "templates/incidents/incident_add/add_incident.html", nil)
 	if err != nil {
 		http.Error(w, "Ошибка при загрузке шаблона", http.StatusInternalServerError)
 		return
@@ -61,65 +73,41 @@ func createIncidentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Получаем текущую сессию
-	curSession, err := utils.GetCurSession(r)
+	// Получаем текущего пользователя
+	curActor, err := actorFromRequest(r)
 	if err != nil {
-		http.Error(w, "Ошибка при получении сессии", http.StatusInternalServerError)
+		utils.WriteError(w, err)
 		return
 	}
 
-	// Получаем текущего пользователя
-	userID, ok := curSession.Values["userID"].(uint)
-	if !ok {
-		http.Error(w, "Пользователь не найден", http.StatusUnauthorized)
+	if err := parseUploadForm(w, r); err != nil {
+		utils.WriteError(w, err)
 		return
 	}
-
-	// Создаем новый инцидент
-	incident := models.Incident{
-		Title:       r.FormValue("title"),
-		Description: r.FormValue("description"),
-		Status:      "Открыт",
-		UserID:      userID,
-	}
-
-	// Сохраняем инцидент в базе данных
-	if err := db.Create(&incident).Error; err != nil {
-		http.Error(w, "Ошибка при добавлении инцидента", http.StatusInternalServerError)
+	attachments := uploadedFiles(r)
+	if err := validateAttachments(attachments); err != nil {
+		utils.WriteError(w, err)
 		return
 	}
 
 	// Получаем выбранные услуги из формы
-	serviceIDs := r.FormValue("selected_services") // Получаем строку с ID услуг
-
-	if serviceIDs != "" {
-		ids := strings.Split(serviceIDs, ",") // Разделяем строку на массив ID
-
-		// Создаем срез для хранения услуг
-		var services []models.Service
-
-		// Загружаем услуги по их ID
-		for _, idStr := range ids {
-			id, err := strconv.ParseUint(idStr, 10, 32) // Преобразуем строку в uint
-			if err != nil {
-				http.Error(w, "Ошибка при преобразовании ID услуги", http.StatusBadRequest)
-				return
-			}
-
-			var service models.Service
-			if err := db.First(&service, id).Error; err == nil {
-				services = append(services, service)
-			} else {
-				http.Error(w, "Услуга не найдена", http.StatusNotFound)
-				return
-			}
-		}
+	serviceIDs, err := parseServiceIDs(r.FormValue("selected_services"))
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
 
-		// Привязываем выбранные услуги к инциденту
-		if err := db.Model(&incident).Association("Services").Append(services); err != nil {
-			http.Error(w, "Ошибка при добавлении связи инцидента и услуги", http.StatusInternalServerError)
-			return
-		}
+	_, err = createIncident(curActor, incidentInput{
+		Title:       r.FormValue("title"),
+		Description: r.FormValue("description"),
+		Impact:      priority.ParseLevel(r.FormValue("impact")),
+		Urgency:     priority.ParseLevel(r.FormValue("urgency")),
+		ServiceIDs:  serviceIDs,
+		Attachments: attachments,
+	})
+	if err != nil {
+		utils.WriteError(w, err)
+		return
 	}
 
 	// Перенаправляем на страницу со списком инцидентов
@@ -160,22 +148,40 @@ func incidentHandler(w http.ResponseWriter, r *http.Request) {
 		responsibleUserUsername = responsibleUser.Username
 	}
 
-	curSession, err := utils.GetCurSession(r)
+	curActor, err := actorFromRequest(r)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	isClient := curActor.isClient()
+	if !curActor.canView(&incident) {
+		http.Error(w, "Недостаточно прав для просмотра инцидента", http.StatusForbidden)
+		return
+	}
+
+	comments, err := loadComments(incident.ID, !isClient)
 	if err != nil {
-		http.Error(w, "Ошибка получения сессии: "+err.Error(), http.StatusUnauthorized)
+		http.Error(w, "Ошибка при получении комментариев", http.StatusInternalServerError)
 		return
 	}
-	isAdmin := curSession.Values["isAdmin"].(bool)
-	isTechOfficer := curSession.Values["isTechOfficer"].(bool)
-	isClient, err := utils.IsClientUser(r)
+
+	history, err := loadHistory(incident.ID)
+	if err != nil {
+		http.Error(w, "Ошибка при получении истории изменений", http.StatusInternalServerError)
+		return
+	}
+
+	attachments, err := loadIncidentAttachments(incident.ID)
 	if err != nil {
-		http.Error(w, "Ошибка получения сессии: "+err.Error(), http.StatusUnauthorized)
+		http.Error(w, "Ошибка при получении вложений", http.StatusInternalServerError)
 		return
 	}
 
+	transitions := availableTransitions(incident.Status, curActor.roles(&incident))
+
 	var techOfficers []models.User
-	if isAdmin || isTechOfficer {
-		if err := db.Where("is_tech_officer = ?", true).Find(&techOfficers).Error; err != nil {
+	if curActor.can(rbac.PermIncidentAssign) {
+		if err := db.Scopes(rbac.WithPermission(rbac.PermIncidentWork)).Find(&techOfficers).Error; err != nil {
 			http.Error(w, "Ошибка при загрузке пользователей", http.StatusInternalServerError)
 			return
 		}
@@ -195,6 +201,12 @@ func incidentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	slaStatuses, err := sla.EvaluateMany(db, []models.Incident{incident}, time.Now())
+	if err != nil {
+		http.Error(w, "Ошибка при расчете SLA", http.StatusInternalServerError)
+		return
+	}
+
 	var responsibleUserIDValue uint
 	if incident.ResponsibleUserID != nil {
 		responsibleUserIDValue = *incident.ResponsibleUserID
@@ -208,12 +220,18 @@ func incidentHandler(w http.ResponseWriter, r *http.Request) {
 		"TechOfficers":            techOfficers,
 		"Services":                services,
 		"SelectedServices":        selectedServices,
-		"HasEditRights":           isAdmin || isTechOfficer,
+		"Transitions":             transitions,
+		"SLA":                     slaStatuses[incident.ID],
+		"Comments":                comments,
+		"History":                 history,
+		"Attachments":             attachments,
+		"Levels":                  priority.Levels,
+		"CanAssign":               curActor.can(rbac.PermIncidentAssign),
+		"CanEdit":                 curActor.can(rbac.PermIncidentEdit),
 		"IsClient":                isClient,
 	}
 
-	tmpl, err := template.ParseFiles("templates/incidents/incident/incident.html",
-		"templates/header/header.html")
+	tmpl, err := utils.ParsePage(r, "templates/incidents/incident/incident.html", nil)
 	if err != nil {
 		http.Error(w, "Ошибка при загрузке шаблона", http.StatusInternalServerError)
 		return
@@ -234,64 +252,98 @@ func updateIncidentsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var incident models.Incident
-	if err := db.First(&incident, id).Error; err != nil {
-		http.Error(w, "Инцидент не найден", http.StatusNotFound)
+	curActor, err := actorFromRequest(r)
+	if err != nil {
+		utils.WriteError(w, err)
 		return
 	}
 
-	status := r.FormValue("status")
-	responsibleUserID := r.FormValue("responsible_user_id")
-
-	incident.Status = status
-	if responsibleUserID != "" {
-		userID, err := strconv.ParseUint(responsibleUserID, 10, 32)
-		if err == nil {
-			incident.ResponsibleUserID = new(uint)
-			*incident.ResponsibleUserID = uint(userID)
-		}
-	} else {
-		incident.ResponsibleUserID = nil
+	incident, err := findIncident(curActor, id)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
 	}
 
-	if err := db.Model(&incident).Association("Services").Clear(); err != nil {
-		http.Error(w, "Ошибка при удалении старых услуг", http.StatusInternalServerError)
-		return
+	changes := incidentChanges{
+		Transition: &transitionRequest{
+			To:         r.FormValue("status"),
+			Resolution: strings.TrimSpace(r.FormValue("resolution")),
+			Reason:     strings.TrimSpace(r.FormValue("status_reason")),
+		},
 	}
 
-	// Обработка выбранных услуг
-	selectedServices := r.FormValue("selected_services")
-	if selectedServices != "" {
-		// Разделяем строку на массив ID услуг
-		serviceIDs := strings.Split(selectedServices, ",")
-
-		// Создаем срез для хранения услуг
-		var services []models.Service
-
-		// Загружаем услуги по их ID
-		for _, serviceID := range serviceIDs {
-			if serviceID != "" {
-				id, err := strconv.ParseUint(serviceID, 10, 32)
-				if err == nil {
-					var service models.Service
-					if err := db.First(&service, id).Error; err == nil {
-						services = append(services, service)
-					}
-				}
+	// Поля, на изменение которых у пользователя нет прав, в форме не выводятся
+	if curActor.can(rbac.PermIncidentAssign) {
+		changes.SetResponsible = true
+		if responsibleUserID := r.FormValue("responsible_user_id"); responsibleUserID != "" {
+			userID, err := strconv.ParseUint(responsibleUserID, 10, 32)
+			if err != nil {
+				http.Error(w, "Некорректный ID ответственного", http.StatusBadRequest)
+				return
 			}
+			changes.ResponsibleUserID = new(uint)
+			*changes.ResponsibleUserID = uint(userID)
+		}
+	}
+
+	if curActor.can(rbac.PermIncidentEdit) {
+		if impact := r.FormValue("impact"); impact != "" {
+			level := priority.ParseLevel(impact)
+			changes.Impact = &level
+		}
+		if urgency := r.FormValue("urgency"); urgency != "" {
+			level := priority.ParseLevel(urgency)
+			changes.Urgency = &level
 		}
 
-		// Добавляем новые связи
-		if err := db.Model(&incident).Association("Services").Append(services); err != nil {
-			http.Error(w, "Ошибка при добавлении услуг", http.StatusInternalServerError)
+		// Обработка выбранных услуг
+		serviceIDs, err := parseServiceIDs(r.FormValue("selected_services"))
+		if err != nil {
+			utils.WriteError(w, err)
 			return
 		}
+		changes.ServiceIDs = &serviceIDs
 	}
 
-	if err := db.Save(&incident).Error; err != nil {
-		http.Error(w, "Ошибка при обновлении инцидента", http.StatusInternalServerError)
+	if err := updateIncident(curActor, &incident, changes); err != nil {
+		utils.WriteError(w, err)
 		return
 	}
 
 	http.Redirect(w, r, "/incidents", http.StatusSeeOther)
 }
+
+// slaBreachesHandler возвращает инциденты с нарушенным SLA, а при near=true -
+// также инциденты, сроки по которым близки к нарушению
+func slaBreachesHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	query := db.Model(&models.Incident{})
+	if r.URL.Query().Get("near") == "true" {
+		query = query.Where("incidents.resolved_at IS NULL")
+	} else {
+		query = query.Scopes(sla.Breached(now))
+	}
+
+	var incidents []models.Incident
+	if err := withRelations(query).Order("incidents.priority ASC").Find(&incidents).Error; err != nil {
+		http.Error(w, "Ошибка при получении инцидентов", http.StatusInternalServerError)
+		return
+	}
+
+	statuses, err := sla.EvaluateMany(db, incidents, now)
+	if err != nil {
+		http.Error(w, "Ошибка при расчете SLA", http.StatusInternalServerError)
+		return
+	}
+
+	result := []incidentResponse{}
+	for _, incident := range incidents {
+		status := statuses[incident.ID]
+		if !status.Breached() && !status.NearBreach() {
+			continue
+		}
+		result = append(result, newIncidentResponse(incident, status))
+	}
+
+	utils.SendJSON(w, result)
+}
@@ -0,0 +1,180 @@
+package incidents
+
+import (
+	"gorm.io/gorm"
+	"itsm/models"
+	"itsm/utils"
+	"net/http"
+	"slices"
+)
+
+// actorRole - роль пользователя по отношению к конкретному инциденту
+type actorRole int
+
+const (
+	roleReporter actorRole = iota // автор инцидента
+	roleOfficer                   // технический специалист
+	roleAdmin
+)
+
+// transition описывает допустимый переход между статусами
+type transition struct {
+	To                  string
+	Roles               []actorRole
+	RequiresResolution  bool // обязательно описание решения
+	RequiresReason      bool // обязательно указание причины
+	RequiresResponsible bool // обязательно назначение ответственного
+}
+
+var staff = []actorRole{roleOfficer, roleAdmin}
+
+// lifecycle - допустимые переходы из каждого статуса
+var lifecycle = map[string][]transition{
+	models.StatusNew: {
+		{To: models.StatusAssigned, Roles: staff, RequiresResponsible: true},
+		{To: models.StatusInProgress, Roles: staff, RequiresResponsible: true},
+		{To: models.StatusCancelled, Roles: []actorRole{roleReporter, roleAdmin}, RequiresReason: true},
+	},
+	models.StatusAssigned: {
+		{To: models.StatusInProgress, Roles: staff, RequiresResponsible: true},
+		{To: models.StatusOnHold, Roles: staff, RequiresReason: true},
+		{To: models.StatusResolved, Roles: staff, RequiresResolution: true},
+		{To: models.StatusCancelled, Roles: []actorRole{roleReporter, roleAdmin}, RequiresReason: true},
+	},
+	models.StatusInProgress: {
+		{To: models.StatusAssigned, Roles: staff, RequiresResponsible: true},
+		{To: models.StatusOnHold, Roles: staff, RequiresReason: true},
+		{To: models.StatusResolved, Roles: staff, RequiresResolution: true},
+	},
+	models.StatusOnHold: {
+		{To: models.StatusInProgress, Roles: staff, RequiresResponsible: true},
+		{To: models.StatusCancelled, Roles: []actorRole{roleAdmin}, RequiresReason: true},
+	},
+	models.StatusResolved: {
+		{To: models.StatusClosed, Roles: []actorRole{roleReporter, roleAdmin}},
+		{To: models.StatusReopened, Roles: []actorRole{roleReporter, roleOfficer, roleAdmin}, RequiresReason: true},
+	},
+	models.StatusClosed: {
+		{To: models.StatusReopened, Roles: []actorRole{roleReporter, roleAdmin}, RequiresReason: true},
+	},
+	models.StatusReopened: {
+		{To: models.StatusAssigned, Roles: staff, RequiresResponsible: true},
+		{To: models.StatusInProgress, Roles: staff, RequiresResponsible: true},
+		{To: models.StatusResolved, Roles: staff, RequiresResolution: true},
+	},
+	models.StatusCancelled: {},
+}
+
+// transitionRequest - запрос на смену статуса вместе с сопутствующими полями
+type transitionRequest struct {
+	To         string
+	Resolution string
+	Reason     string
+}
+
+func actorRoles(incident *models.Incident, userID uint, isOfficer, isAdmin bool) []actorRole {
+	var roles []actorRole
+	if incident.UserID == userID {
+		roles = append(roles, roleReporter)
+	}
+	if isOfficer {
+		roles = append(roles, roleOfficer)
+	}
+	if isAdmin {
+		roles = append(roles, roleAdmin)
+	}
+	return roles
+}
+
+func (t transition) allowedFor(roles []actorRole) bool {
+	for _, role := range roles {
+		if slices.Contains(t.Roles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// availableTransitions возвращает переходы, доступные пользователю с указанными ролями
+func availableTransitions(status string, roles []actorRole) []transition {
+	var result []transition
+	for _, t := range lifecycle[status] {
+		if t.allowedFor(roles) {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// validateTransition проверяет, что переход допустим для текущего статуса, ролей
+// пользователя и что заполнены обязательные для перехода поля
+func validateTransition(incident *models.Incident, req transitionRequest, roles []actorRole) error {
+	if !slices.Contains(models.IncidentStatuses, req.To) {
+		return utils.NewRequestError(http.StatusUnprocessableEntity, "Неизвестный статус «%s»", req.To)
+	}
+
+	idx := slices.IndexFunc(lifecycle[incident.Status], func(t transition) bool { return t.To == req.To })
+	if idx < 0 {
+		return utils.NewRequestError(http.StatusConflict,
+			"Переход из статуса «%s» в «%s» невозможен", incident.Status, req.To)
+	}
+
+	t := lifecycle[incident.Status][idx]
+	if !t.allowedFor(roles) {
+		return utils.NewRequestError(http.StatusForbidden,
+			"Недостаточно прав для перевода инцидента в статус «%s»", req.To)
+	}
+
+	if t.RequiresResponsible && incident.ResponsibleUserID == nil {
+		return utils.NewRequestError(http.StatusUnprocessableEntity,
+			"Для статуса «%s» необходимо назначить ответственного", req.To)
+	}
+	if t.RequiresResolution && req.Resolution == "" {
+		return utils.NewRequestError(http.StatusUnprocessableEntity,
+			"Для статуса «%s» необходимо описать решение", req.To)
+	}
+	if t.RequiresReason && req.Reason == "" {
+		return utils.NewRequestError(http.StatusUnprocessableEntity,
+			"Для статуса «%s» необходимо указать причину", req.To)
+	}
+
+	return nil
+}
+
+// applyTransition меняет статус инцидента; вызывается только после validateTransition
+func applyTransition(incident *models.Incident, req transitionRequest) {
+	incident.Status = req.To
+	incident.StatusReason = req.Reason
+
+	switch req.To {
+	case models.StatusResolved:
+		incident.Resolution = req.Resolution
+	case models.StatusReopened:
+		incident.Resolution = ""
+	}
+}
+
+// recordStatusChange сохраняет смену статуса в историю, по которой считается SLA
+func recordStatusChange(tx *gorm.DB, incident *models.Incident, fromStatus string, userID uint) error {
+	change := models.IncidentStatusChange{
+		IncidentID: incident.ID,
+		UserID:     userID,
+		FromStatus: fromStatus,
+		ToStatus:   incident.Status,
+	}
+	return tx.Create(&change).Error
+}
+
+// MigrateLegacyStatuses переводит инциденты со статусами из старой схемы
+// ("Открыт") в статусы текущего жизненного цикла
+func MigrateLegacyStatuses(database *gorm.DB) error {
+	if err := database.Model(&models.Incident{}).
+		Where("status = ? AND responsible_user_id IS NULL", "Открыт").
+		Update("status", models.StatusNew).Error; err != nil {
+		return err
+	}
+
+	return database.Model(&models.Incident{}).
+		Where("status = ? AND responsible_user_id IS NOT NULL", "Открыт").
+		Update("status", models.StatusAssigned).Error
+}
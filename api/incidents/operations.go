@@ -0,0 +1,276 @@
+package incidents
+
+import (
+	"errors"
+	"gorm.io/gorm"
+	"itsm/middleware"
+	"itsm/models"
+	"itsm/priority"
+	"itsm/rbac"
+	"itsm/sla"
+	"itsm/utils"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Операции над инцидентами, общие для HTML-страниц и JSON API:
+// проверки прав и данных выполняются здесь, обработчики только разбирают запрос
+
+// actor - пользователь, выполняющий действие над инцидентом
+type actor struct {
+	ID   uint
+	user models.User
+}
+
+func (a actor) can(permission string) bool {
+	return rbac.Can(a.user, permission)
+}
+
+func (a actor) isClient() bool {
+	return rbac.IsClient(a.user)
+}
+
+func (a actor) roles(incident *models.Incident) []actorRole {
+	return actorRoles(incident, a.ID, a.can(rbac.PermIncidentWork), a.can(rbac.PermIncidentAdminister))
+}
+
+// canView - клиент видит только свои инциденты, сотрудники - все
+func (a actor) canView(incident *models.Incident) bool {
+	return a.can(rbac.PermIncidentViewAll) || incident.UserID == a.ID
+}
+
+// actorFromRequest определяет пользователя, загруженного middleware.Authenticate
+func actorFromRequest(r *http.Request) (actor, error) {
+	user, ok := middleware.CurrentUser(r)
+	if !ok {
+		return actor{}, utils.NewRequestError(http.StatusUnauthorized, "Пользователь не авторизован")
+	}
+
+	return actor{ID: user.ID, user: user}, nil
+}
+
+// findIncident загружает инцидент и проверяет, что пользователь может его видеть
+func findIncident(a actor, id string) (models.Incident, error) {
+	var incident models.Incident
+	if err := db.First(&incident, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return incident, utils.NewRequestError(http.StatusNotFound, "Инцидент не найден")
+		}
+		return incident, err
+	}
+
+	if !a.canView(&incident) {
+		return incident, utils.NewRequestError(http.StatusForbidden, "Недостаточно прав для просмотра инцидента")
+	}
+	return incident, nil
+}
+
+// parseServiceIDs разбирает список ID услуг вида "1,2,3"
+func parseServiceIDs(value string) ([]uint, error) {
+	var ids []uint
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, utils.NewRequestError(http.StatusBadRequest, "Некорректный ID услуги «%s»", part)
+		}
+		ids = append(ids, uint(id))
+	}
+	return ids, nil
+}
+
+// loadServices загружает услуги по ID; отсутствующая услуга - ошибка
+func loadServices(tx *gorm.DB, ids []uint) ([]models.Service, error) {
+	services := make([]models.Service, 0, len(ids))
+	for _, id := range ids {
+		var service models.Service
+		if err := tx.First(&service, id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, utils.NewRequestError(http.StatusNotFound, "Услуга %d не найдена", id)
+			}
+			return nil, err
+		}
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+// incidentInput - данные нового инцидента
+type incidentInput struct {
+	Title       string
+	Description string
+	Impact      int
+	Urgency     int
+	ServiceIDs  []uint
+	Attachments []*multipart.FileHeader // проверенные validateAttachments
+}
+
+// createIncident создает инцидент от имени пользователя, привязывает услуги
+// и вложения, запускает таймеры SLA и записывает создание в журнал. Все это
+// выполняется в одной транзакции: при ошибке не остается инцидента без вложений
+func createIncident(a actor, input incidentInput) (models.Incident, error) {
+	title := strings.TrimSpace(input.Title)
+	if title == "" {
+		return models.Incident{}, utils.NewRequestError(http.StatusUnprocessableEntity, "Название инцидента не указано")
+	}
+
+	services, err := loadServices(db, input.ServiceIDs)
+	if err != nil {
+		return models.Incident{}, err
+	}
+
+	impact := priority.Normalize(input.Impact)
+	urgency := priority.Normalize(input.Urgency)
+
+	incident := models.Incident{
+		Title:       title,
+		Description: input.Description,
+		Status:      models.StatusNew,
+		UserID:      a.ID,
+		Impact:      impact,
+		Urgency:     urgency,
+		Priority:    priority.Calculate(impact, urgency),
+	}
+
+	var stored []string
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&incident).Error; err != nil {
+			return err
+		}
+
+		if len(services) > 0 {
+			if err := tx.Model(&incident).Association("Services").Append(services); err != nil {
+				return err
+			}
+		}
+
+		if err := sla.Refresh(tx, &incident); err != nil {
+			return err
+		}
+
+		if err := recordCreation(tx, &incident); err != nil {
+			return err
+		}
+
+		stored, err = saveAttachments(tx, input.Attachments, incident.ID, nil, a.ID)
+		return err
+	})
+	if err != nil {
+		deleteFiles(stored)
+	}
+	return incident, err
+}
+
+// incidentChanges - изменения инцидента. Nil-поля не меняются
+type incidentChanges struct {
+	SetResponsible    bool
+	ResponsibleUserID *uint
+	Impact            *int
+	Urgency           *int
+	ServiceIDs        *[]uint
+	Transition        *transitionRequest
+}
+
+// touchesClassification - меняет ли запрос влияние, срочность или услуги
+func (c incidentChanges) touchesClassification() bool {
+	return c.Impact != nil || c.Urgency != nil || c.ServiceIDs != nil
+}
+
+// updateIncident применяет изменения с проверкой прав и жизненного цикла,
+// сохраняет историю статусов и журнал изменений и пересчитывает SLA. Все записи
+// выполняются в одной транзакции: при ошибке инцидент остается прежним
+func updateIncident(a actor, incident *models.Incident, changes incidentChanges) error {
+	if !a.can(rbac.PermIncidentEdit) && !a.can(rbac.PermIncidentAssign) && incident.UserID != a.ID {
+		return utils.NewRequestError(http.StatusForbidden, "Недостаточно прав для изменения инцидента")
+	}
+	if changes.SetResponsible && !a.can(rbac.PermIncidentAssign) {
+		return utils.NewRequestError(http.StatusForbidden, "Недостаточно прав для назначения ответственного")
+	}
+	if changes.touchesClassification() && !a.can(rbac.PermIncidentEdit) {
+		return utils.NewRequestError(http.StatusForbidden, "Недостаточно прав для изменения влияния, срочности и услуг")
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		before, err := takeSnapshot(tx, incident)
+		if err != nil {
+			return err
+		}
+
+		if changes.SetResponsible {
+			if changes.ResponsibleUserID != nil {
+				var responsible models.User
+				if err := rbac.PreloadRoles(tx).First(&responsible, *changes.ResponsibleUserID).Error; err != nil {
+					if errors.Is(err, gorm.ErrRecordNotFound) {
+						return utils.NewRequestError(http.StatusUnprocessableEntity, "Ответственный не найден")
+					}
+					return err
+				}
+				if !rbac.Can(responsible, rbac.PermIncidentWork) {
+					return utils.NewRequestError(http.StatusUnprocessableEntity, "Пользователь «%s» не может быть ответственным", responsible.Username)
+				}
+			}
+			incident.ResponsibleUserID = changes.ResponsibleUserID
+		}
+
+		if changes.Impact != nil {
+			incident.Impact = priority.Normalize(*changes.Impact)
+		}
+		if changes.Urgency != nil {
+			incident.Urgency = priority.Normalize(*changes.Urgency)
+		}
+		incident.Priority = priority.Calculate(incident.Impact, incident.Urgency)
+
+		var services []models.Service
+		if changes.ServiceIDs != nil {
+			if services, err = loadServices(tx, *changes.ServiceIDs); err != nil {
+				return err
+			}
+		}
+
+		previousStatus := incident.Status
+		if changes.Transition != nil && changes.Transition.To != "" && changes.Transition.To != incident.Status {
+			if err := validateTransition(incident, *changes.Transition, a.roles(incident)); err != nil {
+				return err
+			}
+			applyTransition(incident, *changes.Transition)
+		}
+
+		if err := tx.Save(incident).Error; err != nil {
+			return err
+		}
+
+		if changes.ServiceIDs != nil {
+			association := tx.Model(incident).Association("Services")
+			if len(services) == 0 {
+				err = association.Clear()
+			} else {
+				err = association.Replace(services)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if incident.Status != previousStatus {
+			if err := recordStatusChange(tx, incident, previousStatus, a.ID); err != nil {
+				return err
+			}
+		}
+
+		// Приоритет и услуги могли измениться, поэтому SLA пересчитывается при каждом обновлении
+		if err := sla.Refresh(tx, incident); err != nil {
+			return err
+		}
+
+		after, err := takeSnapshot(tx, incident)
+		if err != nil {
+			return err
+		}
+		return recordChanges(tx, incident.ID, a.ID, before, after)
+	})
+}
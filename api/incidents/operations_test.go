@@ -0,0 +1,60 @@
+package incidents
+
+import (
+	"itsm/models"
+	"itsm/rbac"
+	"itsm/testenv"
+	"testing"
+)
+
+// Ошибка на любом шаге изменения откатывает все записи: инцидент не остается
+// в новом статусе без истории статусов, по которой считается SLA
+func TestUpdateIncidentRollsBackFailedTransition(t *testing.T) {
+	db = testenv.Open(t)
+	client := testenv.User(t, db, "client")
+	officer := testenv.User(t, db, "officer", rbac.RoleTechOfficer)
+
+	incident, err := createIncident(actor{ID: client.ID, user: client}, incidentInput{Title: "Почта", Impact: 2, Urgency: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.First(&incident, incident.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	before := incident
+
+	err = db.Exec("CREATE TRIGGER fail_status_change BEFORE INSERT ON incident_status_changes " +
+		"BEGIN SELECT RAISE(ABORT, 'status history unavailable'); END").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	impact := 1
+	err = updateIncident(actor{ID: officer.ID, user: officer}, &incident, incidentChanges{
+		SetResponsible:    true,
+		ResponsibleUserID: &officer.ID,
+		Impact:            &impact,
+		Transition:        &transitionRequest{To: models.StatusInProgress},
+	})
+	if err == nil {
+		t.Fatal("изменение выполнено без записи истории статусов")
+	}
+
+	var stored models.Incident
+	if err := db.First(&stored, incident.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != before.Status || stored.ResponsibleUserID != nil || stored.Impact != before.Impact ||
+		stored.Priority != before.Priority || stored.RespondedAt != nil || !stored.UpdatedAt.Equal(before.UpdatedAt) {
+		t.Errorf("инцидент изменен: %+v, было %+v", stored, before)
+	}
+
+	var changes int64
+	if err := db.Model(&models.IncidentChange{}).Where("incident_id = ? AND field <> ?", incident.ID, fieldCreated).
+		Count(&changes).Error; err != nil {
+		t.Fatal(err)
+	}
+	if changes != 0 {
+		t.Errorf("в журнале %d записей об изменении", changes)
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"encoding/json"
 	"github.com/gorilla/mux"
 	"gorm.io/gorm"
+	"itsm/middleware"
 	"itsm/models"
+	"itsm/openapi"
+	"itsm/rbac"
 	"itsm/utils"
 	"net/http"
 	"time"
@@ -26,26 +29,33 @@ type ExtendedMessage struct {
 
 func SetupRoutes(r *mux.Router, database *gorm.DB) {
 	db = database
-	r.HandleFunc("/users/get", getUsersHandler)
-	r.HandleFunc("/dialogs/get", getDialogsHandler)
-	r.HandleFunc("/messages/get/{dialogId:[0-9]+}", getMessagesHandler)
-	r.HandleFunc("/messages/send", sendMessageHandler).Methods("POST")
-	r.HandleFunc("/dialogs/create", createDialogHandler).Methods("POST")
+	middleware.RequirePermission(openapi.JSON(r.HandleFunc("/users/get", getUsersHandler)), rbac.PermMessengerUse)
+	middleware.RequirePermission(openapi.JSON(r.HandleFunc("/dialogs/get", getDialogsHandler)), rbac.PermMessengerUse)
+	middleware.RequirePermission(openapi.JSON(r.HandleFunc("/messages/get/{dialogId:[0-9]+}", getMessagesHandler)),
+		rbac.PermMessengerUse)
+	middleware.RequirePermission(openapi.JSON(r.HandleFunc("/messages/send", sendMessageHandler).Methods("POST")),
+		rbac.PermMessengerUse)
+	middleware.RequirePermission(openapi.JSON(r.HandleFunc("/dialogs/create", createDialogHandler).Methods("POST")),
+		rbac.PermMessengerUse)
+}
+
+// userResponse - собеседник в списке пользователей: только ID и логин
+type userResponse struct {
+	ID       uint   `json:"id"`
+	Username string `json:"username"`
 }
 
 func getUsersHandler(w http.ResponseWriter, r *http.Request) {
-	var users []models.User
+	users := []userResponse{}
 
-	userID, err := utils.GetCurUserID(w, r)
-	if err != nil {
-		return
-	}
+	user, _ := middleware.CurrentUser(r)
+	userID := user.ID
 
-	if err := db.Table("users").Select("users.*").
+	if err := db.Table("users").Select("users.id, users.username").
 		Joins("LEFT JOIN dialogs ON (users.id = dialogs.user1_id AND dialogs.user2_id = ?)"+
 			"OR (users.id = dialogs.user2_id AND dialogs.user1_id = ?)", userID, userID).
 		Where("users.id != ?", userID).
-		Where("users.is_admin OR users.is_tech_officer OR users.is_default_officer").
+		Scopes(rbac.WithPermission(rbac.PermMessengerUse)).
 		Where("dialogs.id IS NULL").
 		Find(&users).Error; err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -56,10 +66,8 @@ func getUsersHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func getDialogsHandler(w http.ResponseWriter, r *http.Request) {
-	userID, err := utils.GetCurUserID(w, r)
-	if err != nil {
-		return
-	}
+	user, _ := middleware.CurrentUser(r)
+	userID := user.ID
 
 	var dialogs []ExtendedDialog
 
@@ -102,6 +110,11 @@ func getMessagesHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	dialogId := vars["dialogId"]
 
+	user, _ := middleware.CurrentUser(r)
+	if _, ok := participantDialog(w, dialogId, user.ID); !ok {
+		return
+	}
+
 	var messages []ExtendedMessage
 
 	query := getMessagesQueryText()
@@ -132,11 +145,22 @@ func sendMessageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userID, err := utils.GetCurUserID(w, r)
-	if err != nil {
+	user, _ := middleware.CurrentUser(r)
+	message.SenderID = user.ID
+
+	// Отправить сообщение можно только собеседнику в своем диалоге
+	dialog, ok := participantDialog(w, message.DialogID, user.ID)
+	if !ok {
+		return
+	}
+	receiverID := dialog.User1ID
+	if receiverID == user.ID {
+		receiverID = dialog.User2ID
+	}
+	if message.ReceiverID != receiverID {
+		http.Error(w, "Получатель не участвует в диалоге", http.StatusBadRequest)
 		return
 	}
-	message.SenderID = userID
 
 	if err := db.Create(&message).Error; err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -154,6 +178,13 @@ func createDialogHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Создать можно только диалог, в котором участвует сам пользователь
+	user, _ := middleware.CurrentUser(r)
+	if dialog.User1ID != user.ID && dialog.User2ID != user.ID {
+		http.Error(w, "Недостаточно прав", http.StatusForbidden)
+		return
+	}
+
 	if err := db.Create(&dialog).Error; err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -161,3 +192,18 @@ func createDialogHandler(w http.ResponseWriter, r *http.Request) {
 
 	utils.SendJSON(w, dialog)
 }
+
+// participantDialog загружает диалог и проверяет, что пользователь в нем участвует
+func participantDialog(w http.ResponseWriter, dialogID interface{}, userID uint) (models.Dialog, bool) {
+	var dialog models.Dialog
+	if err := db.First(&dialog, dialogID).Error; err != nil {
+		http.Error(w, "Диалог не найден", http.StatusNotFound)
+		return dialog, false
+	}
+
+	if dialog.User1ID != userID && dialog.User2ID != userID {
+		http.Error(w, "Недостаточно прав", http.StatusForbidden)
+		return dialog, false
+	}
+	return dialog, true
+}
@@ -0,0 +1,41 @@
+package messenger
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"itsm/middleware"
+	"itsm/rbac"
+	"itsm/testenv"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Список собеседников содержит только ID и логин, без почты и состояния входа
+func TestGetUsersHidesAccountDetails(t *testing.T) {
+	database := testenv.Open(t)
+	router := mux.NewRouter()
+	router.Use(middleware.Authenticate(database))
+	SetupRoutes(router, database)
+
+	officer := testenv.User(t, database, "officer", rbac.RoleTechOfficer)
+	colleague := testenv.User(t, database, "colleague", rbac.RoleDefaultOfficer)
+	testenv.User(t, database, "client")
+	if err := database.Model(&colleague).Update("email", "colleague@example.com").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/users/get", nil)
+	req.Header.Set("Authorization", "Bearer "+testenv.Token(t, database, officer))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	want := fmt.Sprintf(`[{"id":%d,"username":"colleague"}]`, colleague.ID)
+	if body := strings.TrimSpace(rec.Body.String()); body != want {
+		t.Errorf("users = %s, want %s", body, want)
+	}
+}
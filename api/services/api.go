@@ -0,0 +1,189 @@
+package services
+
+import (
+	"errors"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"itsm/middleware"
+	"itsm/models"
+	"itsm/rbac"
+	"itsm/utils"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// JSON API каталога услуг. Просматривать каталог может любой авторизованный
+// пользователь, изменять - пользователи с разрешениями service.*
+
+// Типы услуг в API
+const (
+	typeBusiness  = "business"
+	typeTechnical = "technical"
+)
+
+func setupAPIRoutes(r *mux.Router) {
+	api := r.PathPrefix("/api/v1/services").Subrouter()
+	api.HandleFunc("", apiListServicesHandler).Methods("GET")
+	middleware.RequirePermission(api.HandleFunc("", apiCreateServiceHandler).Methods("POST"), rbac.PermServiceCreate)
+	api.HandleFunc("/{id:[0-9]+}", apiGetServiceHandler).Methods("GET")
+	middleware.RequirePermission(api.HandleFunc("/{id:[0-9]+}", apiUpdateServiceHandler).Methods("PUT"),
+		rbac.PermServiceUpdate)
+	middleware.RequirePermission(api.HandleFunc("/{id:[0-9]+}", apiDeleteServiceHandler).Methods("DELETE"),
+		rbac.PermServiceDelete)
+}
+
+type serviceResponse struct {
+	ID          uint   `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Type        string `json:"type"`
+}
+
+// serviceRequest - тело запросов создания и изменения услуги
+type serviceRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Type        string `json:"type"`
+}
+
+func newServiceResponse(service models.Service) serviceResponse {
+	response := serviceResponse{
+		ID:          service.ID,
+		Name:        service.Name,
+		Description: service.Description,
+	}
+	switch {
+	case service.IsBusiness:
+		response.Type = typeBusiness
+	case service.IsTechnical:
+		response.Type = typeTechnical
+	}
+	return response
+}
+
+// decodeServiceRequest разбирает и проверяет тело запроса
+func decodeServiceRequest(w http.ResponseWriter, r *http.Request) (serviceRequest, bool) {
+	var req serviceRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteJSONError(w, err)
+		return req, false
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		utils.SendJSONError(w, http.StatusUnprocessableEntity, "Название услуги не указано")
+		return req, false
+	}
+	if req.Type != typeBusiness && req.Type != typeTechnical {
+		utils.SendJSONError(w, http.StatusUnprocessableEntity, "Тип услуги должен быть business или technical")
+		return req, false
+	}
+	return req, true
+}
+
+func (req serviceRequest) apply(service *models.Service) {
+	service.Name = req.Name
+	service.Description = req.Description
+	service.IsBusiness = req.Type == typeBusiness
+	service.IsTechnical = req.Type == typeTechnical
+}
+
+// findService загружает услугу по ID из пути; false - ответ с ошибкой уже отправлен
+func findService(w http.ResponseWriter, r *http.Request) (models.Service, bool) {
+	var service models.Service
+	if err := db.First(&service, mux.Vars(r)["id"]).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.SendJSONError(w, http.StatusNotFound, "Услуга не найдена")
+		} else {
+			utils.SendJSONError(w, http.StatusInternalServerError, "Ошибка при получении услуги")
+		}
+		return service, false
+	}
+	return service, true
+}
+
+func apiListServicesHandler(w http.ResponseWriter, r *http.Request) {
+	query := db.Order("name")
+	switch serviceType := r.URL.Query().Get("type"); serviceType {
+	case "":
+	case typeBusiness:
+		query = query.Where("is_business = ?", true)
+	case typeTechnical:
+		query = query.Where("is_technical = ?", true)
+	default:
+		utils.SendJSONError(w, http.StatusBadRequest, "Неизвестный тип услуги «"+serviceType+"»")
+		return
+	}
+
+	var services []models.Service
+	if err := query.Find(&services).Error; err != nil {
+		utils.SendJSONError(w, http.StatusInternalServerError, "Ошибка при получении услуг")
+		return
+	}
+
+	response := make([]serviceResponse, 0, len(services))
+	for _, service := range services {
+		response = append(response, newServiceResponse(service))
+	}
+	utils.SendJSON(w, response)
+}
+
+func apiGetServiceHandler(w http.ResponseWriter, r *http.Request) {
+	service, ok := findService(w, r)
+	if !ok {
+		return
+	}
+	utils.SendJSON(w, newServiceResponse(service))
+}
+
+func apiCreateServiceHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeServiceRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var service models.Service
+	req.apply(&service)
+	if err := db.Create(&service).Error; err != nil {
+		utils.SendJSONError(w, http.StatusInternalServerError, "Ошибка при создании услуги")
+		return
+	}
+
+	w.Header().Set("Location", "/api/v1/services/"+strconv.FormatUint(uint64(service.ID), 10))
+	utils.WriteJSON(w, http.StatusCreated, newServiceResponse(service))
+}
+
+func apiUpdateServiceHandler(w http.ResponseWriter, r *http.Request) {
+	service, ok := findService(w, r)
+	if !ok {
+		return
+	}
+
+	req, ok := decodeServiceRequest(w, r)
+	if !ok {
+		return
+	}
+
+	req.apply(&service)
+	if err := db.Save(&service).Error; err != nil {
+		utils.SendJSONError(w, http.StatusInternalServerError, "Ошибка при обновлении услуги")
+		return
+	}
+
+	utils.SendJSON(w, newServiceResponse(service))
+}
+
+func apiDeleteServiceHandler(w http.ResponseWriter, r *http.Request) {
+	service, ok := findService(w, r)
+	if !ok {
+		return
+	}
+
+	if err := deleteService(service); err != nil {
+		utils.WriteJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -3,8 +3,9 @@ package services
 import (
 	"github.com/gorilla/mux"
 	"gorm.io/gorm"
-	"html/template"
+	"itsm/middleware"
 	"itsm/models"
+	"itsm/rbac"
 	"itsm/utils"
 	"net/http"
 	"strconv"
@@ -14,12 +15,18 @@ var db *gorm.DB
 
 func SetupRoutes(r *mux.Router, database *gorm.DB) {
 	db = database
-	r.HandleFunc("/service/{id}/delete", deleteServiceHandler).Methods("DELETE")
-	r.HandleFunc("/service/{id}/edit", editServiceHandler).Methods("GET")
+	middleware.RequirePermission(r.HandleFunc("/service/{id}/delete", deleteServiceHandler).Methods("DELETE"),
+		rbac.PermServiceDelete)
+	middleware.RequirePermission(r.HandleFunc("/service/{id}/edit", editServiceHandler).Methods("GET"),
+		rbac.PermServiceUpdate)
 	r.HandleFunc("/service/{id}", openServiceHandler).Methods("GET")
-	r.HandleFunc("/service/{id}/update", updateServiceHandler).Methods("PUT")
-	r.HandleFunc("/services/create", createServiceHandler).Methods("POST")
-	r.HandleFunc("/services/add", addServiceHandler).Methods("GET")
+	middleware.RequirePermission(r.HandleFunc("/service/{id}/update", updateServiceHandler).Methods("PUT"),
+		rbac.PermServiceUpdate)
+	middleware.RequirePermission(r.HandleFunc("/services/create", createServiceHandler).Methods("POST"),
+		rbac.PermServiceCreate)
+	middleware.RequirePermission(r.HandleFunc("/services/add", addServiceHandler).Methods("GET"),
+		rbac.PermServiceCreate)
+	setupAPIRoutes(r)
 }
 
 func updateServiceHandler(w http.ResponseWriter, r *http.Request) {
@@ -81,7 +88,7 @@ func addServiceHandler(w http.ResponseWriter, r *http.Request) {
 		IsClient: false,
 	}
 
-	renderTemplate(w, "templates/service/service.html", data)
+	renderTemplate(w, r, "templates/service/service.html", data)
 }
 
 func openServiceHandler(w http.ResponseWriter, r *http.Request) {
@@ -99,11 +106,8 @@ func openServiceHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	isClient, err := utils.IsClientUser(r)
-	if err != nil {
-		http.Error(w, "Ошибка получения сессии: "+err.Error(), http.StatusUnauthorized)
-		return
-	}
+	user, _ := middleware.CurrentUser(r)
+	isClient := rbac.IsClient(user)
 
 	data := struct {
 		Service  models.Service
@@ -119,7 +123,7 @@ func openServiceHandler(w http.ResponseWriter, r *http.Request) {
 		IsClient: isClient,
 	}
 
-	renderTemplate(w, "templates/service/service.html", data)
+	renderTemplate(w, r, "templates/service/service.html", data)
 }
 
 func editServiceHandler(w http.ResponseWriter, r *http.Request) {
@@ -151,11 +155,11 @@ func editServiceHandler(w http.ResponseWriter, r *http.Request) {
 		IsClient: false,
 	}
 
-	renderTemplate(w, "templates/service/service.html", data)
+	renderTemplate(w, r, "templates/service/service.html", data)
 }
 
-func renderTemplate(w http.ResponseWriter, tmpl string, data interface{}) {
-	t, err := template.ParseFiles(tmpl, "templates/header/header.html")
+func renderTemplate(w http.ResponseWriter, r *http.Request, tmpl string, data interface{}) {
+	t, err := utils.ParsePage(r, tmpl, nil)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -166,6 +170,26 @@ func renderTemplate(w http.ResponseWriter, tmpl string, data interface{}) {
 
 }
 
+// deleteService удаляет услугу вместе с ее политиками SLA. Услугу, указанную
+// в инцидентах, удалить нельзя - иначе пропадет связь
+func deleteService(service models.Service) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var linked int64
+		if err := tx.Table("incident_services").Where("service_id = ?", service.ID).Count(&linked).Error; err != nil {
+			return err
+		}
+		if linked > 0 {
+			return utils.NewRequestError(http.StatusConflict, "Услуга указана в инцидентах и не может быть удалена")
+		}
+
+		// Политики услуги применяются только к ее инцидентам, а их нет
+		if err := tx.Where("service_id = ?", service.ID).Delete(&models.SLAPolicy{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&service).Error
+	})
+}
+
 func deleteServiceHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	serviceID := vars["id"]
@@ -187,8 +211,8 @@ func deleteServiceHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := db.Delete(&service).Error; err != nil {
-		http.Error(w, "Ошибка при удалении услуги", http.StatusInternalServerError)
+	if err := deleteService(service); err != nil {
+		utils.WriteError(w, err)
 		return
 	}
 
@@ -0,0 +1,197 @@
+package apitoken
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"gorm.io/gorm"
+	"itsm/models"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Личные API-токены. Токен передается в заголовке Authorization: Bearer
+// и дает доступ к JSON-маршрутам от имени пользователя с его ролями.
+// Токен показывается один раз при создании, в базе хранится только хеш
+
+// Области действия токена
+const (
+	ScopeRead  = "read"  // только запросы, не изменяющие данные
+	ScopeWrite = "write" // все запросы, разрешенные ролям пользователя
+)
+
+// ScopeTitles - названия областей для вывода
+var ScopeTitles = map[string]string{
+	ScopeRead:  "Только чтение",
+	ScopeWrite: "Чтение и изменение",
+}
+
+const (
+	prefix      = "itsm_" // отличает токены системы от прочих секретов, например при поиске утечек
+	tokenLength = 32      // байт случайных данных
+	prefixShown = 12      // символов токена, сохраняемых для списка
+	maxName     = 100
+)
+
+// Как часто обновляется время последнего использования
+const lastUsedInterval = time.Minute
+
+// Максимальное число действующих токенов пользователя
+const maxTokens = 20
+
+// ErrInvalid - токен не найден, отозван или истек
+var ErrInvalid = errors.New("Недействительный API-токен")
+
+// ErrLimit - у пользователя слишком много токенов
+var ErrLimit = errors.New("Достигнуто максимальное число токенов. Отзовите ненужные")
+
+// ValidationError - ошибка в параметрах нового токена
+type ValidationError struct {
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+// Create создает токен и возвращает его вместе с записью. ttl = 0 - бессрочный токен
+func Create(tx *gorm.DB, userID uint, name, scope string, ttl time.Duration) (string, models.APIToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len([]rune(name)) > maxName {
+		return "", models.APIToken{}, &ValidationError{"Название токена должно содержать от 1 до 100 символов"}
+	}
+	if _, ok := ScopeTitles[scope]; !ok {
+		return "", models.APIToken{}, &ValidationError{"Неизвестная область действия токена"}
+	}
+	if ttl < 0 {
+		return "", models.APIToken{}, &ValidationError{"Срок действия не может быть отрицательным"}
+	}
+
+	var count int64
+	err := tx.Model(&models.APIToken{}).Scopes(active(time.Now())).Where("user_id = ?", userID).Count(&count).Error
+	if err != nil {
+		return "", models.APIToken{}, err
+	}
+	if count >= maxTokens {
+		return "", models.APIToken{}, ErrLimit
+	}
+
+	buf := make([]byte, tokenLength)
+	if _, err := rand.Read(buf); err != nil {
+		return "", models.APIToken{}, err
+	}
+	token := prefix + base64.RawURLEncoding.EncodeToString(buf)
+
+	record := models.APIToken{
+		UserID:    userID,
+		Name:      name,
+		Prefix:    token[:prefixShown],
+		TokenHash: hashToken(token),
+		Scope:     scope,
+	}
+	if ttl > 0 {
+		expiresAt := time.Now().Add(ttl)
+		record.ExpiresAt = &expiresAt
+	}
+	if err := tx.Create(&record).Error; err != nil {
+		return "", record, err
+	}
+	return token, record, nil
+}
+
+// FromRequest возвращает токен из заголовка Authorization. false - заголовка нет
+// или в нем другая схема
+func FromRequest(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// Authenticate находит действующий токен и отмечает его использование
+func Authenticate(db *gorm.DB, token string) (models.APIToken, error) {
+	var record models.APIToken
+	if !strings.HasPrefix(token, prefix) {
+		return record, ErrInvalid
+	}
+
+	now := time.Now()
+	err := db.Scopes(active(now)).Where("token_hash = ?", hashToken(token)).First(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return record, ErrInvalid
+	}
+	if err != nil {
+		return record, err
+	}
+
+	// Время использования пишется не чаще раза в минуту, чтобы частые
+	// запросы мониторинга не превращались в поток обновлений
+	if record.LastUsedAt == nil || now.Sub(*record.LastUsedAt) > lastUsedInterval {
+		if err := db.Model(&record).Update("last_used_at", now).Error; err != nil {
+			return record, err
+		}
+	}
+	return record, nil
+}
+
+// Allows сообщает, разрешает ли область токена запрос с методом method
+func Allows(token models.APIToken, method string) bool {
+	if token.Scope == ScopeWrite {
+		return true
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// List возвращает токены пользователя, кроме отозванных, новые первыми
+func List(db *gorm.DB, userID uint) ([]models.APIToken, error) {
+	var list []models.APIToken
+	err := db.Where("user_id = ? AND revoked_at IS NULL", userID).Order("created_at DESC, id DESC").Find(&list).Error
+	return list, err
+}
+
+// Revoke отзывает токен пользователя. false - токен не найден или уже отозван
+func Revoke(db *gorm.DB, userID, tokenID uint) (models.APIToken, bool, error) {
+	var record models.APIToken
+	err := db.Where("id = ? AND user_id = ? AND revoked_at IS NULL", tokenID, userID).First(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return record, false, nil
+	}
+	if err != nil {
+		return record, false, err
+	}
+	now := time.Now()
+	result := db.Model(&models.APIToken{}).Where("id = ? AND revoked_at IS NULL", record.ID).Update("revoked_at", now)
+	record.RevokedAt = &now
+	return record, result.RowsAffected > 0, result.Error
+}
+
+// RevokeAll отзывает все токены пользователя и возвращает их число
+func RevokeAll(db *gorm.DB, userID uint) (int64, error) {
+	result := db.Model(&models.APIToken{}).Where("user_id = ? AND revoked_at IS NULL", userID).Update("revoked_at", time.Now())
+	return result.RowsAffected, result.Error
+}
+
+// Expired сообщает, истек ли срок действия токена
+func Expired(token models.APIToken) bool {
+	return token.ExpiresAt != nil && !token.ExpiresAt.After(time.Now())
+}
+
+// active - условие выборки неотозванных и неистекших токенов
+func active(now time.Time) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", now)
+	}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
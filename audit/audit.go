@@ -0,0 +1,151 @@
+package audit
+
+import (
+	"fmt"
+	"gorm.io/gorm"
+	"itsm/models"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Действия, записываемые в журнал аудита
+const (
+	ActionUserCreate           = "user.create"
+	ActionUserRoles            = "user.roles"
+	ActionUserTeam             = "user.team"
+	ActionUserPasswordReset    = "user.password_reset"
+	ActionUserDeactivate       = "user.deactivate"
+	ActionUserActivate         = "user.activate"
+	ActionTeamCreate           = "team.create"
+	ActionSessionRevoke        = "session.revoke"
+	ActionUserLock             = "user.lock"
+	ActionUserUnlock           = "user.unlock"
+	ActionUserPasswordChange   = "user.password_change"
+	ActionUserTwoFactorEnable  = "user.2fa_enable"
+	ActionUserTwoFactorDisable = "user.2fa_disable"
+	ActionUserTwoFactorReset   = "user.2fa_reset"
+	ActionUserRecoveryCodes    = "user.recovery_codes"
+	ActionUserPasswordRecover  = "user.password_recover"
+	ActionUserEmail            = "user.email"
+	ActionUserIdentityLink     = "user.identity_link"
+	ActionTokenCreate          = "token.create"
+	ActionTokenRevoke          = "token.revoke"
+)
+
+// ActionTitles - названия действий для вывода в журнале
+var ActionTitles = map[string]string{
+	ActionUserCreate:           "Создание пользователя",
+	ActionUserRoles:            "Изменение ролей",
+	ActionUserTeam:             "Изменение команды",
+	ActionUserPasswordReset:    "Сброс пароля",
+	ActionUserDeactivate:       "Отключение пользователя",
+	ActionUserActivate:         "Включение пользователя",
+	ActionTeamCreate:           "Создание команды",
+	ActionSessionRevoke:        "Завершение сессий",
+	ActionUserLock:             "Блокировка входа",
+	ActionUserUnlock:           "Снятие блокировки входа",
+	ActionUserPasswordChange:   "Смена пароля пользователем",
+	ActionUserTwoFactorEnable:  "Включение двухфакторной аутентификации",
+	ActionUserTwoFactorDisable: "Отключение двухфакторной аутентификации",
+	ActionUserTwoFactorReset:   "Сброс двухфакторной аутентификации",
+	ActionUserRecoveryCodes:    "Новые резервные коды",
+	ActionUserPasswordRecover:  "Восстановление пароля по почте",
+	ActionUserEmail:            "Изменение адреса почты",
+	ActionUserIdentityLink:     "Привязка учетной записи провайдера",
+	ActionTokenCreate:          "Создание API-токена",
+	ActionTokenRevoke:          "Отзыв API-токена",
+}
+
+// Event - данные записи журнала. ActorID и TargetID могут быть нулевыми
+type Event struct {
+	ActorID  uint
+	Action   string
+	TargetID uint
+	Details  string
+}
+
+// Record записывает событие в журнал аудита вместе с адресом клиента
+func Record(db *gorm.DB, r *http.Request, event Event) error {
+	entry := models.AuditEvent{
+		Action:  event.Action,
+		Details: event.Details,
+		IP:      ClientIP(r),
+	}
+	if event.ActorID != 0 {
+		entry.ActorID = &event.ActorID
+	}
+	if event.TargetID != 0 {
+		entry.TargetID = &event.TargetID
+	}
+	return db.Create(&entry).Error
+}
+
+// trustedProxies - сети обратных прокси, от которых принимается X-Forwarded-For
+var trustedProxies []*net.IPNet
+
+// ConfigureTrustedProxies задает адреса и сети (CIDR) обратных прокси перед
+// сервером. Без них X-Forwarded-For не читается: иначе клиент подставлял бы
+// в заголовок любой адрес и обходил ограничение попыток входа по адресу
+func ConfigureTrustedProxies(proxies []string) error {
+	var networks []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return fmt.Errorf("некорректный адрес прокси %q", proxy)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return fmt.Errorf("некорректная сеть прокси %q: %w", proxy, err)
+		}
+		networks = append(networks, network)
+	}
+	trustedProxies = networks
+	return nil
+}
+
+func trusted(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP возвращает адрес клиента. Если соединение пришло от доверенного прокси,
+// X-Forwarded-For разбирается справа налево до первого адреса не из доверенных
+// сетей: адреса левее него мог подставить сам клиент
+func ClientIP(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !trusted(ip) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !trusted(ip) {
+			break
+		}
+	}
+	return ip.String()
+}
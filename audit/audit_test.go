@@ -0,0 +1,50 @@
+package audit
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	if err := ConfigureTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ConfigureTrustedProxies(nil) })
+
+	for _, tc := range []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct", "203.0.113.5:1234", nil, "203.0.113.5"},
+		{"untrusted sender", "203.0.113.5:1234", []string{"198.51.100.7"}, "203.0.113.5"},
+		{"trusted proxy", "10.1.2.3:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"single trusted address", "192.168.1.1:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"address next to trusted", "192.168.1.2:1234", []string{"198.51.100.7"}, "192.168.1.2"},
+		// Адрес, подставленный клиентом левее, не учитывается
+		{"spoofed by client", "10.1.2.3:1234", []string{"1.1.1.1, 198.51.100.7"}, "198.51.100.7"},
+		{"proxy chain", "10.1.2.3:1234", []string{"1.1.1.1, 198.51.100.7", "10.9.9.9"}, "198.51.100.7"},
+		{"only proxies", "10.1.2.3:1234", []string{"10.4.4.4"}, "10.4.4.4"},
+		{"invalid hop", "10.1.2.3:1234", []string{"198.51.100.7, garbage"}, "10.1.2.3"},
+		{"no header", "10.1.2.3:1234", nil, "10.1.2.3"},
+		{"ipv6 proxy", "[fd00::1]:1234", []string{"2001:db8::7"}, "2001:db8::7"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remoteAddr
+		for _, value := range tc.forwarded {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		if got := ClientIP(r); got != tc.want {
+			t.Errorf("%s: ClientIP = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestConfigureTrustedProxiesRejectsInvalid(t *testing.T) {
+	for _, proxy := range []string{"proxy.local", "10.0.0.0/33"} {
+		if err := ConfigureTrustedProxies([]string{proxy}); err == nil {
+			t.Errorf("ConfigureTrustedProxies(%q) succeeded", proxy)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package authn
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"itsm/audit"
+	"itsm/models"
+	"itsm/rbac"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Проверка логина и пароля. Пароль локальных пользователей хранится в базе,
+// пароль пользователей из внешнего каталога проверяет провайдер этого каталога.
+// Пользователь каталога при первом входе создается в таблице users, а его роли
+// обновляются по группам каталога при каждом входе
+
+// Источники учетных записей
+const (
+	SourceLocal = "local"
+	SourceLDAP  = "ldap"
+	SourceOIDC  = "oidc" // вход только через внешнего провайдера, пароля нет
+)
+
+// ErrInvalidCredentials - неверный логин или пароль
+var ErrInvalidCredentials = errors.New("неверный логин или пароль")
+
+// Identity - пользователь, подтвержденный внешним каталогом
+type Identity struct {
+	Username string
+	Email    string
+	Roles    []string // роли по группам каталога
+}
+
+// Provider проверяет пароль пользователей одного источника
+type Provider interface {
+	// Source - значение models.User.AuthSource пользователей провайдера
+	Source() string
+	// Authenticate проверяет пароль. user - локальная запись с этим логином
+	// или nil. Для локального провайдера Identity не возвращается
+	Authenticate(user *models.User, username, password string) (*Identity, error)
+}
+
+// ManagedRoles - роли, которые внешний провайдер назначает по группам.
+// Остальные роли пользователя, назначенные администратором, сохраняются
+type ManagedRoles interface {
+	ManagedRoles() []string
+}
+
+var (
+	local     Provider = Local{}
+	directory Provider // внешний каталог; nil - только локальные пользователи
+)
+
+// Configure подключает внешний каталог
+func Configure(p Provider) {
+	directory = p
+}
+
+// Authenticate проверяет пароль пользователя. user - локальная запись с логином
+// username или nil. Для пользователя каталога возвращается Identity, которую
+// нужно передать в Provision
+func Authenticate(user *models.User, username, password string) (*Identity, error) {
+	// Пустой пароль каталог LDAP счел бы анонимным входом
+	if password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	switch {
+	case user == nil && directory != nil:
+		return directory.Authenticate(nil, username, password)
+	case user == nil || user.AuthSource == local.Source() || user.AuthSource == "":
+		return local.Authenticate(user, username, password)
+	case directory != nil && user.AuthSource == directory.Source():
+		return directory.Authenticate(user, username, password)
+	default:
+		// Каталог, из которого создан пользователь, отключен
+		local.Authenticate(nil, username, password)
+		return nil, ErrInvalidCredentials
+	}
+}
+
+// IsLocal сообщает, хранится ли пароль пользователя в базе. Пароль пользователя
+// каталога нельзя сменить или восстановить в системе
+func IsLocal(user models.User) bool {
+	return user.AuthSource == SourceLocal || user.AuthSource == ""
+}
+
+// Provision создает пользователя каталога при первом входе или обновляет его
+// адрес почты и роли. user - найденная по логину запись или nil
+func Provision(db *gorm.DB, r *http.Request, user *models.User, identity Identity) (models.User, error) {
+	var result models.User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if user == nil {
+			result = models.User{Username: identity.Username, AuthSource: directory.Source()}
+			if err := tx.Create(&result).Error; err != nil {
+				return err
+			}
+			err := audit.Record(tx, r, audit.Event{
+				Action:   audit.ActionUserCreate,
+				TargetID: result.ID,
+				Details:  "Первый вход через каталог " + directory.Source(),
+			})
+			if err != nil {
+				return err
+			}
+		} else if err := rbac.PreloadRoles(tx).First(&result, user.ID).Error; err != nil {
+			return err
+		}
+
+		if err := updateEmail(tx, &result, identity.Email); err != nil {
+			return err
+		}
+		var managed []string
+		if m, ok := directory.(ManagedRoles); ok {
+			managed = m.ManagedRoles()
+		}
+		return SyncRoles(tx, r, &result, managed, identity.Roles, "каталога "+directory.Source())
+	})
+	return result, err
+}
+
+// updateEmail сохраняет адрес из каталога, если он не занят другим пользователем
+func updateEmail(tx *gorm.DB, user *models.User, email string) error {
+	if email == "" || (user.Email != nil && *user.Email == email) {
+		return nil
+	}
+
+	var count int64
+	if err := tx.Model(&models.User{}).Where("email = ? AND id <> ?", email, user.ID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		log.Printf("Адрес %s пользователя каталога %s уже указан у другого пользователя", email, user.Username)
+		return nil
+	}
+
+	user.Email = &email
+	return tx.Model(user).Update("email", email).Error
+}
+
+// SyncRoles заменяет роли пользователя из списка managed ролями granted, полученными
+// от внешнего источника source. Остальные роли, назначенные администратором, сохраняются.
+// Роли пользователя должны быть загружены
+func SyncRoles(tx *gorm.DB, r *http.Request, user *models.User, managed, granted []string, source string) error {
+	if len(managed) == 0 {
+		return nil
+	}
+
+	var names []string
+	for _, role := range user.Roles {
+		if !slices.Contains(managed, role.Name) {
+			names = append(names, role.Name)
+		}
+	}
+	names = append(names, granted...)
+	slices.Sort(names)
+	names = slices.Compact(names)
+
+	current := make([]string, 0, len(user.Roles))
+	for _, role := range user.Roles {
+		current = append(current, role.Name)
+	}
+	slices.Sort(current)
+	if slices.Equal(current, names) {
+		return nil
+	}
+
+	if err := rbac.SetUserRoles(tx, user, names); err != nil {
+		return err
+	}
+	return audit.Record(tx, r, audit.Event{
+		Action:   audit.ActionUserRoles,
+		TargetID: user.ID,
+		Details:  fmt.Sprintf("По данным %s: %s", source, strings.Join(names, ", ")),
+	})
+}
+
+// Local проверяет bcrypt-хеш пароля из таблицы users
+type Local struct{}
+
+func (Local) Source() string {
+	return SourceLocal
+}
+
+func (Local) Authenticate(user *models.User, _, password string) (*Identity, error) {
+	// Для несуществующего логина пароль тоже проверяется, чтобы время ответа
+	// не выдавало, есть ли такой пользователь
+	hash := dummyHash()
+	if user != nil {
+		hash = []byte(user.Password)
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || user == nil {
+		return nil, ErrInvalidCredentials
+	}
+	return nil, nil
+}
+
+// dummyHash - хеш случайного пароля для проверки несуществующих логинов
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte(time.Now().String()), bcrypt.DefaultCost)
+	if err != nil {
+		log.Fatal("Ошибка при хешировании пароля:", err)
+	}
+	return hash
+})
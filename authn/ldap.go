@@ -0,0 +1,215 @@
+package authn
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"itsm/models"
+	"net"
+	"strings"
+	"time"
+)
+
+// LDAPConfig - параметры подключения к каталогу LDAP или Active Directory
+type LDAPConfig struct {
+	URL            string // ldap://host:389 или ldaps://host:636
+	StartTLS       bool
+	BindDN         string // служебная учетная запись для поиска; пустая - анонимный поиск
+	BindPassword   string
+	BaseDN         string
+	UserFilter     string // %s заменяется логином, например (uid=%s) или (sAMAccountName=%s)
+	EmailAttribute string
+	GroupBaseDN    string              // пустой - группы берутся из атрибута memberOf пользователя
+	GroupFilter    string              // %s заменяется DN пользователя
+	GroupRoles     map[string][]string // роль - DN групп, участники которых ее получают
+	Timeout        time.Duration
+}
+
+// DefaultLDAPConfig - значения для OpenLDAP
+var DefaultLDAPConfig = LDAPConfig{
+	UserFilter:     "(&(objectClass=person)(uid=%s))",
+	EmailAttribute: "mail",
+	GroupFilter:    "(member=%s)",
+	Timeout:        10 * time.Second,
+}
+
+// Validate проверяет обязательные параметры
+func (c LDAPConfig) Validate() error {
+	if c.URL == "" || c.BaseDN == "" {
+		return errors.New("не указаны адрес каталога и базовый DN")
+	}
+	if !strings.Contains(c.UserFilter, "%s") {
+		return errors.New("фильтр пользователя должен содержать %s")
+	}
+	if c.GroupBaseDN != "" && !strings.Contains(c.GroupFilter, "%s") {
+		return errors.New("фильтр групп должен содержать %s")
+	}
+	return nil
+}
+
+// LDAP проверяет пароль привязкой к каталогу от имени пользователя
+type LDAP struct {
+	config LDAPConfig
+}
+
+func NewLDAP(config LDAPConfig) *LDAP {
+	return &LDAP{config: config}
+}
+
+func (p *LDAP) Source() string {
+	return SourceLDAP
+}
+
+func (p *LDAP) ManagedRoles() []string {
+	roles := make([]string, 0, len(p.config.GroupRoles))
+	for role := range p.config.GroupRoles {
+		roles = append(roles, role)
+	}
+	return roles
+}
+
+// Authenticate находит пользователя служебной учетной записью, проверяет
+// пароль привязкой от имени найденного DN и читает его группы
+func (p *LDAP) Authenticate(_ *models.User, username, password string) (*Identity, error) {
+	conn, err := p.dial()
+	if err != nil {
+		return nil, fmt.Errorf("подключение к LDAP: %w", err)
+	}
+	defer conn.Close()
+
+	if err := p.bindService(conn); err != nil {
+		return nil, err
+	}
+
+	entry, err := p.findUser(conn, username)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("проверка пароля в LDAP: %w", err)
+	}
+
+	// Группы читаются служебной учетной записью: у пользователя может не быть прав на поиск
+	if err := p.bindService(conn); err != nil {
+		return nil, err
+	}
+	groups, err := p.groups(conn, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		Username: username,
+		Email:    entry.GetAttributeValue(p.config.EmailAttribute),
+		Roles:    p.roles(groups),
+	}, nil
+}
+
+func (p *LDAP) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(p.config.URL, ldap.DialWithDialer(&net.Dialer{Timeout: p.config.Timeout}))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(p.config.Timeout)
+
+	if p.config.StartTLS {
+		host := strings.TrimPrefix(strings.TrimPrefix(p.config.URL, "ldap://"), "ldaps://")
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (p *LDAP) bindService(conn *ldap.Conn) error {
+	var err error
+	if p.config.BindDN == "" {
+		err = conn.UnauthenticatedBind("")
+	} else {
+		err = conn.Bind(p.config.BindDN, p.config.BindPassword)
+	}
+	if err != nil {
+		return fmt.Errorf("вход служебной учетной записи LDAP: %w", err)
+	}
+	return nil
+}
+
+// findUser ищет единственную запись с логином username
+func (p *LDAP) findUser(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	request := ldap.NewSearchRequest(p.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(p.config.Timeout.Seconds()), false,
+		fmt.Sprintf(p.config.UserFilter, ldap.EscapeFilter(username)),
+		[]string{p.config.EmailAttribute, "memberOf"}, nil)
+
+	result, err := conn.Search(request)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("поиск пользователя в LDAP: %w", err)
+	}
+	if result == nil || len(result.Entries) != 1 {
+		// Неоднозначный логин считается неверным, чтобы не войти чужой записью
+		return nil, ErrInvalidCredentials
+	}
+	return result.Entries[0], nil
+}
+
+// groups возвращает DN групп пользователя
+func (p *LDAP) groups(conn *ldap.Conn, entry *ldap.Entry) ([]string, error) {
+	if p.config.GroupBaseDN == "" {
+		return entry.GetAttributeValues("memberOf"), nil
+	}
+
+	request := ldap.NewSearchRequest(p.config.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, int(p.config.Timeout.Seconds()), false,
+		fmt.Sprintf(p.config.GroupFilter, ldap.EscapeFilter(entry.DN)),
+		[]string{"1.1"}, nil) // 1.1 - только DN, без атрибутов
+
+	result, err := conn.Search(request)
+	if err != nil {
+		return nil, fmt.Errorf("поиск групп в LDAP: %w", err)
+	}
+	groups := make([]string, 0, len(result.Entries))
+	for _, group := range result.Entries {
+		groups = append(groups, group.DN)
+	}
+	return groups, nil
+}
+
+// roles сопоставляет группам пользователя роли
+func (p *LDAP) roles(groups []string) []string {
+	var roles []string
+	for role, roleGroups := range p.config.GroupRoles {
+		for _, group := range roleGroups {
+			if containsDN(groups, group) {
+				roles = append(roles, role)
+				break
+			}
+		}
+	}
+	return roles
+}
+
+// containsDN сравнивает DN без учета регистра и пробелов между компонентами
+func containsDN(list []string, dn string) bool {
+	want, err := ldap.ParseDN(dn)
+	for _, item := range list {
+		if err != nil {
+			if strings.EqualFold(item, dn) {
+				return true
+			}
+			continue
+		}
+		if got, err := ldap.ParseDN(item); err == nil && want.EqualFold(got) {
+			return true
+		}
+	}
+	return false
+}
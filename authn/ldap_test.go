@@ -0,0 +1,279 @@
+package authn
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"itsm/models"
+	"itsm/rbac"
+	"itsm/testenv"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Интеграционный тест входа через LDAP. Выполняется, только если указан адрес
+// каталога LDAP_TEST_URL; учетная запись LDAP_TEST_BIND_DN должна иметь право
+// создавать записи в LDAP_TEST_BASE_DN. Тест создает свое поддерево и удаляет
+// его в конце. Роли по memberOf проверяются, если каталог ведет этот атрибут.
+// Например, для OpenLDAP в Docker с оверлеем memberOf:
+//
+//	docker run -d -p 389:389 osixia/openldap
+//	LDAP_TEST_URL=ldap://localhost:389 LDAP_TEST_BIND_DN=cn=admin,dc=example,dc=org \
+//	LDAP_TEST_BIND_PASSWORD=admin LDAP_TEST_BASE_DN=dc=example,dc=org go test ./authn
+
+const ldapTestPassword = "Directory-Pass-1"
+
+// ldapTest - тестовое поддерево каталога
+type ldapTest struct {
+	conn   *ldap.Conn
+	config LDAPConfig
+	root   string // DN поддерева
+	people string
+	groups string
+	admins string // DN группы администраторов
+	unique string // DN такой же группы groupOfUniqueNames: memberOf ведется для групп одного из видов
+}
+
+func newLDAPTest(t *testing.T) *ldapTest {
+	address := os.Getenv("LDAP_TEST_URL")
+	if address == "" {
+		t.Skip("LDAP_TEST_URL не указан")
+	}
+	bindDN, bindPassword := os.Getenv("LDAP_TEST_BIND_DN"), os.Getenv("LDAP_TEST_BIND_PASSWORD")
+	baseDN := os.Getenv("LDAP_TEST_BASE_DN")
+
+	conn, err := ldap.DialURL(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.Bind(bindDN, bindPassword); err != nil {
+		t.Fatal(err)
+	}
+
+	test := &ldapTest{conn: conn, root: fmt.Sprintf("ou=itsm-test-%d,%s", time.Now().UnixNano(), baseDN)}
+	test.people = "ou=people," + test.root
+	test.groups = "ou=groups," + test.root
+	test.admins = "cn=admins," + test.groups
+	test.unique = "cn=unique-admins," + test.groups
+
+	test.add(t, test.root, map[string][]string{"objectClass": {"organizationalUnit"}})
+	t.Cleanup(func() { test.deleteTree(t) })
+	test.add(t, test.people, map[string][]string{"objectClass": {"organizationalUnit"}})
+	test.add(t, test.groups, map[string][]string{"objectClass": {"organizationalUnit"}})
+
+	test.addPerson(t, "Ivan Ivanov", "ivanov", "ivanov@example.com")
+	test.addPerson(t, "Petr Petrov", "petrov", "")
+	// Две записи с одним логином
+	test.addPerson(t, "Twin One", "twin", "")
+	test.addPerson(t, "Twin Two", "twin", "")
+
+	test.add(t, test.admins, map[string][]string{
+		"objectClass": {"groupOfNames"},
+		"cn":          {"admins"},
+		"member":      {test.personDN("Ivan Ivanov")},
+	})
+	test.add(t, test.unique, map[string][]string{
+		"objectClass":  {"groupOfUniqueNames"},
+		"cn":           {"unique-admins"},
+		"uniqueMember": {test.personDN("Ivan Ivanov")},
+	})
+
+	test.config = DefaultLDAPConfig
+	test.config.URL = address
+	test.config.BindDN = bindDN
+	test.config.BindPassword = bindPassword
+	test.config.BaseDN = test.people
+	test.config.GroupBaseDN = test.groups
+	// Регистр и пробелы DN группы в настройках не совпадают с каталогом
+	test.config.GroupRoles = map[string][]string{
+		rbac.RoleAdmin: {strings.ToUpper(strings.ReplaceAll(test.admins, ",", ", ")), test.unique},
+	}
+	return test
+}
+
+func (test *ldapTest) personDN(cn string) string {
+	return "cn=" + cn + "," + test.people
+}
+
+func (test *ldapTest) add(t *testing.T, dn string, attributes map[string][]string) {
+	t.Helper()
+	request := ldap.NewAddRequest(dn, nil)
+	for name, values := range attributes {
+		request.Attribute(name, values)
+	}
+	if err := test.conn.Add(request); err != nil {
+		t.Fatalf("add %s: %v", dn, err)
+	}
+}
+
+func (test *ldapTest) addPerson(t *testing.T, cn, uid, mail string) {
+	t.Helper()
+	attributes := map[string][]string{
+		"objectClass":  {"inetOrgPerson"},
+		"cn":           {cn},
+		"sn":           {cn},
+		"uid":          {uid},
+		"userPassword": {ldapTestPassword},
+	}
+	if mail != "" {
+		attributes["mail"] = []string{mail}
+	}
+	test.add(t, test.personDN(cn), attributes)
+}
+
+// setAdmins заменяет участников группы администраторов
+func (test *ldapTest) setAdmins(t *testing.T, members ...string) {
+	t.Helper()
+	request := ldap.NewModifyRequest(test.admins, nil)
+	request.Replace("member", members)
+	if err := test.conn.Modify(request); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// deleteTree удаляет поддерево, начиная с самых глубоких записей
+func (test *ldapTest) deleteTree(t *testing.T) {
+	result, err := test.conn.Search(ldap.NewSearchRequest(test.root, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, 0, false, "(objectClass=*)", []string{"1.1"}, nil))
+	if err != nil {
+		t.Errorf("cleanup %s: %v", test.root, err)
+		return
+	}
+	sort.Slice(result.Entries, func(i, j int) bool {
+		return strings.Count(result.Entries[i].DN, ",") > strings.Count(result.Entries[j].DN, ",")
+	})
+	for _, entry := range result.Entries {
+		if err := test.conn.Del(ldap.NewDelRequest(entry.DN, nil)); err != nil {
+			t.Errorf("cleanup %s: %v", entry.DN, err)
+		}
+	}
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	test := newLDAPTest(t)
+	provider := NewLDAP(test.config)
+
+	identity, err := provider.Authenticate(nil, "ivanov", ldapTestPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Username != "ivanov" || identity.Email != "ivanov@example.com" {
+		t.Errorf("identity = %+v", identity)
+	}
+
+	for name, login := range map[string][2]string{
+		"wrong password": {"ivanov", "wrong"},
+		"unknown user":   {"sidorov", ldapTestPassword},
+		"ambiguous":      {"twin", ldapTestPassword},
+		"filter escape":  {"*", ldapTestPassword},
+	} {
+		if _, err := provider.Authenticate(nil, login[0], login[1]); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%s: err = %v, want %v", name, err, ErrInvalidCredentials)
+		}
+	}
+}
+
+func TestLDAPGroupSearchRoles(t *testing.T) {
+	test := newLDAPTest(t)
+	provider := NewLDAP(test.config)
+
+	for username, want := range map[string][]string{"ivanov": {rbac.RoleAdmin}, "petrov": nil} {
+		identity, err := provider.Authenticate(nil, username, ldapTestPassword)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(identity.Roles, want) {
+			t.Errorf("%s: roles = %v, want %v", username, identity.Roles, want)
+		}
+	}
+}
+
+func TestLDAPMemberOfRoles(t *testing.T) {
+	test := newLDAPTest(t)
+	config := test.config
+	config.GroupBaseDN = ""
+	provider := NewLDAP(config)
+
+	result, err := test.conn.Search(ldap.NewSearchRequest(test.personDN("Ivan Ivanov"), ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", []string{"memberOf"}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Entries) != 1 || len(result.Entries[0].GetAttributeValues("memberOf")) == 0 {
+		t.Skip("каталог не ведет атрибут memberOf")
+	}
+
+	identity, err := provider.Authenticate(nil, "ivanov", ldapTestPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(identity.Roles, []string{rbac.RoleAdmin}) {
+		t.Errorf("roles = %v, want [%s]", identity.Roles, rbac.RoleAdmin)
+	}
+}
+
+func TestLDAPProvision(t *testing.T) {
+	test := newLDAPTest(t)
+	db := testenv.Open(t)
+	Configure(NewLDAP(test.config))
+	t.Cleanup(func() { Configure(nil) })
+	r := httptest.NewRequest("POST", "/", nil)
+
+	// Первый вход создает пользователя каталога с ролями по группам
+	identity, err := Authenticate(nil, "ivanov", ldapTestPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := Provision(db, r, nil, *identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.AuthSource != SourceLDAP || user.Email == nil || *user.Email != "ivanov@example.com" {
+		t.Errorf("provisioned user = %+v", user)
+	}
+	if err := rbac.PreloadRoles(db).First(&user, user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !rbac.Can(user, rbac.PermUserManage) {
+		t.Error("admin group member has no admin permissions")
+	}
+	if IsLocal(user) {
+		t.Error("directory user is local")
+	}
+
+	// Роль, назначенная администратором, сохраняется, роль по группе снимается
+	if err := rbac.SetUserRoles(db, &user, []string{rbac.RoleAdmin, rbac.RoleTechOfficer}); err != nil {
+		t.Fatal(err)
+	}
+	test.setAdmins(t, test.personDN("Petr Petrov"))
+
+	identity, err = Authenticate(&user, "ivanov", ldapTestPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err = Provision(db, r, &user, *identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var roles []string
+	for _, role := range user.Roles {
+		roles = append(roles, role.Name)
+	}
+	if !slices.Equal(roles, []string{rbac.RoleTechOfficer}) {
+		t.Errorf("roles after group removal = %v, want [%s]", roles, rbac.RoleTechOfficer)
+	}
+
+	var count int64
+	if err := db.Model(&models.User{}).Where("username = ?", "ivanov").Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("users named ivanov = %d, want 1", count)
+	}
+}
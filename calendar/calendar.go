@@ -0,0 +1,277 @@
+package calendar
+
+import (
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"itsm/models"
+	"sort"
+	"time"
+)
+
+// DefaultTimezone - часовой пояс службы поддержки
+const DefaultTimezone = "Europe/Moscow"
+
+// maxDays ограничивает поиск рабочего времени, чтобы календарь без рабочих
+// часов не приводил к бесконечному циклу
+const maxDays = 366 * 10
+
+const dateLayout = "2006-01-02"
+
+type interval struct {
+	start, end int // минуты от полуночи
+}
+
+// Schedule - рабочий календарь, подготовленный для расчетов
+type Schedule struct {
+	location *time.Location
+	hours    map[time.Weekday][]interval
+	holidays map[string]bool
+}
+
+// AlwaysOpen - круглосуточный календарь без выходных
+var AlwaysOpen = &Schedule{location: time.UTC}
+
+// New подготавливает календарь из базы к расчетам
+func New(cal models.Calendar) (*Schedule, error) {
+	location, err := time.LoadLocation(cal.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("календарь %q: %w", cal.Name, err)
+	}
+
+	s := &Schedule{
+		location: location,
+		hours:    make(map[time.Weekday][]interval),
+		holidays: make(map[string]bool),
+	}
+
+	for _, wh := range cal.WorkingHours {
+		if wh.Weekday < 0 || wh.Weekday > 6 || wh.StartMinute < 0 || wh.EndMinute > 24*60 ||
+			wh.StartMinute >= wh.EndMinute {
+			return nil, fmt.Errorf("календарь %q: некорректный рабочий интервал %d %d-%d",
+				cal.Name, wh.Weekday, wh.StartMinute, wh.EndMinute)
+		}
+		day := time.Weekday(wh.Weekday)
+		s.hours[day] = append(s.hours[day], interval{wh.StartMinute, wh.EndMinute})
+	}
+	for day := range s.hours {
+		sort.Slice(s.hours[day], func(i, j int) bool { return s.hours[day][i].start < s.hours[day][j].start })
+	}
+
+	for _, holiday := range cal.Holidays {
+		s.holidays[holiday.Date.Format(dateLayout)] = true
+	}
+
+	return s, nil
+}
+
+// Location - часовой пояс календаря
+func (s *Schedule) Location() *time.Location {
+	return s.location
+}
+
+func (s *Schedule) alwaysOpen() bool {
+	return len(s.hours) == 0
+}
+
+// workingIntervals возвращает рабочие интервалы дня, начинающегося в day
+func (s *Schedule) workingIntervals(day time.Time) [][2]time.Time {
+	if s.holidays[day.Format(dateLayout)] {
+		return nil
+	}
+
+	var result [][2]time.Time
+	for _, iv := range s.hours[day.Weekday()] {
+		from := time.Date(day.Year(), day.Month(), day.Day(), 0, iv.start, 0, 0, s.location)
+		to := time.Date(day.Year(), day.Month(), day.Day(), 0, iv.end, 0, 0, s.location)
+		result = append(result, [2]time.Time{from, to})
+	}
+	return result
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// BusinessDuration - рабочее время между двумя моментами
+func (s *Schedule) BusinessDuration(from, to time.Time) time.Duration {
+	if !to.After(from) {
+		return 0
+	}
+	if s.alwaysOpen() {
+		return to.Sub(from)
+	}
+
+	var total time.Duration
+	for day := startOfDay(from.In(s.location)); day.Before(to); day = day.AddDate(0, 0, 1) {
+		for _, iv := range s.workingIntervals(day) {
+			start, end := iv[0], iv[1]
+			if start.Before(from) {
+				start = from
+			}
+			if end.After(to) {
+				end = to
+			}
+			if end.After(start) {
+				total += end.Sub(start)
+			}
+		}
+	}
+	return total
+}
+
+// AddBusinessDuration возвращает момент, когда с start пройдет d рабочего времени
+func (s *Schedule) AddBusinessDuration(start time.Time, d time.Duration) time.Time {
+	if d <= 0 || s.alwaysOpen() {
+		return start.Add(d)
+	}
+
+	remaining := d
+	day := startOfDay(start.In(s.location))
+	for i := 0; i < maxDays; i, day = i+1, day.AddDate(0, 0, 1) {
+		for _, iv := range s.workingIntervals(day) {
+			from, to := iv[0], iv[1]
+			if from.Before(start) {
+				from = start
+			}
+			if !to.After(from) {
+				continue
+			}
+
+			available := to.Sub(from)
+			if remaining <= available {
+				return from.Add(remaining)
+			}
+			remaining -= available
+		}
+	}
+
+	// В календаре нет рабочего времени - считаем по обычному времени
+	return start.Add(d)
+}
+
+// AddBusinessMinutes - срок, наступающий через minutes рабочих минут после start
+func (s *Schedule) AddBusinessMinutes(start time.Time, minutes int) time.Time {
+	return s.AddBusinessDuration(start, time.Duration(minutes)*time.Minute)
+}
+
+// Load загружает календарь по ID вместе с рабочими часами и праздниками
+func Load(db *gorm.DB, id uint) (*Schedule, error) {
+	var cal models.Calendar
+	if err := db.Preload("WorkingHours").Preload("Holidays").First(&cal, id).Error; err != nil {
+		return nil, err
+	}
+	return New(cal)
+}
+
+// LoadAll загружает все календари. Календарь по умолчанию дополнительно
+// возвращается под ключом 0; если его нет, используется круглосуточный
+func LoadAll(db *gorm.DB) (map[uint]*Schedule, error) {
+	var calendars []models.Calendar
+	if err := db.Preload("WorkingHours").Preload("Holidays").Find(&calendars).Error; err != nil {
+		return nil, err
+	}
+
+	schedules := map[uint]*Schedule{0: AlwaysOpen}
+	for _, cal := range calendars {
+		schedule, err := New(cal)
+		if err != nil {
+			return nil, err
+		}
+		schedules[cal.ID] = schedule
+		if cal.IsDefault {
+			schedules[0] = schedule
+		}
+	}
+	return schedules, nil
+}
+
+// russianHolidays - нерабочие праздничные дни (месяц, день)
+var russianHolidays = []struct {
+	month time.Month
+	day   int
+	name  string
+}{
+	{time.January, 1, "Новогодние каникулы"},
+	{time.January, 2, "Новогодние каникулы"},
+	{time.January, 3, "Новогодние каникулы"},
+	{time.January, 4, "Новогодние каникулы"},
+	{time.January, 5, "Новогодние каникулы"},
+	{time.January, 6, "Новогодние каникулы"},
+	{time.January, 7, "Рождество Христово"},
+	{time.January, 8, "Новогодние каникулы"},
+	{time.February, 23, "День защитника Отечества"},
+	{time.March, 8, "Международный женский день"},
+	{time.May, 1, "Праздник Весны и Труда"},
+	{time.May, 9, "День Победы"},
+	{time.June, 12, "День России"},
+	{time.November, 4, "День народного единства"},
+}
+
+// SeedDefault создает календарь по умолчанию (Москва, пн-пт 9:00-18:00,
+// государственные праздники текущего и следующего года), если календарей еще нет.
+// Праздники следующих лет и переносы выходных добавляются в таблицу holidays
+// вручную; о календарях без праздников на текущий год предупреждает WithoutHolidays
+func SeedDefault(db *gorm.DB) error {
+	var count int64
+	if err := db.Model(&models.Calendar{}).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	location, err := time.LoadLocation(DefaultTimezone)
+	if err != nil {
+		return err
+	}
+
+	cal := models.Calendar{Name: "Рабочие часы (Москва)", Timezone: DefaultTimezone, IsDefault: true}
+	for day := time.Monday; day <= time.Friday; day++ {
+		cal.WorkingHours = append(cal.WorkingHours,
+			models.WorkingHours{Weekday: int(day), StartMinute: 9 * 60, EndMinute: 18 * 60})
+	}
+
+	year := time.Now().In(location).Year()
+	for _, y := range []int{year, year + 1} {
+		for _, h := range russianHolidays {
+			cal.Holidays = append(cal.Holidays, models.Holiday{
+				Date: time.Date(y, h.month, h.day, 0, 0, 0, 0, location),
+				Name: h.name,
+			})
+		}
+	}
+
+	return db.Create(&cal).Error
+}
+
+// WithoutHolidays возвращает названия календарей с рабочими часами, в которых
+// нет ни одного праздника в году year. В таких календарях праздники считаются
+// рабочими днями, и сроки SLA получаются короче ожидаемых
+func WithoutHolidays(db *gorm.DB, year int) ([]string, error) {
+	var names []string
+	err := db.Model(&models.Calendar{}).
+		Where("EXISTS (SELECT 1 FROM working_hours WHERE working_hours.calendar_id = calendars.id)").
+		Where("NOT EXISTS (SELECT 1 FROM holidays WHERE holidays.calendar_id = calendars.id AND holidays.date >= ? AND holidays.date < ?)",
+			time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC).Format(dateLayout),
+			time.Date(year+1, time.January, 1, 0, 0, 0, 0, time.UTC).Format(dateLayout)).
+		Order("name").
+		Pluck("name", &names).Error
+	return names, err
+}
+
+// ErrNoDefault - в базе не задан календарь по умолчанию
+var ErrNoDefault = errors.New("календарь по умолчанию не задан")
+
+// LoadDefault загружает календарь по умолчанию
+func LoadDefault(db *gorm.DB) (*Schedule, error) {
+	var cal models.Calendar
+	err := db.Preload("WorkingHours").Preload("Holidays").Where("is_default = ?", true).First(&cal).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNoDefault
+	}
+	if err != nil {
+		return nil, err
+	}
+	return New(cal)
+}
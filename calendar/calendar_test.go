@@ -0,0 +1,136 @@
+package calendar
+
+import (
+	"itsm/models"
+	"testing"
+	"time"
+)
+
+var moscow = mustLocation("Europe/Moscow")
+
+func mustLocation(name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return location
+}
+
+// msk - момент по московскому времени; 4 марта 2024 - понедельник
+func msk(day, hour, minute int) time.Time {
+	return time.Date(2024, time.March, day, hour, minute, 0, 0, moscow)
+}
+
+func utc(day, hour, minute int) time.Time {
+	return time.Date(2024, time.March, day, hour, minute, 0, 0, time.UTC)
+}
+
+// newTestSchedule - пн-пт 9:00-18:00 по Москве, 8 марта - праздник
+func newTestSchedule(t *testing.T) *Schedule {
+	t.Helper()
+	cal := models.Calendar{Name: "test", Timezone: "Europe/Moscow"}
+	for day := time.Monday; day <= time.Friday; day++ {
+		cal.WorkingHours = append(cal.WorkingHours,
+			models.WorkingHours{Weekday: int(day), StartMinute: 9 * 60, EndMinute: 18 * 60})
+	}
+	cal.Holidays = []models.Holiday{{Date: time.Date(2024, time.March, 8, 0, 0, 0, 0, moscow)}}
+	schedule, err := New(cal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return schedule
+}
+
+func TestBusinessDuration(t *testing.T) {
+	schedule := newTestSchedule(t)
+
+	for _, tc := range []struct {
+		name     string
+		from, to time.Time
+		want     time.Duration
+	}{
+		{"within hours", msk(4, 10, 0), msk(4, 12, 30), 2*time.Hour + 30*time.Minute},
+		{"start and end outside hours", msk(4, 7, 0), msk(4, 20, 0), 9 * time.Hour},
+		{"start before hours", msk(4, 7, 0), msk(4, 10, 0), time.Hour},
+		{"end after hours", msk(4, 17, 0), msk(4, 23, 0), time.Hour},
+		{"both after hours", msk(4, 18, 0), msk(4, 23, 0), 0},
+		{"until 18:00", msk(4, 17, 0), msk(4, 18, 0), time.Hour},
+		{"multi-day", msk(4, 17, 0), msk(6, 10, 0), 11 * time.Hour},
+		{"over weekend", msk(1, 17, 0), msk(4, 10, 0), 2 * time.Hour},
+		{"weekend only", msk(2, 10, 0), msk(3, 18, 0), 0},
+		{"over holiday and weekend", msk(7, 17, 0), msk(11, 10, 0), 2 * time.Hour},
+		{"holiday only", msk(8, 9, 0), msk(8, 18, 0), 0},
+		{"reversed", msk(4, 12, 0), msk(4, 10, 0), 0},
+		// Моменты в UTC переводятся в часовой пояс календаря: 6:00-15:00 UTC - 9:00-18:00 по Москве
+		{"utc working day", utc(4, 6, 0), utc(4, 15, 0), 9 * time.Hour},
+		// 22:00 UTC понедельника - уже 1:00 вторника по Москве
+		{"utc date differs", utc(4, 22, 0), utc(5, 7, 0), time.Hour},
+	} {
+		if got := schedule.BusinessDuration(tc.from, tc.to); got != tc.want {
+			t.Errorf("%s: BusinessDuration(%v, %v) = %v, want %v", tc.name, tc.from, tc.to, got, tc.want)
+		}
+	}
+}
+
+func TestAddBusinessDuration(t *testing.T) {
+	schedule := newTestSchedule(t)
+
+	for _, tc := range []struct {
+		name  string
+		start time.Time
+		d     time.Duration
+		want  time.Time
+	}{
+		{"within hours", msk(4, 10, 0), 2 * time.Hour, msk(4, 12, 0)},
+		{"start before hours", msk(4, 7, 0), time.Hour, msk(4, 10, 0)},
+		{"start after hours", msk(4, 19, 0), time.Hour, msk(5, 10, 0)},
+		{"ends at 18:00", msk(4, 17, 0), time.Hour, msk(4, 18, 0)},
+		{"starts at 18:00", msk(4, 18, 0), 30 * time.Minute, msk(5, 9, 30)},
+		{"multi-day", msk(4, 10, 0), 20 * time.Hour, msk(6, 12, 0)},
+		{"over weekend", msk(1, 17, 0), 2 * time.Hour, msk(4, 10, 0)},
+		{"start on weekend", msk(2, 12, 0), time.Hour, msk(4, 10, 0)},
+		{"over holiday and weekend", msk(7, 17, 0), 2 * time.Hour, msk(11, 10, 0)},
+		{"zero", msk(2, 12, 0), 0, msk(2, 12, 0)},
+		{"overdue", msk(4, 10, 0), -time.Hour, msk(4, 9, 0)},
+		{"utc start", utc(4, 5, 0), time.Hour, utc(4, 7, 0)},
+		{"utc start after hours", utc(4, 16, 0), time.Hour, utc(5, 7, 0)},
+	} {
+		if got := schedule.AddBusinessDuration(tc.start, tc.d); !got.Equal(tc.want) {
+			t.Errorf("%s: AddBusinessDuration(%v, %v) = %v, want %v", tc.name, tc.start, tc.d, got, tc.want)
+		}
+	}
+}
+
+func TestAddBusinessMinutes(t *testing.T) {
+	schedule := newTestSchedule(t)
+
+	for _, tc := range []struct {
+		start   time.Time
+		minutes int
+		want    time.Time
+	}{
+		{msk(4, 17, 30), 90, msk(5, 10, 0)},
+		{msk(7, 17, 59), 1, msk(7, 18, 0)},
+		{msk(7, 17, 59), 2, msk(11, 9, 1)},
+		{msk(4, 10, 0), 0, msk(4, 10, 0)},
+	} {
+		got := schedule.AddBusinessMinutes(tc.start, tc.minutes)
+		if !got.Equal(tc.want) {
+			t.Errorf("AddBusinessMinutes(%v, %d) = %v, want %v", tc.start, tc.minutes, got, tc.want)
+		}
+		// Срок и рабочее время до него согласованы
+		if d := schedule.BusinessDuration(tc.start, got); d != time.Duration(tc.minutes)*time.Minute {
+			t.Errorf("BusinessDuration(%v, %v) = %v, want %d minutes", tc.start, got, d, tc.minutes)
+		}
+	}
+}
+
+func TestAlwaysOpen(t *testing.T) {
+	from, to := utc(2, 10, 0), utc(3, 12, 0)
+	if got := AlwaysOpen.BusinessDuration(from, to); got != 26*time.Hour {
+		t.Errorf("BusinessDuration = %v, want 26h", got)
+	}
+	if got := AlwaysOpen.AddBusinessMinutes(from, 26*60); !got.Equal(to) {
+		t.Errorf("AddBusinessMinutes = %v, want %v", got, to)
+	}
+}
@@ -0,0 +1,400 @@
+package filter
+
+import (
+	"fmt"
+	"gorm.io/gorm"
+	"itsm/models"
+	"itsm/utils"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 200
+	dateLayout      = "2006-01-02"
+)
+
+// sortColumns - допустимые варианты сортировки и соответствующие им столбцы
+var sortColumns = map[string]string{
+	"priority": "incidents.priority",
+	"created":  "incidents.created_at",
+	"updated":  "incidents.updated_at",
+	"status":   "incidents.status",
+	"title":    "incidents.title",
+}
+
+const defaultSort = "priority"
+
+// Встроенные очереди инцидентов
+const (
+	QueueMine       = "mine"
+	QueueUnassigned = "unassigned"
+	QueueCreated    = "created"
+)
+
+// Queue - встроенная очередь для вывода в шаблонах
+type Queue struct {
+	Name  string
+	Title string
+}
+
+var Queues = []Queue{
+	{QueueMine, "Назначенные мне"},
+	{QueueUnassigned, "Неназначенные"},
+	{QueueCreated, "Созданные мной"},
+}
+
+// closedStatuses - статусы, инциденты в которых не попадают в рабочие очереди
+var closedStatuses = []string{models.StatusResolved, models.StatusClosed, models.StatusCancelled}
+
+// IncidentFilter - параметры выборки списка инцидентов из строки запроса
+type IncidentFilter struct {
+	Statuses    []string
+	Priorities  []int
+	AssigneeID  *uint
+	Unassigned  bool
+	AuthorID    *uint
+	ServiceID   *uint
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+	UpdatedFrom *time.Time
+	UpdatedTo   *time.Time
+	Search      string
+	Queue       string
+	Sort        string
+	Page        int
+	PageSize    int
+
+	currentUserID uint
+}
+
+// WithUser задает пользователя, для которого вычисляются очереди "мои" и "созданные мной"
+func (f IncidentFilter) WithUser(userID uint) IncidentFilter {
+	f.currentUserID = userID
+	return f
+}
+
+func parseID(value string) (*uint, error) {
+	id, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	result := uint(id)
+	return &result, nil
+}
+
+// parseDate разбирает дату в часовом поясе loc. Для конца периода
+// возвращается начало следующего дня, чтобы включить весь указанный день
+func parseDate(value string, loc *time.Location, endOfDay bool) (*time.Time, error) {
+	date, err := time.ParseInLocation(dateLayout, value, loc)
+	if err != nil {
+		return nil, err
+	}
+	if endOfDay {
+		date = date.AddDate(0, 0, 1)
+	}
+	return &date, nil
+}
+
+// Parse разбирает параметры фильтра. Неизвестные параметры игнорируются,
+// некорректные значения известных параметров возвращают ошибку
+func Parse(values url.Values, loc *time.Location) (IncidentFilter, error) {
+	f := IncidentFilter{Sort: defaultSort, Page: 1, PageSize: DefaultPageSize}
+
+	for _, status := range values["status"] {
+		if status != "" {
+			f.Statuses = append(f.Statuses, status)
+		}
+	}
+
+	for _, value := range values["priority"] {
+		if value == "" {
+			continue
+		}
+		p, err := strconv.Atoi(value)
+		if err != nil || p < 1 || p > 5 {
+			return f, fmt.Errorf("некорректный приоритет %q", value)
+		}
+		f.Priorities = append(f.Priorities, p)
+	}
+
+	var err error
+	if value := values.Get("assignee"); value == "none" {
+		f.Unassigned = true
+	} else if value != "" {
+		if f.AssigneeID, err = parseID(value); err != nil {
+			return f, fmt.Errorf("некорректный ответственный %q", value)
+		}
+	}
+	if value := values.Get("author"); value != "" {
+		if f.AuthorID, err = parseID(value); err != nil {
+			return f, fmt.Errorf("некорректный автор %q", value)
+		}
+	}
+	if value := values.Get("service"); value != "" {
+		if f.ServiceID, err = parseID(value); err != nil {
+			return f, fmt.Errorf("некорректная услуга %q", value)
+		}
+	}
+
+	dates := []struct {
+		param    string
+		target   **time.Time
+		endOfDay bool
+	}{
+		{"created_from", &f.CreatedFrom, false},
+		{"created_to", &f.CreatedTo, true},
+		{"updated_from", &f.UpdatedFrom, false},
+		{"updated_to", &f.UpdatedTo, true},
+	}
+	for _, d := range dates {
+		if value := values.Get(d.param); value != "" {
+			if *d.target, err = parseDate(value, loc, d.endOfDay); err != nil {
+				return f, fmt.Errorf("некорректная дата %s=%q", d.param, value)
+			}
+		}
+	}
+
+	f.Search = strings.TrimSpace(values.Get("q"))
+
+	if value := values.Get("queue"); value != "" {
+		if !isQueue(value) {
+			return f, fmt.Errorf("неизвестная очередь %q", value)
+		}
+		f.Queue = value
+	}
+
+	if value := values.Get("sort"); value != "" {
+		if _, ok := sortColumns[strings.TrimPrefix(value, "-")]; !ok {
+			return f, fmt.Errorf("некорректная сортировка %q", value)
+		}
+		f.Sort = value
+	}
+
+	if value := values.Get("page"); value != "" {
+		if f.Page, err = strconv.Atoi(value); err != nil || f.Page < 1 {
+			return f, fmt.Errorf("некорректный номер страницы %q", value)
+		}
+	}
+	if value := values.Get("page_size"); value != "" {
+		if f.PageSize, err = strconv.Atoi(value); err != nil || f.PageSize < 1 {
+			return f, fmt.Errorf("некорректный размер страницы %q", value)
+		}
+		if f.PageSize > MaxPageSize {
+			f.PageSize = MaxPageSize
+		}
+	}
+
+	return f, nil
+}
+
+func isQueue(name string) bool {
+	for _, q := range Queues {
+		if q.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply добавляет к запросу условия фильтра. Запрос должен выбирать из таблицы incidents
+func (f IncidentFilter) Apply(query *gorm.DB) *gorm.DB {
+	switch f.Queue {
+	case QueueMine:
+		query = query.Where("incidents.responsible_user_id = ? AND incidents.status NOT IN ?",
+			f.currentUserID, closedStatuses)
+	case QueueUnassigned:
+		query = query.Where("incidents.responsible_user_id IS NULL AND incidents.status NOT IN ?", closedStatuses)
+	case QueueCreated:
+		query = query.Where("incidents.user_id = ?", f.currentUserID)
+	}
+
+	if len(f.Statuses) > 0 {
+		query = query.Where("incidents.status IN ?", f.Statuses)
+	}
+	if len(f.Priorities) > 0 {
+		query = query.Where("incidents.priority IN ?", f.Priorities)
+	}
+	if f.Unassigned {
+		query = query.Where("incidents.responsible_user_id IS NULL")
+	} else if f.AssigneeID != nil {
+		query = query.Where("incidents.responsible_user_id = ?", *f.AssigneeID)
+	}
+	if f.AuthorID != nil {
+		query = query.Where("incidents.user_id = ?", *f.AuthorID)
+	}
+	if f.ServiceID != nil {
+		query = query.Where("EXISTS (SELECT 1 FROM incident_services "+
+			"WHERE incident_services.incident_id = incidents.id AND incident_services.service_id = ?)", *f.ServiceID)
+	}
+	if f.CreatedFrom != nil {
+		query = query.Where("incidents.created_at >= ?", *f.CreatedFrom)
+	}
+	if f.CreatedTo != nil {
+		query = query.Where("incidents.created_at < ?", *f.CreatedTo)
+	}
+	if f.UpdatedFrom != nil {
+		query = query.Where("incidents.updated_at >= ?", *f.UpdatedFrom)
+	}
+	if f.UpdatedTo != nil {
+		query = query.Where("incidents.updated_at < ?", *f.UpdatedTo)
+	}
+	if f.Search != "" {
+		pattern := "%" + utils.EscapeLike(f.Search) + "%"
+		query = query.Where("incidents.title LIKE ? OR incidents.description LIKE ?", pattern, pattern)
+	}
+	return query
+}
+
+// Order добавляет сортировку. ID используется как дополнительный ключ,
+// чтобы порядок строк с одинаковыми значениями не менялся между страницами
+func (f IncidentFilter) Order(query *gorm.DB) *gorm.DB {
+	sort := f.Sort
+	if sort == "" {
+		sort = defaultSort
+	}
+
+	direction := "ASC"
+	if strings.HasPrefix(sort, "-") {
+		direction = "DESC"
+		sort = sort[1:]
+	}
+
+	return query.Order(sortColumns[sort] + " " + direction).Order("incidents.id " + direction)
+}
+
+// Paginate ограничивает запрос текущей страницей
+func (f IncidentFilter) Paginate(query *gorm.DB) *gorm.DB {
+	return query.Offset((f.Page - 1) * f.PageSize).Limit(f.PageSize)
+}
+
+// Values возвращает параметры фильтра в виде строки запроса
+func (f IncidentFilter) Values() url.Values {
+	values := url.Values{}
+	for _, status := range f.Statuses {
+		values.Add("status", status)
+	}
+	for _, p := range f.Priorities {
+		values.Add("priority", strconv.Itoa(p))
+	}
+	if f.Unassigned {
+		values.Set("assignee", "none")
+	} else if f.AssigneeID != nil {
+		values.Set("assignee", strconv.FormatUint(uint64(*f.AssigneeID), 10))
+	}
+	if f.AuthorID != nil {
+		values.Set("author", strconv.FormatUint(uint64(*f.AuthorID), 10))
+	}
+	if f.ServiceID != nil {
+		values.Set("service", strconv.FormatUint(uint64(*f.ServiceID), 10))
+	}
+	if f.CreatedFrom != nil {
+		values.Set("created_from", f.CreatedFrom.Format(dateLayout))
+	}
+	if f.CreatedTo != nil {
+		values.Set("created_to", f.CreatedTo.AddDate(0, 0, -1).Format(dateLayout))
+	}
+	if f.UpdatedFrom != nil {
+		values.Set("updated_from", f.UpdatedFrom.Format(dateLayout))
+	}
+	if f.UpdatedTo != nil {
+		values.Set("updated_to", f.UpdatedTo.AddDate(0, 0, -1).Format(dateLayout))
+	}
+	if f.Search != "" {
+		values.Set("q", f.Search)
+	}
+	if f.Queue != "" {
+		values.Set("queue", f.Queue)
+	}
+	if f.Sort != "" && f.Sort != defaultSort {
+		values.Set("sort", f.Sort)
+	}
+	if f.PageSize != DefaultPageSize {
+		values.Set("page_size", strconv.Itoa(f.PageSize))
+	}
+	if f.Page > 1 {
+		values.Set("page", strconv.Itoa(f.Page))
+	}
+	return values
+}
+
+// PageURL - ссылка на страницу page списка с теми же условиями
+func (f IncidentFilter) PageURL(page int) string {
+	f.Page = page
+	return "?" + f.Values().Encode()
+}
+
+// SortURL - ссылка для сортировки по полю; повторный выбор того же поля меняет направление
+func (f IncidentFilter) SortURL(field string) string {
+	if f.Sort == field {
+		f.Sort = "-" + field
+	} else {
+		f.Sort = field
+	}
+	f.Page = 1
+	return "?" + f.Values().Encode()
+}
+
+// SortIndicator - стрелка направления для текущего поля сортировки
+func (f IncidentFilter) SortIndicator(field string) string {
+	switch f.Sort {
+	case field:
+		return "▲"
+	case "-" + field:
+		return "▼"
+	}
+	return ""
+}
+
+// HasStatus и HasPriority используются в шаблонах для отметки выбранных значений
+func (f IncidentFilter) HasStatus(status string) bool {
+	for _, s := range f.Statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func (f IncidentFilter) HasPriority(p int) bool {
+	for _, v := range f.Priorities {
+		if v == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Page - сведения о странице результата для вывода навигации
+type Page struct {
+	Number     int
+	TotalPages int
+	Total      int64
+}
+
+func (p Page) HasPrev() bool { return p.Number > 1 }
+func (p Page) HasNext() bool { return p.Number < p.TotalPages }
+func (p Page) Prev() int     { return p.Number - 1 }
+func (p Page) Next() int     { return p.Number + 1 }
+
+// NewPage вычисляет сведения о странице по общему числу записей
+func NewPage(number, pageSize int, total int64) Page {
+	pages := int((total + int64(pageSize) - 1) / int64(pageSize))
+	if pages == 0 {
+		pages = 1
+	}
+	return Page{Number: number, TotalPages: pages, Total: total}
+}
+
+// NewPage вычисляет сведения о текущей странице выборки
+func (f IncidentFilter) NewPage(total int64) Page {
+	return NewPage(f.Page, f.PageSize, total)
+}
+
+// Param - значение параметра фильтра для заполнения формы в шаблоне
+func (f IncidentFilter) Param(name string) string {
+	return f.Values().Get(name)
+}
@@ -0,0 +1,196 @@
+package listener
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"itsm/session"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Слушатели HTTP. Каждый слушатель принимает запросы на своем адресе, выдает
+// собственную cookie сессии и может обслуживать только часть разделов системы,
+// например отдельный портал для клиентов и консоль для сотрудников
+
+// Разделы системы, которые можно подключить к слушателю. Вход, главная страница
+// и учетная запись подключаются всегда: без них нельзя войти в систему
+// и настроить двухфакторную аутентификацию
+const (
+	ModuleServices  = "services"
+	ModuleIncidents = "incidents"
+	ModuleMessenger = "messenger"
+	ModuleAdmin     = "admin"
+	ModuleAPIDocs   = "openapi"
+)
+
+// Modules - все разделы в порядке подключения
+var Modules = []string{ModuleServices, ModuleIncidents, ModuleMessenger, ModuleAdmin, ModuleAPIDocs}
+
+// TLS - сертификат слушателя. Без сертификата слушатель работает по HTTP,
+// например за обратным прокси, который сам завершает TLS
+type TLS struct {
+	CertFile   string
+	KeyFile    string
+	MinVersion uint16
+}
+
+// Config - настройки слушателя
+type Config struct {
+	Name      string
+	Addr      string // host:port, например :8080
+	Cookie    session.Cookie
+	TLS       TLS
+	Modules   []string // подключаемые разделы
+	PublicURL string   // внешний адрес для ссылок в письмах и входа через провайдера; пусто - общий
+}
+
+// cookieName - допустимые символы имени cookie
+var cookieName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// Validate проверяет настройки одного слушателя
+func (c Config) Validate() error {
+	if c.Name == "" {
+		return errors.New("не указано имя слушателя")
+	}
+	if _, port, err := net.SplitHostPort(c.Addr); err != nil || port == "" {
+		return fmt.Errorf("некорректный адрес %q, нужен host:port", c.Addr)
+	}
+	if !cookieName.MatchString(c.Cookie.Name) {
+		return fmt.Errorf("некорректное имя cookie %q", c.Cookie.Name)
+	}
+	if !strings.HasPrefix(c.Cookie.Path, "/") {
+		return fmt.Errorf("путь cookie %q должен начинаться с /", c.Cookie.Path)
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return errors.New("для TLS нужны и сертификат, и ключ")
+	}
+	for _, module := range c.Modules {
+		if !slices.Contains(Modules, module) {
+			return fmt.Errorf("неизвестный раздел %q, доступны: %s", module, strings.Join(Modules, ", "))
+		}
+	}
+	if c.PublicURL != "" {
+		u, err := url.Parse(c.PublicURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("некорректный внешний адрес %q", c.PublicURL)
+		}
+	}
+	return nil
+}
+
+// ValidateAll проверяет слушателей и их согласованность: у слушателей одного
+// узла должны различаться адреса и cookie, иначе браузер смешает их сессии
+func ValidateAll(configs []Config) error {
+	if len(configs) == 0 {
+		return errors.New("не задан ни один слушатель")
+	}
+	names := map[string]bool{}
+	addrs := map[string]bool{}
+	cookies := map[session.Cookie]string{}
+	for _, c := range configs {
+		if err := c.Validate(); err != nil {
+			return fmt.Errorf("слушатель %s: %w", c.Name, err)
+		}
+		if names[c.Name] {
+			return fmt.Errorf("слушатель %s указан дважды", c.Name)
+		}
+		if addrs[c.Addr] {
+			return fmt.Errorf("адрес %s занят другим слушателем", c.Addr)
+		}
+		// Cookie различаются браузером по имени, домену и пути, но не по порту
+		key := session.Cookie{Name: c.Cookie.Name, Domain: c.Cookie.Domain, Path: c.Cookie.Path}
+		if other, ok := cookies[key]; ok {
+			return fmt.Errorf("слушатели %s и %s используют одну cookie %s", other, c.Name, c.Cookie.Name)
+		}
+		names[c.Name] = true
+		addrs[c.Addr] = true
+		cookies[key] = c.Name
+	}
+	return nil
+}
+
+// DefaultURL - адрес слушателя на этом компьютере, если внешний адрес не задан
+func (c Config) DefaultURL() string {
+	host, port, _ := net.SplitHostPort(c.Addr)
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	scheme := "http"
+	if c.TLS.CertFile != "" {
+		scheme = "https"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
+type contextKey struct{}
+
+var configKey contextKey
+
+// Handler передает обработчику настройки слушателя и его cookie сессии
+// через контекст запроса
+func Handler(c Config, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), configKey, c)
+		ctx = session.WithCookie(ctx, c.Cookie)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// PublicURL возвращает внешний адрес слушателя, принявшего запрос.
+// Пустая строка - слушатель не задал свой адрес
+func PublicURL(r *http.Request) string {
+	c, _ := r.Context().Value(configKey).(Config)
+	return strings.TrimSuffix(c.PublicURL, "/")
+}
+
+// Mounted сообщает, подключен ли раздел module к слушателю, принявшему запрос.
+// Вне слушателя, например в тестах обработчиков, подключены все разделы
+func Mounted(r *http.Request, module string) bool {
+	c, ok := r.Context().Value(configKey).(Config)
+	return !ok || slices.Contains(c.Modules, module)
+}
+
+// Ограничения времени соединения. Без них медленный или зависший клиент
+// удерживал бы соединение сколько угодно. Чтение и запись запроса целиком
+// ограничены с запасом на загрузку и скачивание вложений
+const (
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = 5 * time.Minute
+	writeTimeout      = 5 * time.Minute
+	idleTimeout       = 2 * time.Minute
+)
+
+// Serve принимает запросы слушателя до ошибки
+func Serve(c Config, handler http.Handler) error {
+	server := &http.Server{
+		Addr:              c.Addr,
+		Handler:           Handler(c, handler),
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+	if c.TLS.CertFile == "" {
+		return server.ListenAndServe()
+	}
+	server.TLSConfig = &tls.Config{MinVersion: c.TLS.MinVersion}
+	return server.ListenAndServeTLS(c.TLS.CertFile, c.TLS.KeyFile)
+}
+
+// ParseTLSVersion разбирает минимальную версию TLS: 1.2 или 1.3
+func ParseTLSVersion(value string) (uint16, error) {
+	switch value {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("неподдерживаемая версия TLS %q, допустимы 1.2 и 1.3", value)
+}
@@ -0,0 +1,298 @@
+package loginguard
+
+import (
+	"fmt"
+	"gorm.io/gorm"
+	"hash/fnv"
+	"itsm/audit"
+	"itsm/models"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Защита входа от подбора пароля. Неудачные попытки считаются отдельно
+// по логину и по адресу клиента за скользящее окно. После нескольких бесплатных
+// попыток следующая разрешается только через экспоненциально растущую паузу,
+// а после Policy.LockThreshold неудач по логину учетная запись блокируется
+
+// Результаты попыток входа
+const (
+	ResultSuccess     = "success"
+	ResultInvalid     = "invalid_credentials" // неверный логин или пароль
+	ResultInvalidCode = "invalid_code"        // неверный код второго фактора
+	ResultThrottled   = "throttled"           // отклонена до проверки пароля из-за паузы
+	ResultLocked      = "locked"              // учетная запись заблокирована
+	ResultDeactivated = "deactivated"         // учетная запись отключена
+)
+
+// ResultTitles - названия результатов для вывода в журнале
+var ResultTitles = map[string]string{
+	ResultSuccess:     "Успешный вход",
+	ResultInvalid:     "Неверный логин или пароль",
+	ResultInvalidCode: "Неверный код подтверждения",
+	ResultThrottled:   "Слишком частые попытки",
+	ResultLocked:      "Учетная запись заблокирована",
+	ResultDeactivated: "Учетная запись отключена",
+}
+
+// Policy - параметры ограничения попыток входа
+type Policy struct {
+	Window           time.Duration // за какой период считаются неудачи
+	UserFreeAttempts int           // неудач по логину без паузы
+	IPFreeAttempts   int           // неудач с одного адреса без паузы; 0 - без ограничения по адресу
+	BaseDelay        time.Duration // первая пауза, затем удваивается
+	MaxDelay         time.Duration
+	LockThreshold    int // неудач по логину до блокировки
+	LockDuration     time.Duration
+	Retention        time.Duration // сколько хранить журнал попыток, не меньше Window
+}
+
+// DefaultPolicy - параметры по умолчанию
+var DefaultPolicy = Policy{
+	Window:           15 * time.Minute,
+	UserFreeAttempts: 3,
+	IPFreeAttempts:   10,
+	BaseDelay:        time.Second,
+	MaxDelay:         5 * time.Minute,
+	LockThreshold:    10,
+	LockDuration:     30 * time.Minute,
+	Retention:        90 * 24 * time.Hour,
+}
+
+var policy = DefaultPolicy
+
+// failureResults - результаты, которые считаются неудачными попытками
+var failureResults = []string{ResultInvalid, ResultInvalidCode}
+
+// Configure задает параметры ограничения
+func Configure(p Policy) {
+	policy = p
+}
+
+// userLocks не дают параллельным запросам с одним логином пройти проверку
+// паузы до того, как будет записан результат предыдущей попытки. Логины
+// распределяются по фиксированному числу блокировок, чтобы перебор логинов
+// не увеличивал расход памяти
+var userLocks [256]sync.Mutex
+
+// Guard - проверка одной попытки входа
+type Guard struct {
+	db       *gorm.DB
+	r        *http.Request
+	username string
+	ip       string
+	unlock   func()
+}
+
+// Begin начинает попытку входа. Вызывающий обязан вызвать End
+func Begin(db *gorm.DB, r *http.Request, username string) *Guard {
+	hash := fnv.New32a()
+	hash.Write([]byte(strings.ToLower(username)))
+	mutex := &userLocks[hash.Sum32()%uint32(len(userLocks))]
+	mutex.Lock()
+
+	return &Guard{db: db, r: r, username: username, ip: audit.ClientIP(r), unlock: mutex.Unlock}
+}
+
+// End завершает попытку
+func (g *Guard) End() {
+	g.unlock()
+}
+
+// Denied - отказ во входе до проверки пароля
+type Denied struct {
+	Result  string
+	RetryAt time.Time
+}
+
+func (d *Denied) Error() string {
+	wait := time.Until(d.RetryAt).Round(time.Second)
+	if wait < time.Second {
+		wait = time.Second
+	}
+	if d.Result == ResultLocked {
+		return fmt.Sprintf("Учетная запись временно заблокирована после неудачных попыток входа. "+
+			"Повторите через %s или обратитесь к администратору", formatWait(wait))
+	}
+	return fmt.Sprintf("Слишком много неудачных попыток входа. Повторите через %s", formatWait(wait))
+}
+
+func formatWait(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%d с", int(d.Seconds()))
+	}
+	return fmt.Sprintf("%d мин", int(math.Ceil(d.Minutes())))
+}
+
+// Check проверяет блокировку учетной записи и паузы по логину и адресу.
+// user - найденный по логину пользователь или nil. Отказ записывается в журнал
+func (g *Guard) Check(user *models.User) error {
+	now := time.Now()
+
+	if user != nil && IsLocked(*user) {
+		return g.deny(user, &Denied{Result: ResultLocked, RetryAt: *user.LockedUntil})
+	}
+
+	// Вход и разблокировка сбрасывают счетчик логина, но не адреса: иначе
+	// владелец одной учетной записи мог бы обнулять счетчик своего адреса
+	retryAt, err := g.retryAt(policy.UserFreeAttempts, "username = ? AND cleared = ?", g.username, false)
+	if err != nil {
+		return err
+	}
+	// За прокси без TRUSTED_PROXIES все клиенты приходят с одного адреса,
+	// и ограничение по адресу закрыло бы вход всем; его можно отключить
+	if policy.IPFreeAttempts > 0 {
+		ipRetryAt, err := g.retryAt(policy.IPFreeAttempts, "ip = ?", g.ip)
+		if err != nil {
+			return err
+		}
+		if ipRetryAt.After(retryAt) {
+			retryAt = ipRetryAt
+		}
+	}
+
+	if retryAt.After(now) {
+		return g.deny(user, &Denied{Result: ResultThrottled, RetryAt: retryAt})
+	}
+	return nil
+}
+
+func (g *Guard) deny(user *models.User, denied *Denied) error {
+	if err := g.record(g.db, user, denied.Result); err != nil {
+		return err
+	}
+	return denied
+}
+
+// retryAt возвращает время, раньше которого новая попытка не разрешена
+func (g *Guard) retryAt(freeAttempts int, condition string, args ...interface{}) (time.Time, error) {
+	var failures struct {
+		Count int64
+		Last  *time.Time
+	}
+	err := g.db.Model(&models.LoginAttempt{}).
+		Select("COUNT(*) AS count, MAX(created_at) AS last").
+		Where(condition, args...).
+		Where("result IN ? AND created_at > ?", failureResults, time.Now().Add(-policy.Window)).
+		Scan(&failures).Error
+	if err != nil || failures.Last == nil {
+		return time.Time{}, err
+	}
+	return failures.Last.Add(delay(int(failures.Count), freeAttempts)), nil
+}
+
+// delay - пауза после failures неудач: 0 для первых freeAttempts, затем BaseDelay,
+// удваиваемая с каждой неудачей, но не больше MaxDelay
+func delay(failures, freeAttempts int) time.Duration {
+	extra := failures - freeAttempts
+	if extra <= 0 {
+		return 0
+	}
+	if extra > 30 {
+		return policy.MaxDelay
+	}
+	d := policy.BaseDelay << (extra - 1)
+	if d > policy.MaxDelay || d <= 0 {
+		return policy.MaxDelay
+	}
+	return d
+}
+
+// Failure записывает неудачную попытку и блокирует учетную запись
+// при достижении порога
+func (g *Guard) Failure(user *models.User, result string) error {
+	if err := g.record(g.db, user, result); err != nil {
+		return err
+	}
+	if user == nil || !slices.Contains(failureResults, result) || policy.LockThreshold <= 0 {
+		return nil
+	}
+
+	var failures int64
+	err := g.db.Model(&models.LoginAttempt{}).
+		Where("username = ? AND result IN ? AND cleared = ? AND created_at > ?",
+			g.username, failureResults, false, time.Now().Add(-policy.Window)).
+		Count(&failures).Error
+	if err != nil || failures < int64(policy.LockThreshold) {
+		return err
+	}
+
+	lockedUntil := time.Now().Add(policy.LockDuration)
+	return g.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Update("locked_until", lockedUntil).Error; err != nil {
+			return err
+		}
+		// Неудачи до блокировки больше не учитываются, иначе после нее сразу действует пауза
+		if err := clearFailures(tx, g.username); err != nil {
+			return err
+		}
+		return audit.Record(tx, g.r, audit.Event{
+			Action:   audit.ActionUserLock,
+			TargetID: user.ID,
+			Details:  fmt.Sprintf("%d неудачных попыток входа, до %s", failures, lockedUntil.Format("02.01.2006 15:04")),
+		})
+	})
+}
+
+// Success записывает успешный вход и сбрасывает счетчик неудач по логину
+func (g *Guard) Success(user *models.User) error {
+	return g.db.Transaction(func(tx *gorm.DB) error {
+		if err := clearFailures(tx, g.username); err != nil {
+			return err
+		}
+		return g.record(tx, user, ResultSuccess)
+	})
+}
+
+func (g *Guard) record(db *gorm.DB, user *models.User, result string) error {
+	attempt := models.LoginAttempt{Username: truncate(g.username, 255), IP: g.ip, Result: result}
+	if user != nil {
+		attempt.UserID = &user.ID
+	}
+	return db.Create(&attempt).Error
+}
+
+// Unlock снимает блокировку и сбрасывает счетчик неудач пользователя
+func Unlock(tx *gorm.DB, user *models.User) error {
+	if err := tx.Model(user).Update("locked_until", nil).Error; err != nil {
+		return err
+	}
+	user.LockedUntil = nil
+	return clearFailures(tx, user.Username)
+}
+
+// IsLocked сообщает, заблокирован ли вход пользователя сейчас
+func IsLocked(user models.User) bool {
+	return user.LockedUntil != nil && user.LockedUntil.After(time.Now())
+}
+
+// PurgeExpired периодически удаляет попытки старше срока хранения журнала.
+// Попытки записываются и без входа, поэтому без очистки таблица растет неограниченно
+func PurgeExpired(db *gorm.DB, interval time.Duration) {
+	for {
+		retention := max(policy.Retention, policy.Window)
+		if err := db.Where("created_at < ?", time.Now().Add(-retention)).Delete(&models.LoginAttempt{}).Error; err != nil {
+			log.Println("Ошибка при удалении старых попыток входа:", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// clearFailures исключает прошлые неудачи по логину из подсчета
+func clearFailures(tx *gorm.DB, username string) error {
+	return tx.Model(&models.LoginAttempt{}).
+		Where("username = ? AND cleared = ?", username, false).
+		Update("cleared", true).Error
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
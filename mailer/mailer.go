@@ -0,0 +1,189 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Отправка писем пользователям. Способ доставки выбирается при запуске:
+// SMTP-сервер или локальный приемник, который сохраняет письма в каталог
+// или в память для разработки и проверки
+
+// Способы доставки
+const (
+	TransportSMTP   = "smtp"
+	TransportFile   = "file"
+	TransportMemory = "memory"
+)
+
+// Message - письмо в виде простого текста
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer доставляет письма
+type Mailer interface {
+	Send(msg Message) error
+}
+
+var current Mailer = NewMemorySink()
+
+// Configure задает способ доставки писем
+func Configure(m Mailer) {
+	current = m
+}
+
+// Send отправляет письмо выбранным способом
+func Send(msg Message) error {
+	return current.Send(msg)
+}
+
+// ParseAddress проверяет адрес электронной почты. Принимается только сам
+// адрес, без имени и угловых скобок
+func ParseAddress(address string) (string, error) {
+	address = strings.TrimSpace(address)
+	parsed, err := mail.ParseAddress(address)
+	if err != nil || parsed.Address != address {
+		return "", errors.New("Некорректный адрес электронной почты")
+	}
+	return address, nil
+}
+
+// compose собирает письмо в формате RFC 5322
+func compose(from string, msg Message) ([]byte, error) {
+	var buf bytes.Buffer
+	headers := []struct{ name, value string }{
+		{"From", from},
+		{"To", msg.To},
+		{"Subject", mime.BEncoding.Encode("UTF-8", msg.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", messageID(from)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=UTF-8"},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+	}
+	for _, h := range headers {
+		// Перевод строки в заголовке позволил бы добавить чужие заголовки
+		if strings.ContainsAny(h.value, "\r\n") {
+			return nil, fmt.Errorf("недопустимый перевод строки в заголовке %s", h.name)
+		}
+		fmt.Fprintf(&buf, "%s: %s\r\n", h.name, h.value)
+	}
+	buf.WriteString("\r\n")
+
+	body := quotedprintable.NewWriter(&buf)
+	if _, err := body.Write([]byte(strings.ReplaceAll(msg.Body, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func messageID(from string) string {
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = strings.TrimSuffix(from[at+1:], ">")
+	}
+	return "<" + randomID() + "@" + domain + ">"
+}
+
+func randomID() string {
+	buf := make([]byte, 12)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// SMTP отправляет письма через SMTP-сервер. Если сервер поддерживает
+// STARTTLS, соединение шифруется
+type SMTP struct {
+	Addr     string // host:port
+	Username string // пустой - без аутентификации
+	Password string
+	From     string
+}
+
+func (s *SMTP) Send(msg Message) error {
+	data, err := compose(s.From, msg)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	from, err := mail.ParseAddress(s.From)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(s.Addr, auth, from.Address, []string{msg.To}, data)
+}
+
+// FileSink сохраняет каждое письмо в отдельный файл .eml вместо отправки
+type FileSink struct {
+	Dir  string
+	From string
+}
+
+// NewFileSink создает приемник и каталог для писем
+func NewFileSink(dir, from string) (*FileSink, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	return &FileSink{Dir: dir, From: from}, nil
+}
+
+func (s *FileSink) Send(msg Message) error {
+	data, err := compose(s.From, msg)
+	if err != nil {
+		return err
+	}
+	name := time.Now().Format("20060102-150405") + "-" + randomID() + ".eml"
+	return os.WriteFile(filepath.Join(s.Dir, name), data, 0o640)
+}
+
+// MemorySink хранит отправленные письма в памяти
+type MemorySink struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewMemorySink() *MemorySink {
+	return &MemorySink{}
+}
+
+func (s *MemorySink) Send(msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, msg)
+	return nil
+}
+
+// Messages возвращает копию отправленных писем
+func (s *MemorySink) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.messages...)
+}
@@ -8,32 +8,34 @@ import (
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 	"itsm/api/auth"
-	"itsm/api/dashboard"
 	"itsm/api/incidents"
-	"itsm/api/messenger"
-	"itsm/api/services"
+	"itsm/audit"
+	"itsm/authn"
+	"itsm/calendar"
+	"itsm/listener"
+	"itsm/loginguard"
+	"itsm/mailer"
 	"itsm/models"
-	_ "itsm/session"
+	"itsm/password"
+	"itsm/priority"
+	"itsm/rbac"
+	"itsm/router"
+	"itsm/session"
+	"itsm/sla"
+	"itsm/sso"
+	"itsm/storage"
+	"itsm/twofactor"
 	"log"
-	"net/http"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
-func startServer(port string, db *gorm.DB) {
-	r := mux.NewRouter()
-	auth.SetupRoutes(r, db)
-	dashboard.SetupRoutes(r, db)
-	services.SetupRoutes(r, db)
-	incidents.SetupRoutes(r, db)
-	messenger.SetupRoutes(r, db)
-
-	fs := http.FileServer(http.Dir("./templates"))
-	r.PathPrefix("/templates/").Handler(http.StripPrefix("/templates/", fs))
-
-	log.Printf("Сервер запущен на :%s\n", port)
-	if err := http.ListenAndServe(":"+port, r); err != nil {
+func startServer(config listener.Config, r *mux.Router) {
+	log.Printf("Сервер %s запущен на %s\n", config.Name, config.Addr)
+	if err := listener.Serve(config, r); err != nil {
 		log.Fatal("Ошибка при запуске сервера:", err)
 	}
 }
@@ -42,9 +44,7 @@ func checkEnvVariables() {
 	requiredEnvVars := []string{"DB_USER",
 		"DB_HOST",
 		"DB_NAME",
-		"PORT1",
-		"PORT2",
-		"USE_2_SERVERS"}
+		"SESSION_KEYS"}
 
 	for _, envVar := range requiredEnvVars {
 		value, exists := os.LookupEnv(envVar)
@@ -58,16 +58,418 @@ func getEnv(name string) string {
 	return os.Getenv(name)
 }
 
-func startGoroutines(db *gorm.DB) {
-	go startServer(getEnv("PORT1"), db)
+func getEnvOrDefault(name, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func loadPriorityMatrix() {
+	value, exists := os.LookupEnv("PRIORITY_MATRIX")
+	if !exists || value == "" {
+		return
+	}
 
-	use2servers, err := strconv.ParseBool(getEnv("USE_2_SERVERS"))
+	matrix, err := priority.Parse(value)
 	if err != nil {
-		log.Fatalf("Error converting .env var USE_2_SERVERS to boolean: %v", err)
+		log.Fatalf("Error parsing .env var PRIORITY_MATRIX: %v", err)
+	}
+	priority.Set(matrix)
+}
+
+func configureAttachments() {
+	store, err := storage.NewLocal(getEnvOrDefault("ATTACHMENTS_DIR", "./uploads"))
+	if err != nil {
+		log.Fatalf("Error creating attachments storage: %v", err)
+	}
+
+	maxSizeMB, err := strconv.ParseInt(getEnvOrDefault("ATTACHMENT_MAX_SIZE_MB", "10"), 10, 64)
+	if err != nil {
+		log.Fatalf("Error converting .env var ATTACHMENT_MAX_SIZE_MB to integer: %v", err)
+	}
+
+	incidents.ConfigureAttachments(store, maxSizeMB<<20)
+}
+
+func configureSessions(db *gorm.DB) {
+	keys, err := session.ParseKeys(getEnv("SESSION_KEYS"))
+	if err != nil {
+		log.Fatalf("Error parsing .env var SESSION_KEYS: %v", err)
+	}
+
+	maxAgeHours, err := strconv.Atoi(getEnvOrDefault("SESSION_MAX_AGE_HOURS", "720"))
+	if err != nil || maxAgeHours <= 0 {
+		log.Fatalf("Error converting .env var SESSION_MAX_AGE_HOURS to positive integer: %v", err)
+	}
+
+	err = session.Configure(db, session.Config{
+		Keys:    keys,
+		Backend: getEnvOrDefault("SESSION_STORE", session.BackendDB),
+		MaxAge:  maxAgeHours * 3600,
+		Secure:  sessionCookieSecure(),
+	})
+	if err != nil {
+		log.Fatalf("Error configuring sessions: %v", err)
+	}
+}
+
+// sessionCookieSecure - флаг Secure cookie сессии для слушателей без TLS
+func sessionCookieSecure() bool {
+	secure, err := strconv.ParseBool(getEnvOrDefault("SESSION_COOKIE_SECURE", "false"))
+	if err != nil {
+		log.Fatalf("Error converting .env var SESSION_COOKIE_SECURE to boolean: %v", err)
+	}
+	return secure
+}
+
+// configureListeners читает слушателей из списка LISTENERS. Параметры слушателя
+// name задаются переменными LISTENER_<NAME>_*. Без LISTENERS используются прежние
+// PORT1, PORT2 и USE_2_SERVERS с прежними именами cookie, чтобы сессии сохранились
+func configureListeners() []listener.Config {
+	var configs []listener.Config
+	if getEnv("LISTENERS") == "" {
+		configs = legacyListeners()
+	}
+	for _, name := range strings.Split(getEnv("LISTENERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "LISTENER_" + strings.ToUpper(name) + "_"
+
+		config := listener.Config{
+			Name:      name,
+			Addr:      getEnv(prefix + "ADDR"),
+			Modules:   listener.Modules,
+			PublicURL: getEnv(prefix + "PUBLIC_URL"),
+			TLS: listener.TLS{
+				CertFile: getEnv(prefix + "TLS_CERT"),
+				KeyFile:  getEnv(prefix + "TLS_KEY"),
+			},
+		}
+		if modules := getEnv(prefix + "MODULES"); modules != "" {
+			config.Modules = nil
+			for _, module := range strings.Split(modules, ",") {
+				if module = strings.TrimSpace(module); module != "" {
+					config.Modules = append(config.Modules, module)
+				}
+			}
+		}
+
+		minVersion, err := listener.ParseTLSVersion(getEnvOrDefault(prefix+"TLS_MIN_VERSION", "1.2"))
+		if err != nil {
+			log.Fatalf("Error in .env var %sTLS_MIN_VERSION: %v", prefix, err)
+		}
+		config.TLS.MinVersion = minVersion
+
+		// Cookie слушателя с TLS по умолчанию передается только по HTTPS
+		defaultSecure := config.TLS.CertFile != "" || sessionCookieSecure()
+		secure, err := strconv.ParseBool(getEnvOrDefault(prefix+"COOKIE_SECURE", strconv.FormatBool(defaultSecure)))
+		if err != nil {
+			log.Fatalf("Error converting .env var %sCOOKIE_SECURE to boolean: %v", prefix, err)
+		}
+		config.Cookie = session.Cookie{
+			Name:   getEnvOrDefault(prefix+"COOKIE_NAME", "session-"+name),
+			Domain: getEnv(prefix + "COOKIE_DOMAIN"),
+			Path:   getEnvOrDefault(prefix+"COOKIE_PATH", "/"),
+			Secure: secure,
+		}
+		configs = append(configs, config)
+	}
+
+	if err := listener.ValidateAll(configs); err != nil {
+		log.Fatalf("Error in listener settings: %v", err)
 	}
+	return configs
+}
 
+// legacyListeners - слушатели по прежним переменным PORT1, PORT2 и USE_2_SERVERS
+func legacyListeners() []listener.Config {
+	ports := []string{getEnv("PORT1")}
+	if getEnv("PORT1") == "" {
+		log.Fatal("Error: Environment variable LISTENERS or PORT1 is required but not set or empty.")
+	}
+
+	use2servers, err := strconv.ParseBool(getEnvOrDefault("USE_2_SERVERS", "false"))
+	if err != nil {
+		log.Fatalf("Error converting .env var USE_2_SERVERS to boolean: %v", err)
+	}
 	if use2servers {
-		go startServer(getEnv("PORT2"), db)
+		ports = append(ports, getEnv("PORT2"))
+	}
+
+	log.Println("PORT1, PORT2 and USE_2_SERVERS are deprecated, use LISTENERS")
+	var configs []listener.Config
+	for i, port := range ports {
+		configs = append(configs, listener.Config{
+			Name:    "port" + strconv.Itoa(i+1),
+			Addr:    ":" + port,
+			Modules: listener.Modules,
+			Cookie:  session.Cookie{Name: "session-" + port, Path: "/", Secure: sessionCookieSecure()},
+		})
+	}
+	return configs
+}
+
+func configurePasswordPolicy() {
+	policy := password.DefaultPolicy
+
+	minLength, err := strconv.Atoi(getEnvOrDefault("PASSWORD_MIN_LENGTH", strconv.Itoa(policy.MinLength)))
+	if err != nil || minLength < 1 {
+		log.Fatalf("Error converting .env var PASSWORD_MIN_LENGTH to positive integer: %v", err)
+	}
+	policy.MinLength = minLength
+
+	minClasses, err := strconv.Atoi(getEnvOrDefault("PASSWORD_MIN_CLASSES", strconv.Itoa(policy.MinClasses)))
+	if err != nil || minClasses < 0 || minClasses > 4 {
+		log.Fatalf("Error converting .env var PASSWORD_MIN_CLASSES to integer from 0 to 4: %v", err)
+	}
+	policy.MinClasses = minClasses
+
+	password.Configure(policy)
+
+	if path := getEnv("PASSWORD_DENY_LIST"); path != "" {
+		if err := password.LoadDenyList(path); err != nil {
+			log.Fatalf("Error loading password deny list: %v", err)
+		}
+	}
+}
+
+// configureMail настраивает доставку писем. По умолчанию письма отправляются
+// через SMTP; сохранение в каталог или в память включается явно для разработки,
+// иначе ссылки восстановления пароля молча оседали бы на диске сервера
+func configureMail(baseURL string) {
+	from := getEnvOrDefault("MAIL_FROM", "noreply@localhost")
+
+	switch transport := getEnvOrDefault("MAIL_TRANSPORT", mailer.TransportSMTP); transport {
+	case mailer.TransportSMTP:
+		if getEnv("SMTP_ADDR") == "" {
+			log.Fatal("Error: Environment variable SMTP_ADDR is required for MAIL_TRANSPORT=smtp (the default). " +
+				"Set MAIL_TRANSPORT=file or MAIL_TRANSPORT=memory to keep mail locally during development.")
+		}
+		mailer.Configure(&mailer.SMTP{
+			Addr:     getEnv("SMTP_ADDR"),
+			Username: getEnv("SMTP_USERNAME"),
+			Password: getEnv("SMTP_PASSWORD"),
+			From:     from,
+		})
+	case mailer.TransportFile:
+		sink, err := mailer.NewFileSink(getEnvOrDefault("MAIL_DIR", "./mail"), from)
+		if err != nil {
+			log.Fatalf("Error creating mail directory: %v", err)
+		}
+		mailer.Configure(sink)
+	case mailer.TransportMemory:
+		mailer.Configure(mailer.NewMemorySink())
+	default:
+		log.Fatalf("Error in .env var MAIL_TRANSPORT: unknown transport %q", transport)
+	}
+
+	ttl, err := strconv.Atoi(getEnvOrDefault("PASSWORD_RESET_TTL_MINUTES", "60"))
+	if err != nil || ttl <= 0 {
+		log.Fatalf("Error converting .env var PASSWORD_RESET_TTL_MINUTES to positive integer: %v", err)
+	}
+	auth.ConfigurePasswordReset(baseURL, time.Duration(ttl)*time.Minute)
+}
+
+// publicURL - внешний адрес системы для ссылок в письмах и адресов возврата от провайдеров,
+// если слушатель не задал свой. По умолчанию - адрес первого слушателя
+func publicURL(first listener.Config) string {
+	return strings.TrimSuffix(getEnvOrDefault("PUBLIC_URL", first.DefaultURL()), "/")
+}
+
+// configureDirectory подключает вход через каталог LDAP, если указан LDAP_URL
+func configureDirectory() {
+	address := getEnv("LDAP_URL")
+	if address == "" {
+		return
+	}
+
+	config := authn.DefaultLDAPConfig
+	config.URL = address
+	config.BindDN = getEnv("LDAP_BIND_DN")
+	config.BindPassword = getEnv("LDAP_BIND_PASSWORD")
+	config.BaseDN = getEnv("LDAP_BASE_DN")
+	config.UserFilter = getEnvOrDefault("LDAP_USER_FILTER", config.UserFilter)
+	config.EmailAttribute = getEnvOrDefault("LDAP_EMAIL_ATTRIBUTE", config.EmailAttribute)
+	config.GroupBaseDN = getEnv("LDAP_GROUP_BASE_DN")
+	config.GroupFilter = getEnvOrDefault("LDAP_GROUP_FILTER", config.GroupFilter)
+
+	startTLS, err := strconv.ParseBool(getEnvOrDefault("LDAP_START_TLS", "false"))
+	if err != nil {
+		log.Fatalf("Error converting .env var LDAP_START_TLS to boolean: %v", err)
+	}
+	config.StartTLS = startTLS
+
+	// DN групп содержат запятые, поэтому группы разделяются точкой с запятой
+	config.GroupRoles = map[string][]string{}
+	for role, envVar := range map[string]string{
+		rbac.RoleAdmin:          "LDAP_ADMIN_GROUPS",
+		rbac.RoleTechOfficer:    "LDAP_TECH_OFFICER_GROUPS",
+		rbac.RoleDefaultOfficer: "LDAP_DEFAULT_OFFICER_GROUPS",
+	} {
+		for _, group := range strings.Split(getEnv(envVar), ";") {
+			if group = strings.TrimSpace(group); group != "" {
+				config.GroupRoles[role] = append(config.GroupRoles[role], group)
+			}
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Error in LDAP settings: %v", err)
+	}
+	authn.Configure(authn.NewLDAP(config))
+}
+
+// configureSSO подключает провайдеров единого входа из списка SSO_PROVIDERS.
+// Параметры провайдера name задаются переменными SSO_<NAME>_*
+func configureSSO(baseURL string) {
+	var configs []sso.Config
+	for _, name := range strings.Split(getEnv("SSO_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "SSO_" + strings.ToUpper(name) + "_"
+
+		config := sso.DefaultConfig
+		config.Name = name
+		config.Title = getEnvOrDefault(prefix+"TITLE", name)
+		config.Issuer = getEnv(prefix + "ISSUER")
+		config.ClientID = getEnv(prefix + "CLIENT_ID")
+		config.ClientSecret = getEnv(prefix + "CLIENT_SECRET")
+		config.RedirectURL = baseURL + "/login/sso/" + name + "/callback"
+		if scopes := getEnv(prefix + "SCOPES"); scopes != "" {
+			config.Scopes = strings.Fields(scopes)
+		}
+		config.UsernameClaim = getEnvOrDefault(prefix+"USERNAME_CLAIM", config.UsernameClaim)
+		config.EmailClaim = getEnvOrDefault(prefix+"EMAIL_CLAIM", config.EmailClaim)
+		config.RolesClaim = getEnv(prefix + "ROLES_CLAIM")
+
+		linkByEmail, err := strconv.ParseBool(getEnvOrDefault(prefix+"LINK_BY_EMAIL", "false"))
+		if err != nil {
+			log.Fatalf("Error converting .env var %sLINK_BY_EMAIL to boolean: %v", prefix, err)
+		}
+		config.LinkByEmail = linkByEmail
+
+		config.ClaimRoles = map[string][]string{}
+		for role, suffix := range map[string]string{
+			rbac.RoleAdmin:          "ADMIN_VALUES",
+			rbac.RoleTechOfficer:    "TECH_OFFICER_VALUES",
+			rbac.RoleDefaultOfficer: "DEFAULT_OFFICER_VALUES",
+		} {
+			for _, value := range strings.Split(getEnv(prefix+suffix), ",") {
+				if value = strings.TrimSpace(value); value != "" {
+					config.ClaimRoles[role] = append(config.ClaimRoles[role], value)
+				}
+			}
+		}
+
+		if err := config.Validate(); err != nil {
+			log.Fatalf("Error in SSO provider %s settings: %v", name, err)
+		}
+		configs = append(configs, config)
+	}
+	sso.Configure(configs...)
+}
+
+// configureLoginGuard настраивает ограничение попыток входа. Неудачи считаются
+// и по адресу клиента, поэтому за обратным прокси его адреса нужно указать
+// в TRUSTED_PROXIES (адреса или сети CIDR через запятую): тогда адрес клиента
+// берется из X-Forwarded-For. Иначе все клиенты получают адрес прокси, и подбор
+// с одного адреса блокирует вход всем; LOGIN_IP_FREE_ATTEMPTS=0 отключает
+// ограничение по адресу, ограничение по логину продолжает действовать
+func configureLoginGuard() {
+	var proxies []string
+	for _, proxy := range strings.Split(getEnv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	if err := audit.ConfigureTrustedProxies(proxies); err != nil {
+		log.Fatalf("Error in .env var TRUSTED_PROXIES: %v", err)
+	}
+
+	policy := loginguard.DefaultPolicy
+
+	ipAttempts, err := strconv.Atoi(getEnvOrDefault("LOGIN_IP_FREE_ATTEMPTS", strconv.Itoa(policy.IPFreeAttempts)))
+	if err != nil || ipAttempts < 0 {
+		log.Fatalf("Error converting .env var LOGIN_IP_FREE_ATTEMPTS to non-negative integer: %v", err)
+	}
+	policy.IPFreeAttempts = ipAttempts
+
+	threshold, err := strconv.Atoi(getEnvOrDefault("LOGIN_LOCKOUT_THRESHOLD", strconv.Itoa(policy.LockThreshold)))
+	if err != nil {
+		log.Fatalf("Error converting .env var LOGIN_LOCKOUT_THRESHOLD to integer: %v", err)
+	}
+	policy.LockThreshold = threshold
+
+	minutes, err := strconv.Atoi(getEnvOrDefault("LOGIN_LOCKOUT_MINUTES", strconv.Itoa(int(policy.LockDuration.Minutes()))))
+	if err != nil || minutes <= 0 {
+		log.Fatalf("Error converting .env var LOGIN_LOCKOUT_MINUTES to positive integer: %v", err)
+	}
+	policy.LockDuration = time.Duration(minutes) * time.Minute
+
+	days, err := strconv.Atoi(getEnvOrDefault("LOGIN_ATTEMPTS_RETENTION_DAYS", strconv.Itoa(int(policy.Retention.Hours()/24))))
+	if err != nil || days <= 0 {
+		log.Fatalf("Error converting .env var LOGIN_ATTEMPTS_RETENTION_DAYS to positive integer: %v", err)
+	}
+	policy.Retention = time.Duration(days) * 24 * time.Hour
+
+	loginguard.Configure(policy)
+}
+
+// configureTwoFactor читает роли, для которых двухфакторная аутентификация обязательна
+func configureTwoFactor(db *gorm.DB) {
+	var roles []string
+	for _, name := range strings.Split(getEnv("TOTP_REQUIRED_ROLES"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			roles = append(roles, name)
+		}
+	}
+
+	if len(roles) > 0 {
+		var count int64
+		if err := db.Model(&models.Role{}).Where("name IN ?", roles).Count(&count).Error; err != nil {
+			log.Fatal(err)
+		}
+		if count != int64(len(roles)) {
+			log.Fatalf("Error in .env var TOTP_REQUIRED_ROLES: unknown role in %q", roles)
+		}
+	}
+
+	twofactor.Configure(roles)
+}
+
+// warnMissingHolidays предупреждает о календарях, в которых не заведены
+// праздники текущего года
+func warnMissingHolidays(db *gorm.DB) {
+	year := time.Now().Year()
+	names, err := calendar.WithoutHolidays(db, year)
+	if err != nil {
+		log.Println("Не удалось проверить праздники календарей:", err)
+		return
+	}
+	for _, name := range names {
+		log.Printf("Внимание: в календаре %q нет праздников на %d год, сроки SLA считаются без них", name, year)
+	}
+}
+
+func startGoroutines(db *gorm.DB, listeners []listener.Config) {
+	if session.Revocable() {
+		go session.PurgeExpired(db, time.Hour)
+	}
+	go loginguard.PurgeExpired(db, time.Hour)
+
+	// Маршрутизаторы собираются до запуска серверов: запросы первого слушателя
+	// не должны обслуживаться, пока регистрируются маршруты следующих
+	routers := make([]*mux.Router, len(listeners))
+	for i, config := range listeners {
+		routers[i] = router.New(db, config.Modules)
+	}
+	for i, config := range listeners {
+		go startServer(config, routers[i])
 	}
 
 	select {}
@@ -80,12 +482,21 @@ func main() {
 	}
 
 	checkEnvVariables()
+	listeners := configureListeners()
+	baseURL := publicURL(listeners[0])
+	loadPriorityMatrix()
+	configureAttachments()
+	configureLoginGuard()
+	configurePasswordPolicy()
+	configureMail(baseURL)
+	configureDirectory()
+	configureSSO(baseURL)
 
 	dbUser := getEnv("DB_USER")
 	dbPass := getEnv("DB_PASS")
 	dbHost := getEnv("DB_HOST")
 	dbName := getEnv("DB_NAME")
-	loc := url.QueryEscape("Europe/Moscow")
+	loc := url.QueryEscape(getEnvOrDefault("DB_TIMEZONE", calendar.DefaultTimezone))
 
 	dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s?parseTime=true&loc=%s", dbUser, dbPass, dbHost, dbName, loc)
 	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
@@ -93,11 +504,35 @@ func main() {
 		log.Fatal(err)
 	}
 
-	err = db.AutoMigrate(&models.User{}, &models.Service{}, &models.Message{},
-		&models.Dialog{}, &models.Incident{})
+	err = db.AutoMigrate(models.All()...)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	startGoroutines(db)
+	configureSessions(db)
+
+	if err := rbac.Seed(db); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := rbac.MigrateLegacyFlags(db); err != nil {
+		log.Fatal(err)
+	}
+
+	configureTwoFactor(db)
+
+	if err := incidents.MigrateLegacyStatuses(db); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := calendar.SeedDefault(db); err != nil {
+		log.Fatal(err)
+	}
+	warnMissingHolidays(db)
+
+	if err := sla.SeedDefaultPolicies(db); err != nil {
+		log.Fatal(err)
+	}
+
+	startGoroutines(db, listeners)
 }
@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"github.com/gorilla/mux"
+	"itsm/session"
+	"itsm/utils"
+	"mime"
+	"net/http"
+)
+
+// Защита от CSRF по схеме double submit cookie: браузер получает случайный
+// токен в cookie, а запросы, изменяющие данные, должны повторить его в заголовке
+// X-CSRF-Token или в поле формы csrf_token. Чужой сайт может заставить браузер
+// отправить cookie, но не может ее прочитать. Токен в формы и запросы fetch
+// подставляет скрипт /templates/csrf/csrf.js
+
+const (
+	CSRFCookieName = "csrf_token"
+	CSRFHeaderName = "X-CSRF-Token"
+	CSRFFieldName  = "csrf_token"
+)
+
+// Длина токена в байтах
+const csrfTokenLength = 32
+
+// CSRF выдает токен и отклоняет изменяющие запросы без него с кодом 403.
+// Запросы с API-токеном не проверяются: браузер не подставляет заголовок
+// Authorization сам, поэтому чужой сайт не может отправить такой запрос.
+// Должен подключаться после Authenticate
+func CSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := CurrentToken(r); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := csrfCookie(r)
+		if token == "" {
+			var err error
+			if token, err = newCSRFToken(); err != nil {
+				http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+				return
+			}
+			// Домен, путь и Secure - как у cookie сессии слушателя: токен
+			// должен приходить вместе с сессией, которую он защищает
+			sessionCookie := session.CurrentCookie(r)
+			http.SetCookie(w, &http.Cookie{
+				Name:     CSRFCookieName,
+				Value:    token,
+				Domain:   sessionCookie.Domain,
+				Path:     sessionCookie.Path,
+				Secure:   sessionCookie.Secure || r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+
+		if isSafeMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !validCSRFToken(token, requestCSRFToken(r)) {
+			message := "Недействительный CSRF-токен. Обновите страницу и повторите действие"
+			if isJSONRoute(mux.CurrentRoute(r)) {
+				utils.SendJSONError(w, http.StatusForbidden, message)
+			} else {
+				http.Error(w, message, http.StatusForbidden)
+			}
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+func csrfCookie(r *http.Request) string {
+	cookie, err := r.Cookie(CSRFCookieName)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// requestCSRFToken находит токен в заголовке или в форме. Тело multipart-формы
+// не разбирается, чтобы не обходить ограничения размера вложений, - для таких
+// форм скрипт передает токен в строке запроса
+func requestCSRFToken(r *http.Request) string {
+	if token := r.Header.Get(CSRFHeaderName); token != "" {
+		return token
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		return r.PostFormValue(CSRFFieldName)
+	case "multipart/form-data":
+		return r.URL.Query().Get(CSRFFieldName)
+	}
+	return ""
+}
+
+func validCSRFToken(expected, actual string) bool {
+	return expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) == 1
+}
+
+func newCSRFToken() (string, error) {
+	buf := make([]byte, csrfTokenLength)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,210 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"itsm/session"
+	"itsm/testenv"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const testCSRFToken = "test-csrf-token"
+
+// newCSRFRouter - маршрутизатор с HTML- и JSON-обработчиком, защищенными от CSRF
+func newCSRFRouter(t *testing.T) (*mux.Router, string) {
+	db := testenv.Open(t)
+	user := testenv.User(t, db, "user")
+
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }
+	r := mux.NewRouter()
+	r.Use(Authenticate(db))
+	r.Use(CSRF)
+	Public(r.HandleFunc("/form", ok).Methods("GET", "POST"))
+	Public(r.HandleFunc("/api/v1/public", ok).Methods("POST"))
+	r.HandleFunc("/api/v1/items", ok).Methods("POST")
+	return r, testenv.Token(t, db, user)
+}
+
+func serve(r *mux.Router, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+// withCookie добавляет cookie с CSRF-токеном, выданную браузеру ранее
+func withCookie(req *http.Request) *http.Request {
+	req.AddCookie(&http.Cookie{Name: CSRFCookieName, Value: testCSRFToken})
+	return req
+}
+
+func TestCSRFIssuesCookie(t *testing.T) {
+	r, _ := newCSRFRouter(t)
+
+	rec := serve(r, httptest.NewRequest("GET", "/form", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("GET: код ответа %d", rec.Code)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != CSRFCookieName || cookies[0].Value == "" {
+		t.Fatalf("не выдана cookie с токеном: %v", cookies)
+	}
+	if cookies[0].Path != "/" || cookies[0].Secure {
+		t.Errorf("cookie вне слушателя: путь %q, Secure %v", cookies[0].Path, cookies[0].Secure)
+	}
+
+	// Выданная cookie не заменяется
+	rec = serve(r, withCookie(httptest.NewRequest("GET", "/form", nil)))
+	if len(rec.Result().Cookies()) != 0 {
+		t.Errorf("cookie выдана повторно: %v", rec.Result().Cookies())
+	}
+}
+
+func TestCSRFListenerCookie(t *testing.T) {
+	r, _ := newCSRFRouter(t)
+
+	listenerCookie := session.Cookie{Name: "portal_session", Domain: "portal.example.com", Path: "/portal", Secure: true}
+	req := httptest.NewRequest("GET", "/form", nil)
+	rec := serve(r, req.WithContext(session.WithCookie(req.Context(), listenerCookie)))
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("не выдана cookie с токеном: %v", cookies)
+	}
+	if cookie := cookies[0]; cookie.Domain != listenerCookie.Domain || cookie.Path != listenerCookie.Path || !cookie.Secure {
+		t.Errorf("cookie %v, ожидались домен, путь и Secure cookie сессии %+v", cookie, listenerCookie)
+	}
+}
+
+func TestCSRFHeader(t *testing.T) {
+	r, _ := newCSRFRouter(t)
+
+	for _, tc := range []struct {
+		name   string
+		cookie bool
+		header string
+		code   int
+	}{
+		{"valid", true, testCSRFToken, http.StatusNoContent},
+		{"missing", true, "", http.StatusForbidden},
+		{"mismatched", true, "other-token", http.StatusForbidden},
+		{"no cookie", false, testCSRFToken, http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/form", nil)
+			if tc.cookie {
+				withCookie(req)
+			}
+			if tc.header != "" {
+				req.Header.Set(CSRFHeaderName, tc.header)
+			}
+			if rec := serve(r, req); rec.Code != tc.code {
+				t.Errorf("код ответа %d, ожидался %d", rec.Code, tc.code)
+			}
+		})
+	}
+}
+
+func TestCSRFFormField(t *testing.T) {
+	r, _ := newCSRFRouter(t)
+
+	for _, tc := range []struct {
+		name  string
+		field string
+		code  int
+	}{
+		{"valid", testCSRFToken, http.StatusNoContent},
+		{"missing", "", http.StatusForbidden},
+		{"mismatched", "other-token", http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			form := url.Values{"title": {"x"}}
+			if tc.field != "" {
+				form.Set(CSRFFieldName, tc.field)
+			}
+			req := withCookie(httptest.NewRequest("POST", "/form", strings.NewReader(form.Encode())))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if rec := serve(r, req); rec.Code != tc.code {
+				t.Errorf("код ответа %d, ожидался %d", rec.Code, tc.code)
+			}
+		})
+	}
+}
+
+func TestCSRFMultipartQuery(t *testing.T) {
+	r, _ := newCSRFRouter(t)
+
+	for _, tc := range []struct {
+		name  string
+		query string
+		body  string // токен в теле формы не принимается
+		code  int
+	}{
+		{"valid", testCSRFToken, "", http.StatusNoContent},
+		{"missing", "", "", http.StatusForbidden},
+		{"mismatched", "other-token", "", http.StatusForbidden},
+		{"in body", "", testCSRFToken, http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var body bytes.Buffer
+			writer := multipart.NewWriter(&body)
+			if tc.body != "" {
+				writer.WriteField(CSRFFieldName, tc.body)
+			}
+			writer.Close()
+
+			target := "/form"
+			if tc.query != "" {
+				target += "?" + url.Values{CSRFFieldName: {tc.query}}.Encode()
+			}
+			req := withCookie(httptest.NewRequest("POST", target, &body))
+			req.Header.Set("Content-Type", writer.FormDataContentType())
+			if rec := serve(r, req); rec.Code != tc.code {
+				t.Errorf("код ответа %d, ожидался %d", rec.Code, tc.code)
+			}
+		})
+	}
+}
+
+func TestCSRFErrorFormat(t *testing.T) {
+	r, _ := newCSRFRouter(t)
+
+	rec := serve(r, withCookie(httptest.NewRequest("POST", "/api/v1/public", strings.NewReader("{}"))))
+	if rec.Code != http.StatusForbidden || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("JSON-маршрут: код %d, Content-Type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var body struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error != "forbidden" || body.Message == "" {
+		t.Errorf("тело ответа %s", rec.Body)
+	}
+
+	rec = serve(r, withCookie(httptest.NewRequest("POST", "/form", nil)))
+	if rec.Code != http.StatusForbidden || strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") {
+		t.Errorf("HTML-маршрут: код %d, Content-Type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestCSRFBearerBypass(t *testing.T) {
+	r, token := newCSRFRouter(t)
+
+	req := httptest.NewRequest("POST", "/api/v1/items", strings.NewReader("{}"))
+	req.Header.Set("Authorization", "Bearer "+token)
+	if rec := serve(r, req); rec.Code != http.StatusNoContent {
+		t.Fatalf("запрос с API-токеном: код ответа %d: %s", rec.Code, rec.Body)
+	}
+
+	// Недействительный токен не освобождает от проверки и не принимается
+	req = httptest.NewRequest("POST", "/api/v1/items", strings.NewReader("{}"))
+	req.Header.Set("Authorization", "Bearer itsm_invalid")
+	if rec := serve(r, req); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("недействительный токен: код ответа %d", rec.Code)
+	}
+}
@@ -0,0 +1,236 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"itsm/apitoken"
+	"itsm/models"
+	"itsm/openapi"
+	"itsm/rbac"
+	"itsm/twofactor"
+	"itsm/utils"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// Аутентификация и проверка разрешений для всех маршрутов. Пользователь загружается
+// из сессии или по API-токену вместе с ролями один раз и передается обработчикам
+// через контекст запроса. Маршруты по умолчанию требуют входа; требуемые разрешения
+// задаются при регистрации маршрута в SetupRoutes пакета
+
+type contextKey int
+
+const (
+	userKey contextKey = iota
+	tokenKey
+)
+
+// routeOptions - требования маршрута, заданные при регистрации
+type routeOptions struct {
+	public         bool
+	restricted     bool // доступ только с одним из permissions
+	permissions    []string
+	twoFactorSetup bool
+	sessionOnly    bool
+}
+
+// Маршрутизаторы разных слушателей регистрируют маршруты и обслуживают
+// запросы одновременно, поэтому доступ к требованиям маршрутов защищен
+var (
+	routesMu sync.RWMutex
+	routes   = map[*mux.Route]routeOptions{}
+)
+
+func setOptions(route *mux.Route, set func(*routeOptions)) *mux.Route {
+	routesMu.Lock()
+	defer routesMu.Unlock()
+	options := routes[route]
+	set(&options)
+	routes[route] = options
+	return route
+}
+
+func optionsFor(route *mux.Route) routeOptions {
+	routesMu.RLock()
+	defer routesMu.RUnlock()
+	return routes[route]
+}
+
+// Public отмечает маршрут, доступный без входа в систему
+func Public(route *mux.Route) *mux.Route {
+	return setOptions(route, func(o *routeOptions) { o.public = true })
+}
+
+// RequirePermission разрешает маршрут только пользователям с одним из разрешений
+func RequirePermission(route *mux.Route, permissions ...string) *mux.Route {
+	return setOptions(route, func(o *routeOptions) {
+		o.restricted, o.permissions = true, permissions
+	})
+}
+
+// AllowWithoutTwoFactor отмечает маршрут, доступный пользователю, для роли которого
+// двухфакторная аутентификация обязательна, но еще не настроена. Остальные
+// маршруты перенаправляют такого пользователя на страницу настройки
+func AllowWithoutTwoFactor(route *mux.Route) *mux.Route {
+	return setOptions(route, func(o *routeOptions) { o.twoFactorSetup = true })
+}
+
+// SessionOnly отмечает JSON-маршрут, недоступный по API-токену: смену пароля
+// и управление токенами, чтобы утекший токен нельзя было расширить
+func SessionOnly(route *mux.Route) *mux.Route {
+	return setOptions(route, func(o *routeOptions) { o.sessionOnly = true })
+}
+
+// CurrentUser возвращает пользователя, загруженного Authenticate.
+// Для публичных маршрутов без входа возвращается false
+func CurrentUser(r *http.Request) (models.User, bool) {
+	user, ok := r.Context().Value(userKey).(models.User)
+	return user, ok
+}
+
+// CurrentToken возвращает API-токен, по которому выполняется запрос.
+// Для запросов из сессии возвращается false
+func CurrentToken(r *http.Request) (models.APIToken, bool) {
+	token, ok := r.Context().Value(tokenKey).(models.APIToken)
+	return token, ok
+}
+
+// Authenticate загружает пользователя из сессии или по API-токену, отклоняет
+// анонимные запросы к закрытым маршрутам и проверяет разрешения
+func Authenticate(db *gorm.DB) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := mux.CurrentRoute(r)
+			options := optionsFor(route)
+
+			var user models.User
+			var ok bool
+			if raw, found := apitoken.FromRequest(r); found {
+				// Запрос с токеном не использует сессию, а неверный токен
+				// не заменяется входом по cookie
+				token, code, message := authenticateToken(db, r, route, raw)
+				if code != 0 {
+					utils.SendJSONError(w, code, message)
+					return
+				}
+				if err := rbac.PreloadRoles(db).First(&user, token.UserID).Error; err != nil {
+					log.Println("Ошибка при загрузке пользователя:", err)
+					utils.SendJSONError(w, http.StatusInternalServerError, "Ошибка сервера")
+					return
+				}
+				if user.DeactivatedAt != nil {
+					utils.SendJSONError(w, http.StatusUnauthorized, apitoken.ErrInvalid.Error())
+					return
+				}
+				ok = true
+				r = r.WithContext(context.WithValue(r.Context(), tokenKey, token))
+			} else {
+				user, ok = loadUser(db, r)
+			}
+			if ok {
+				r = r.WithContext(context.WithValue(r.Context(), userKey, user))
+			}
+
+			if options.public {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !ok {
+				if isJSONRoute(route) {
+					utils.SendJSONError(w, http.StatusUnauthorized, "Пользователь не авторизован")
+				} else {
+					http.Redirect(w, r, "/", http.StatusSeeOther)
+				}
+				return
+			}
+
+			if twofactor.Required(user) && !twofactor.Enabled(user) && !options.twoFactorSetup {
+				if isJSONRoute(route) {
+					utils.SendJSONError(w, http.StatusForbidden, "Необходимо настроить двухфакторную аутентификацию")
+				} else {
+					http.Redirect(w, r, twofactor.SetupPath, http.StatusSeeOther)
+				}
+				return
+			}
+
+			if options.restricted && !rbac.CanAny(user, options.permissions...) {
+				if isJSONRoute(route) {
+					utils.SendJSONError(w, http.StatusForbidden, "Недостаточно прав")
+				} else {
+					http.Error(w, "Недостаточно прав", http.StatusForbidden)
+				}
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// loadUser находит пользователя по ID из сессии. Недействительная сессия,
+// удаленный и отключенный пользователь и сессия, открытая до смены пароля,
+// считаются анонимным запросом
+func loadUser(db *gorm.DB, r *http.Request) (models.User, bool) {
+	var user models.User
+
+	curSession, err := utils.GetCurSession(r)
+	if err != nil {
+		return user, false
+	}
+	userID, ok := curSession.Values["userID"].(uint)
+	if !ok {
+		return user, false
+	}
+
+	if err := rbac.PreloadRoles(db).First(&user, userID).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Println("Ошибка при загрузке пользователя:", err)
+		}
+		return user, false
+	}
+
+	// Сессии отключенного пользователя перестают действовать сразу
+	if user.DeactivatedAt != nil {
+		return user, false
+	}
+
+	// Смена пароля завершает сессии, открытые со старым паролем
+	authTime, _ := curSession.Values["authTime"].(int64)
+	if user.PasswordChangedAt != nil && authTime < user.PasswordChangedAt.Unix() {
+		return user, false
+	}
+	return user, true
+}
+
+// authenticateToken проверяет API-токен и его применимость к маршруту.
+// Ненулевой code - ответ с ошибкой
+func authenticateToken(db *gorm.DB, r *http.Request, route *mux.Route, raw string) (models.APIToken, int, string) {
+	if !isJSONRoute(route) {
+		return models.APIToken{}, http.StatusUnauthorized, "API-токен действует только для JSON API"
+	}
+
+	token, err := apitoken.Authenticate(db, raw)
+	if errors.Is(err, apitoken.ErrInvalid) {
+		return token, http.StatusUnauthorized, err.Error()
+	}
+	if err != nil {
+		log.Println("Ошибка при проверке API-токена:", err)
+		return token, http.StatusInternalServerError, "Ошибка сервера"
+	}
+
+	if optionsFor(route).sessionOnly {
+		return token, http.StatusForbidden, "Действие недоступно по API-токену, войдите в систему"
+	}
+	if !apitoken.Allows(token, r.Method) {
+		return token, http.StatusForbidden, "Токен дает доступ только на чтение"
+	}
+	return token, 0, ""
+}
+
+func isJSONRoute(route *mux.Route) bool {
+	return route != nil && openapi.IsJSON(route)
+}
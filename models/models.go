@@ -2,13 +2,113 @@ package models
 
 import "time"
 
+// All возвращает все модели для миграции схемы базы данных
+func All() []interface{} {
+	return []interface{}{&Permission{}, &Role{}, &User{}, &Service{}, &Message{},
+		&Dialog{}, &Incident{}, &IncidentStatusChange{}, &SLAPolicy{},
+		&IncidentComment{}, &IncidentChange{}, &Attachment{},
+		&Calendar{}, &WorkingHours{}, &Holiday{},
+		&Team{}, &SavedView{}, &AuditEvent{}, &UserSession{},
+		&LoginAttempt{}, &RecoveryCode{}, &PasswordResetToken{},
+		&UserIdentity{}, &APIToken{}}
+}
+
 type User struct {
-	ID               uint   `gorm:"primaryKey" json:"id"`
-	Username         string `gorm:"not null" json:"username"`
-	Password         string `gorm:"not null" json:"password"`
-	IsAdmin          bool   `gorm:"default:false" json:"is_admin"`
-	IsTechOfficer    bool   `gorm:"default:false" json:"is_tech_officer"`
-	IsDefaultOfficer bool   `gorm:"default:false" json:"is_default_officer"`
+	ID                uint       `gorm:"primaryKey" json:"id"`
+	Username          string     `gorm:"not null" json:"username"`
+	Email             *string    `gorm:"size:255;uniqueIndex" json:"email"` // для восстановления пароля
+	Password          string     `gorm:"not null" json:"-"`
+	AuthSource        string     `gorm:"size:32;not null;default:local" json:"auth_source"` // local, внешний каталог или oidc
+	TeamID            *uint      `json:"team_id"`
+	DefaultViewID     *uint      `json:"default_view_id"`
+	DeactivatedAt     *time.Time `json:"deactivated_at"` // отключенный пользователь не может войти
+	LockedUntil       *time.Time `json:"locked_until"`   // вход заблокирован после неудачных попыток
+	PasswordChangedAt *time.Time `json:"-"`              // сессии, открытые раньше, недействительны
+	TOTPSecret        string     `gorm:"size:64" json:"-"`
+	TOTPEnabledAt     *time.Time `json:"totp_enabled_at"`    // включена двухфакторная аутентификация
+	TOTPLastCounter   int64      `gorm:"default:0" json:"-"` // последний принятый шаг TOTP, повтор кода не принимается
+	Roles             []Role     `gorm:"many2many:user_roles;" json:"roles"`
+}
+
+// UserIdentity - связь пользователя с учетной записью внешнего провайдера
+// единого входа. Subject - неизменный идентификатор пользователя у провайдера
+type UserIdentity struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	UserID      uint      `gorm:"not null;index" json:"user_id"`
+	Provider    string    `gorm:"size:64;not null;uniqueIndex:idx_identity_subject" json:"provider"`
+	Subject     string    `gorm:"size:255;not null;uniqueIndex:idx_identity_subject" json:"subject"`
+	Email       string    `gorm:"size:255" json:"email"`
+	CreatedAt   time.Time `gorm:"autoCreateTime" json:"created_at"`
+	LastLoginAt time.Time `json:"last_login_at"`
+}
+
+// PasswordResetToken - одноразовая ссылка восстановления пароля, отправленная
+// на почту. Хранится только хеш токена
+type PasswordResetToken struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	UserID    uint       `gorm:"not null;index" json:"user_id"`
+	TokenHash string     `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	IP        string     `gorm:"size:64" json:"ip"` // с какого адреса запрошено восстановление
+	ExpiresAt time.Time  `gorm:"not null" json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `gorm:"autoCreateTime" json:"created_at"`
+}
+
+// RecoveryCode - резервный код для входа без приложения. Хранится только хеш
+type RecoveryCode struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	UserID    uint       `gorm:"not null;index" json:"user_id"`
+	CodeHash  string     `gorm:"size:64;not null" json:"-"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `gorm:"autoCreateTime" json:"created_at"`
+}
+
+// APIToken - личный токен пользователя для скриптов и интеграций. Запрос
+// с токеном выполняется от имени пользователя с его ролями. Хранится только хеш
+type APIToken struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	UserID     uint       `gorm:"not null;index" json:"user_id"`
+	Name       string     `gorm:"size:100;not null" json:"name"`
+	Prefix     string     `gorm:"size:16;not null" json:"prefix"` // начало токена, чтобы узнать его в списке
+	TokenHash  string     `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	Scope      string     `gorm:"size:16;not null" json:"scope"` // read или write
+	ExpiresAt  *time.Time `json:"expires_at"`                    // nil - бессрочный
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `gorm:"autoCreateTime" json:"created_at"`
+}
+
+// Role - набор разрешений, назначаемый пользователям. Пользователь без ролей - клиент
+type Role struct {
+	ID          uint         `gorm:"primaryKey" json:"id"`
+	Name        string       `gorm:"size:64;not null;uniqueIndex" json:"name"`
+	Title       string       `gorm:"not null" json:"title"`
+	Permissions []Permission `gorm:"many2many:role_permissions;" json:"permissions,omitempty"`
+}
+
+// Permission - право на действие, например incident.assign
+type Permission struct {
+	ID          uint   `gorm:"primaryKey" json:"id"`
+	Code        string `gorm:"size:64;not null;uniqueIndex" json:"code"`
+	Description string `json:"description"`
+}
+
+// Team - команда сотрудников поддержки, участники которой видят общие фильтры
+type Team struct {
+	ID   uint   `gorm:"primaryKey" json:"id"`
+	Name string `gorm:"not null;unique" json:"name"`
+}
+
+// SavedView - сохраненный фильтр списка инцидентов. Без команды фильтр
+// виден только владельцу, с командой - всем ее участникам
+type SavedView struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	OwnerID   uint      `gorm:"not null;index" json:"owner_id"`
+	TeamID    *uint     `gorm:"index" json:"team_id"`
+	Name      string    `gorm:"not null" json:"name"`
+	Query     string    `gorm:"type:text" json:"query"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+	Owner     User      `gorm:"foreignKey:OwnerID" json:"owner"`
 }
 
 type Service struct {
@@ -20,19 +120,135 @@ type Service struct {
 }
 
 type Incident struct {
-	ID                uint      `gorm:"primaryKey" json:"id"`
-	UserID            uint      `gorm:"not null" json:"user_id"`
-	ResponsibleUserID *uint     `gorm:"default:null" json:"responsible_user_id"`
-	Title             string    `gorm:"not null" json:"title"`
-	Description       string    `json:"description"`
-	Status            string    `json:"status"`
-	CreatedAt         time.Time `gorm:"autoCreateTime" json:"created_at"`
-	UpdatedAt         time.Time `gorm:"autoUpdateTime" json:"updated_at"`
-	User              User      `gorm:"foreignKey:UserID" json:"user"`
-	ResponsibleUser   User      `gorm:"foreignKey:ResponsibleUserID" json:"responsible_user"`
-	Services          []Service `gorm:"many2many:incident_services;" json:"services"`
+	ID                uint       `gorm:"primaryKey" json:"id"`
+	UserID            uint       `gorm:"not null" json:"user_id"`
+	ResponsibleUserID *uint      `gorm:"default:null" json:"responsible_user_id"`
+	Title             string     `gorm:"not null" json:"title"`
+	Description       string     `json:"description"`
+	Status            string     `json:"status"`
+	Resolution        string     `gorm:"type:text" json:"resolution"`
+	StatusReason      string     `gorm:"type:text" json:"status_reason"`
+	Impact            int        `gorm:"default:3" json:"impact"`
+	Urgency           int        `gorm:"default:3" json:"urgency"`
+	Priority          int        `gorm:"default:5;index" json:"priority"`
+	RespondedAt       *time.Time `json:"responded_at"`
+	ResolvedAt        *time.Time `json:"resolved_at"`
+	ResponseDueAt     *time.Time `gorm:"index" json:"response_due_at"`
+	ResolutionDueAt   *time.Time `gorm:"index" json:"resolution_due_at"`
+	SLABreached       bool       `gorm:"default:false;index" json:"sla_breached"`
+	CreatedAt         time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt         time.Time  `gorm:"autoUpdateTime" json:"updated_at"`
+	User              User       `gorm:"foreignKey:UserID" json:"user"`
+	ResponsibleUser   User       `gorm:"foreignKey:ResponsibleUserID" json:"responsible_user"`
+	Services          []Service  `gorm:"many2many:incident_services;" json:"services"`
+}
+
+// IncidentComment - комментарий к инциденту. Рабочие заметки (IsInternal)
+// видны только сотрудникам поддержки
+type IncidentComment struct {
+	ID          uint         `gorm:"primaryKey" json:"id"`
+	IncidentID  uint         `gorm:"not null;index" json:"incident_id"`
+	AuthorID    uint         `gorm:"not null" json:"author_id"`
+	Content     string       `gorm:"type:text;not null" json:"content"`
+	IsInternal  bool         `gorm:"default:false" json:"is_internal"`
+	CreatedAt   time.Time    `gorm:"autoCreateTime" json:"created_at"`
+	Author      User         `gorm:"foreignKey:AuthorID" json:"author"`
+	Attachments []Attachment `gorm:"foreignKey:CommentID" json:"attachments"`
 }
 
+// Attachment - файл, приложенный к инциденту или к комментарию.
+// Содержимое хранится в хранилище файлов под ключом StorageKey
+type Attachment struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	IncidentID  uint      `gorm:"not null;index" json:"incident_id"`
+	CommentID   *uint     `gorm:"index" json:"comment_id"`
+	UploaderID  uint      `gorm:"not null" json:"uploader_id"`
+	FileName    string    `gorm:"not null" json:"file_name"`
+	ContentType string    `gorm:"not null" json:"content_type"`
+	Size        int64     `gorm:"not null" json:"size"`
+	StorageKey  string    `gorm:"not null" json:"-"`
+	CreatedAt   time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+// IncidentChange - запись журнала изменений полей инцидента.
+// Записи только добавляются и никогда не изменяются
+type IncidentChange struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	IncidentID uint      `gorm:"not null;index" json:"incident_id"`
+	UserID     uint      `gorm:"not null" json:"user_id"`
+	Field      string    `gorm:"not null" json:"field"`
+	OldValue   string    `gorm:"type:text" json:"old_value"`
+	NewValue   string    `gorm:"type:text" json:"new_value"`
+	CreatedAt  time.Time `gorm:"autoCreateTime" json:"created_at"`
+	User       User      `gorm:"foreignKey:UserID" json:"user"`
+}
+
+// IncidentStatusChange - запись истории статусов инцидента
+type IncidentStatusChange struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	IncidentID uint      `gorm:"not null;index" json:"incident_id"`
+	UserID     uint      `gorm:"not null" json:"user_id"`
+	FromStatus string    `json:"from_status"`
+	ToStatus   string    `gorm:"not null" json:"to_status"`
+	CreatedAt  time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+// SLAPolicy - целевые сроки реакции и решения. Политика без услуги
+// применяется ко всем услугам, политика с нулевым приоритетом - ко всем приоритетам
+type SLAPolicy struct {
+	ID                uint     `gorm:"primaryKey" json:"id"`
+	ServiceID         *uint    `gorm:"index" json:"service_id"`
+	Priority          int      `gorm:"default:0" json:"priority"`
+	ResponseMinutes   int      `gorm:"not null" json:"response_minutes"`
+	ResolutionMinutes int      `gorm:"not null" json:"resolution_minutes"`
+	CalendarID        *uint    `json:"calendar_id"`
+	Service           *Service `gorm:"foreignKey:ServiceID" json:"service,omitempty"`
+}
+
+// Calendar - рабочий календарь: рабочие часы по дням недели и праздники.
+// Время рабочих часов задается в часовом поясе календаря
+type Calendar struct {
+	ID           uint           `gorm:"primaryKey" json:"id"`
+	Name         string         `gorm:"not null" json:"name"`
+	Timezone     string         `gorm:"not null" json:"timezone"`
+	IsDefault    bool           `gorm:"default:false" json:"is_default"`
+	WorkingHours []WorkingHours `gorm:"foreignKey:CalendarID" json:"working_hours"`
+	Holidays     []Holiday      `gorm:"foreignKey:CalendarID" json:"holidays"`
+}
+
+// WorkingHours - рабочий интервал в один из дней недели (0 - воскресенье).
+// Начало и конец задаются в минутах от полуночи
+type WorkingHours struct {
+	ID          uint `gorm:"primaryKey" json:"id"`
+	CalendarID  uint `gorm:"not null;index" json:"calendar_id"`
+	Weekday     int  `gorm:"not null" json:"weekday"`
+	StartMinute int  `gorm:"not null" json:"start_minute"`
+	EndMinute   int  `gorm:"not null" json:"end_minute"`
+}
+
+type Holiday struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	CalendarID uint      `gorm:"not null;index" json:"calendar_id"`
+	Date       time.Time `gorm:"type:date;not null" json:"date"`
+	Name       string    `json:"name"`
+}
+
+// Статусы жизненного цикла инцидента
+const (
+	StatusNew        = "Новый"
+	StatusAssigned   = "Назначен"
+	StatusInProgress = "В работе"
+	StatusOnHold     = "Приостановлен"
+	StatusResolved   = "Решен"
+	StatusClosed     = "Закрыт"
+	StatusReopened   = "Переоткрыт"
+	StatusCancelled  = "Отменен"
+)
+
+// IncidentStatuses - все статусы в порядке жизненного цикла
+var IncidentStatuses = []string{StatusNew, StatusAssigned, StatusInProgress, StatusOnHold,
+	StatusResolved, StatusClosed, StatusReopened, StatusCancelled}
+
 type Message struct {
 	ID         uint      `json:"id" gorm:"primaryKey"`
 	DialogID   uint      `json:"dialog_id" gorm:"not null"`
@@ -52,3 +268,43 @@ type Dialog struct {
 	User1   User `gorm:"foreignKey:User1ID" json:"user1"`
 	User2   User `gorm:"foreignKey:User2ID" json:"user2"`
 }
+
+// AuditEvent - запись журнала аудита действий с учетными записями
+type AuditEvent struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	ActorID   *uint     `gorm:"index" json:"actor_id"` // nil - действие анонимного пользователя или системы
+	Action    string    `gorm:"size:64;not null;index" json:"action"`
+	TargetID  *uint     `gorm:"index" json:"target_id"` // пользователь, над которым выполнено действие
+	Details   string    `gorm:"type:text" json:"details"`
+	IP        string    `gorm:"size:64" json:"ip"`
+	CreatedAt time.Time `gorm:"autoCreateTime;index" json:"created_at"`
+	Actor     *User     `gorm:"foreignKey:ActorID" json:"actor,omitempty"`
+	Target    *User     `gorm:"foreignKey:TargetID" json:"target,omitempty"`
+}
+
+// UserSession - сессия, хранящаяся на сервере. В cookie передается только
+// подписанный токен, в базе - его хеш, поэтому утечка таблицы не раскрывает сессии
+type UserSession struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	TokenHash string    `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	UserID    *uint     `gorm:"index" json:"user_id"` // nil - сессия без входа в систему
+	Data      []byte    `gorm:"type:blob" json:"-"`
+	IP        string    `gorm:"size:64" json:"ip"`
+	UserAgent string    `gorm:"size:255" json:"user_agent"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+	ExpiresAt time.Time `gorm:"not null;index" json:"expires_at"`
+}
+
+// LoginAttempt - попытка входа. Неудачные попытки учитываются при ограничении
+// частоты входа, пока не истечет окно или администратор не снимет блокировку.
+// Составные индексы покрывают подсчет неудач по логину и по адресу
+type LoginAttempt struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Username  string    `gorm:"size:255;not null;index:idx_login_attempts_user_failures,priority:1" json:"username"`
+	UserID    *uint     `gorm:"index" json:"user_id"` // nil - пользователь не найден
+	IP        string    `gorm:"size:64;not null;index:idx_login_attempts_ip_failures,priority:1" json:"ip"`
+	Result    string    `gorm:"size:32;not null;index;index:idx_login_attempts_user_failures,priority:3;index:idx_login_attempts_ip_failures,priority:2" json:"result"`
+	Cleared   bool      `gorm:"not null;default:false;index:idx_login_attempts_user_failures,priority:2" json:"-"` // не учитывается после входа или разблокировки
+	CreatedAt time.Time `gorm:"autoCreateTime;index;index:idx_login_attempts_user_failures,priority:4;index:idx_login_attempts_ip_failures,priority:3" json:"created_at"`
+}
@@ -0,0 +1,151 @@
+package openapi
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Спецификация OpenAPI всех JSON-обработчиков. Документ поддерживается вручную,
+// а Verify сверяет его с зарегистрированными маршрутами в тестах пакета
+
+// SpecPath - адрес, по которому отдается спецификация
+const SpecPath = "/api/openapi.json"
+
+// apiPrefix - маршруты с этим префиксом всегда считаются JSON-обработчиками
+const apiPrefix = "/api/"
+
+//go:embed openapi.json
+var spec []byte
+
+// jsonRoutes - JSON-маршруты вне apiPrefix, отмеченные через JSON. Маршрутизаторы
+// слушателей регистрируют и проверяют маршруты одновременно
+var (
+	jsonRoutesMu sync.RWMutex
+	jsonRoutes   = map[*mux.Route]bool{}
+)
+
+// pathVariable - переменная пути gorilla/mux вида {id:[0-9]+}
+var pathVariable = regexp.MustCompile(`\{([^{}:]+)(:[^{}]*)?\}`)
+
+// JSON отмечает маршрут как JSON-обработчик, который должен быть описан в спецификации
+func JSON(route *mux.Route) *mux.Route {
+	jsonRoutesMu.Lock()
+	defer jsonRoutesMu.Unlock()
+	jsonRoutes[route] = true
+	return route
+}
+
+// IsJSON сообщает, отвечает ли маршрут в формате JSON
+func IsJSON(route *mux.Route) bool {
+	jsonRoutesMu.RLock()
+	marked := jsonRoutes[route]
+	jsonRoutesMu.RUnlock()
+	if marked {
+		return true
+	}
+	template, err := route.GetPathTemplate()
+	return err == nil && strings.HasPrefix(template, apiPrefix)
+}
+
+func SetupRoutes(r *mux.Router) {
+	r.HandleFunc(SpecPath, specHandler).Methods("GET").Name(SpecPath)
+}
+
+func specHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(spec)
+}
+
+type document struct {
+	Paths map[string]map[string]json.RawMessage `json:"paths"`
+}
+
+// operations возвращает описанные в спецификации методы для каждого пути
+func operations() (map[string]map[string]bool, error) {
+	var doc document
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return nil, fmt.Errorf("некорректная спецификация OpenAPI: %w", err)
+	}
+
+	result := make(map[string]map[string]bool, len(doc.Paths))
+	for path, item := range doc.Paths {
+		result[path] = map[string]bool{}
+		for method := range item {
+			// Кроме операций элемент пути содержит общие параметры и описание
+			if method != "parameters" && method != "summary" && method != "description" {
+				result[path][strings.ToUpper(method)] = true
+			}
+		}
+	}
+	return result, nil
+}
+
+// Verify проверяет, что каждый JSON-маршрут описан в спецификации
+// с теми же методами и что в спецификации нет несуществующих путей
+func Verify(r *mux.Router) error {
+	documented, err := operations()
+	if err != nil {
+		return err
+	}
+
+	registered := map[string]bool{}
+	var missing []string
+
+	err = r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		// Маршрут PathPrefix подмаршрутизатора сам запросы не обрабатывает
+		if route.GetHandler() == nil {
+			return nil
+		}
+
+		if !IsJSON(route) {
+			return nil
+		}
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+
+		path := pathVariable.ReplaceAllString(template, "{$1}")
+		registered[path] = true
+
+		methods, err := route.GetMethods()
+		if err != nil {
+			// Маршрут без ограничения методов должен быть описан хотя бы одной операцией
+			if len(documented[path]) == 0 {
+				missing = append(missing, path)
+			}
+			return nil
+		}
+		for _, method := range methods {
+			if !documented[path][method] {
+				missing = append(missing, method+" "+path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var stale []string
+	for path := range documented {
+		if !registered[path] {
+			stale = append(stale, path)
+		}
+	}
+
+	if len(missing) > 0 || len(stale) > 0 {
+		sort.Strings(missing)
+		sort.Strings(stale)
+		return fmt.Errorf("спецификация OpenAPI не соответствует маршрутам: не описаны [%s], не зарегистрированы [%s]",
+			strings.Join(missing, ", "), strings.Join(stale, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package openapi_test
+
+import (
+	"itsm/listener"
+	"itsm/openapi"
+	"itsm/router"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func noop(w http.ResponseWriter, r *http.Request) {}
+
+// Спецификация должна описывать все JSON-маршруты всех разделов
+func TestSpecMatchesRoutes(t *testing.T) {
+	if err := openapi.Verify(router.New(nil, listener.Modules)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyReportsUndocumentedRoute(t *testing.T) {
+	r := router.New(nil, listener.Modules)
+	r.HandleFunc("/api/v1/undocumented", noop).Methods("GET")
+	openapi.JSON(r.HandleFunc("/incidents/undocumented", noop).Methods("POST"))
+
+	err := openapi.Verify(r)
+	if err == nil {
+		t.Fatal("неописанные маршруты не обнаружены")
+	}
+	for _, route := range []string{"GET /api/v1/undocumented", "POST /incidents/undocumented"} {
+		if !strings.Contains(err.Error(), route) {
+			t.Errorf("в ошибке нет маршрута %s: %v", route, err)
+		}
+	}
+}
+
+func TestVerifyReportsUnknownPath(t *testing.T) {
+	// Без раздела инцидентов их пути в спецификации не соответствуют маршрутам
+	err := openapi.Verify(router.New(nil, []string{listener.ModuleServices}))
+	if err == nil || !strings.Contains(err.Error(), "/api/v1/incidents") {
+		t.Fatalf("лишние пути спецификации не обнаружены: %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+package password
+
+import (
+	"bufio"
+	"crypto/rand"
+	_ "embed"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"math/big"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Требования к паролям пользователей. Проверяются при регистрации,
+// создании пользователя администратором и смене пароля
+
+//go:embed common.txt
+var commonPasswords string
+
+// Policy - требования к паролю
+type Policy struct {
+	MinLength  int // минимальная длина в символах
+	MinClasses int // сколько классов символов должно встречаться: строчные, прописные, цифры, прочие
+}
+
+// Длина и алфавит временных паролей. Похожие символы исключены
+const (
+	generatedLength   = 12
+	generatedAlphabet = "abcdefghjkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789-_!@#%"
+)
+
+// MaxBytes - наибольшая длина пароля в байтах, которую принимает bcrypt
+const MaxBytes = 72
+
+// DefaultPolicy - требования по умолчанию
+var DefaultPolicy = Policy{MinLength: 10, MinClasses: 3}
+
+var (
+	policy   = DefaultPolicy
+	denyList = parseDenyList(commonPasswords)
+)
+
+// Configure задает требования к паролю
+func Configure(p Policy) {
+	policy = p
+}
+
+// LoadDenyList добавляет к встроенному списку распространенных паролей
+// пароли из файла, по одному в строке
+func LoadDenyList(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		addDenied(denyList, scanner.Text())
+	}
+	return scanner.Err()
+}
+
+func parseDenyList(list string) map[string]bool {
+	result := map[string]bool{}
+	for _, line := range strings.Split(list, "\n") {
+		addDenied(result, line)
+	}
+	return result
+}
+
+// addDenied добавляет в список пароль и его основу (см. base)
+func addDenied(list map[string]bool, line string) {
+	line = strings.ToLower(strings.TrimSpace(line))
+	if line == "" {
+		return
+	}
+	list[line] = true
+	if b := base(line); b != "" {
+		list[b] = true
+	}
+}
+
+// base оставляет от пароля только буквы в нижнем регистре. Распространенный
+// пароль обычно дополняют цифрами и знаками, чтобы пройти требования:
+// Password123! и P@ssw0rd2024 сводятся к основам password и psswrd из списка
+func base(password string) string {
+	return strings.Map(func(r rune) rune {
+		if !unicode.IsLetter(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, password)
+}
+
+// Error - пароль не соответствует требованиям
+type Error struct {
+	Problems []string
+}
+
+func (e *Error) Error() string {
+	return "Пароль не соответствует требованиям: " + strings.Join(e.Problems, "; ")
+}
+
+// Validate проверяет пароль пользователя username на соответствие требованиям
+func Validate(password, username string) error {
+	var problems []string
+
+	if utf8.RuneCountInString(password) < policy.MinLength {
+		problems = append(problems, fmt.Sprintf("длина не меньше %d символов", policy.MinLength))
+	}
+	if len(password) > MaxBytes {
+		problems = append(problems, fmt.Sprintf("длина не больше %d байт (%d символов кириллицы)", MaxBytes, MaxBytes/2))
+	}
+	if classes(password) < policy.MinClasses {
+		problems = append(problems, fmt.Sprintf("символы хотя бы %d видов из: строчные и прописные буквы, цифры, прочие символы",
+			policy.MinClasses))
+	}
+
+	lower := strings.ToLower(password)
+	if username != "" && lower == strings.ToLower(username) {
+		problems = append(problems, "пароль не должен совпадать с логином")
+	}
+	if b := base(password); denyList[lower] || (b != "" && denyList[b]) {
+		problems = append(problems, "пароль слишком распространен")
+	}
+
+	if len(problems) > 0 {
+		return &Error{Problems: problems}
+	}
+	return nil
+}
+
+// Requirements - описание требований для вывода рядом с формой
+func Requirements() string {
+	return fmt.Sprintf("Не меньше %d символов и не больше %d байт, хотя бы %d вида символов из: строчные и прописные буквы, цифры, "+
+		"прочие символы. Пароль не должен совпадать с логином и быть распространенным, в том числе с добавленными цифрами и знаками",
+		policy.MinLength, MaxBytes, policy.MinClasses)
+}
+
+// classes считает, сколько классов символов встречается в пароле
+func classes(password string) int {
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+
+	count := 0
+	for _, present := range []bool{lower, upper, digit, other} {
+		if present {
+			count++
+		}
+	}
+	return count
+}
+
+// Generate создает случайный временный пароль, удовлетворяющий требованиям
+func Generate() (string, error) {
+	length := max(generatedLength, policy.MinLength)
+	alphabetSize := big.NewInt(int64(len(generatedAlphabet)))
+
+	// Случайный пароль может не содержать нужных классов символов - тогда пробуем снова
+	for range 100 {
+		buf := make([]byte, length)
+		for i := range buf {
+			n, err := rand.Int(rand.Reader, alphabetSize)
+			if err != nil {
+				return "", err
+			}
+			buf[i] = generatedAlphabet[n.Int64()]
+		}
+		if generated := string(buf); Validate(generated, "") == nil {
+			return generated, nil
+		}
+	}
+	return "", errors.New("не удалось создать пароль, удовлетворяющий требованиям")
+}
+
+// Hash возвращает bcrypt-хеш пароля для хранения в базе
+func Hash(plain string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(plain), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// Matches сообщает, соответствует ли пароль хешу
+func Matches(hash, plain string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(plain)) == nil
+}
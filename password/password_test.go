@@ -0,0 +1,45 @@
+package password
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateDenyList(t *testing.T) {
+	for _, p := range []string{"Password123!", "P@ssw0rd2024", "Qwerty12345!", "Пароль2024!!"} {
+		var validationErr *Error
+		if err := Validate(p, ""); !errors.As(err, &validationErr) ||
+			!strings.Contains(validationErr.Error(), "распространен") {
+			t.Errorf("Validate(%q) = %v, want common password error", p, err)
+		}
+	}
+
+	if err := Validate("Tr1cky-Hors3-Battery", ""); err != nil {
+		t.Errorf("Validate(strong) = %v", err)
+	}
+}
+
+func TestValidateMaxBytes(t *testing.T) {
+	if err := Validate("Aa1-"+strings.Repeat("x", MaxBytes-4), ""); err != nil {
+		t.Errorf("Validate(%d bytes) = %v", MaxBytes, err)
+	}
+
+	for _, p := range []string{"Aa1-" + strings.Repeat("x", MaxBytes-3), "Aa1-" + strings.Repeat("ж", 35)} {
+		if err := Validate(p, ""); err == nil || !strings.Contains(err.Error(), "байт") {
+			t.Errorf("Validate(%d bytes) = %v, want length error", len(p), err)
+		}
+	}
+}
+
+func TestGenerateValid(t *testing.T) {
+	for range 20 {
+		p, err := Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Validate(p, ""); err != nil {
+			t.Errorf("Validate(%q) = %v", p, err)
+		}
+	}
+}
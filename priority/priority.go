@@ -0,0 +1,92 @@
+package priority
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Уровни влияния и срочности инцидента
+const (
+	High   = 1
+	Medium = 2
+	Low    = 3
+)
+
+// Level - уровень влияния или срочности для вывода в шаблонах
+type Level struct {
+	Value int
+	Name  string
+}
+
+var Levels = []Level{
+	{High, "Высокое"},
+	{Medium, "Среднее"},
+	{Low, "Низкое"},
+}
+
+// Matrix - матрица приоритетов: Matrix[влияние-1][срочность-1] = приоритет (1-5, где 1 - наивысший)
+type Matrix [3][3]int
+
+var Default = Matrix{
+	{1, 2, 3},
+	{2, 3, 4},
+	{3, 4, 5},
+}
+
+var current = Default
+
+// Set заменяет матрицу, по которой вычисляется приоритет
+func Set(m Matrix) {
+	current = m
+}
+
+// Calculate вычисляет приоритет по влиянию и срочности.
+// Некорректные значения считаются низкими
+func Calculate(impact, urgency int) int {
+	return current[Normalize(impact)-1][Normalize(urgency)-1]
+}
+
+// Normalize приводит значение влияния или срочности к допустимому диапазону
+func Normalize(level int) int {
+	if level < High || level > Low {
+		return Low
+	}
+	return level
+}
+
+// ParseLevel разбирает значение влияния или срочности из формы
+func ParseLevel(value string) int {
+	level, err := strconv.Atoi(value)
+	if err != nil {
+		return Low
+	}
+	return Normalize(level)
+}
+
+// Parse разбирает матрицу из строки вида "1,2,3;2,3,4;3,4,5",
+// где строки соответствуют влиянию, а столбцы - срочности
+func Parse(value string) (Matrix, error) {
+	var m Matrix
+
+	rows := strings.Split(value, ";")
+	if len(rows) != 3 {
+		return m, fmt.Errorf("ожидается 3 строки матрицы, получено %d", len(rows))
+	}
+
+	for i, row := range rows {
+		cells := strings.Split(row, ",")
+		if len(cells) != 3 {
+			return m, fmt.Errorf("строка %d: ожидается 3 значения, получено %d", i+1, len(cells))
+		}
+		for j, cell := range cells {
+			p, err := strconv.Atoi(strings.TrimSpace(cell))
+			if err != nil || p < 1 || p > 5 {
+				return m, fmt.Errorf("строка %d: недопустимый приоритет %q", i+1, cell)
+			}
+			m[i][j] = p
+		}
+	}
+
+	return m, nil
+}
@@ -0,0 +1,205 @@
+package rbac
+
+import (
+	"gorm.io/gorm"
+	"itsm/models"
+	"slices"
+)
+
+// Разрешения. Коды хранятся в таблице permissions и назначаются ролям
+const (
+	PermIncidentViewAll    = "incident.view_all"   // видеть все инциденты и рабочие заметки
+	PermIncidentAssign     = "incident.assign"     // назначать ответственного
+	PermIncidentEdit       = "incident.edit"       // менять влияние, срочность и услуги
+	PermIncidentWork       = "incident.work"       // выполнять инциденты, быть ответственным
+	PermIncidentAdminister = "incident.administer" // отменять и переоткрывать любые инциденты
+	PermSLAView            = "sla.view"            // видеть отчет о нарушениях SLA
+	PermServiceViewTech    = "service.view_technical"
+	PermServiceCreate      = "service.create"
+	PermServiceUpdate      = "service.update"
+	PermServiceDelete      = "service.delete"
+	PermMessengerUse       = "messenger.use"
+	PermUserManage         = "user.manage" // управлять пользователями и их ролями
+)
+
+// Permissions - все разрешения с описаниями
+var Permissions = []models.Permission{
+	{Code: PermIncidentViewAll, Description: "Просмотр всех инцидентов и рабочих заметок"},
+	{Code: PermIncidentAssign, Description: "Назначение ответственного"},
+	{Code: PermIncidentEdit, Description: "Изменение влияния, срочности и услуг инцидента"},
+	{Code: PermIncidentWork, Description: "Работа над инцидентами"},
+	{Code: PermIncidentAdminister, Description: "Отмена и переоткрытие любых инцидентов"},
+	{Code: PermSLAView, Description: "Просмотр нарушений SLA"},
+	{Code: PermServiceViewTech, Description: "Просмотр технических услуг"},
+	{Code: PermServiceCreate, Description: "Создание услуг"},
+	{Code: PermServiceUpdate, Description: "Изменение услуг"},
+	{Code: PermServiceDelete, Description: "Удаление услуг"},
+	{Code: PermMessengerUse, Description: "Использование мессенджера"},
+	{Code: PermUserManage, Description: "Управление пользователями и ролями"},
+}
+
+// Встроенные роли
+const (
+	RoleAdmin          = "admin"
+	RoleTechOfficer    = "tech_officer"
+	RoleDefaultOfficer = "default_officer"
+)
+
+type defaultRole struct {
+	Name        string
+	Title       string
+	Permissions []string
+}
+
+// defaultRoles создаются при первом запуске. Разрешения существующих ролей
+// не меняются, кроме роли администратора, которая всегда получает все разрешения
+var defaultRoles = []defaultRole{
+	{RoleAdmin, "Администратор", nil},
+	{RoleTechOfficer, "Технический специалист", []string{
+		PermIncidentViewAll, PermIncidentAssign, PermIncidentEdit, PermIncidentWork,
+		PermSLAView, PermServiceViewTech, PermMessengerUse,
+	}},
+	{RoleDefaultOfficer, "Сотрудник поддержки", []string{
+		PermIncidentViewAll, PermServiceViewTech, PermMessengerUse,
+	}},
+}
+
+// legacyFlags - столбцы users, которыми раньше задавались права, и соответствующие им роли
+var legacyFlags = []struct {
+	Column string
+	Role   string
+}{
+	{"is_admin", RoleAdmin},
+	{"is_tech_officer", RoleTechOfficer},
+	{"is_default_officer", RoleDefaultOfficer},
+}
+
+// Can сообщает, есть ли у пользователя разрешение через одну из его ролей.
+// Роли пользователя должны быть загружены вместе с разрешениями (см. PreloadRoles)
+func Can(user models.User, permission string) bool {
+	for _, role := range user.Roles {
+		if slices.ContainsFunc(role.Permissions, func(p models.Permission) bool { return p.Code == permission }) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAny сообщает, есть ли у пользователя хотя бы одно из разрешений
+func CanAny(user models.User, permissions ...string) bool {
+	return slices.ContainsFunc(permissions, func(p string) bool { return Can(user, p) })
+}
+
+// IsClient - пользователь, который видит только собственные инциденты
+func IsClient(user models.User) bool {
+	return !Can(user, PermIncidentViewAll)
+}
+
+// HasRole сообщает, назначена ли пользователю роль
+func HasRole(user models.User, name string) bool {
+	return slices.ContainsFunc(user.Roles, func(r models.Role) bool { return r.Name == name })
+}
+
+// PreloadRoles - условие загрузки ролей пользователя с разрешениями
+func PreloadRoles(db *gorm.DB) *gorm.DB {
+	return db.Preload("Roles.Permissions")
+}
+
+// WithPermission - условие выборки пользователей, у которых есть разрешение
+func WithPermission(permission string) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		holders := db.Session(&gorm.Session{NewDB: true}).Table("user_roles").
+			Select("user_roles.user_id").
+			Joins("JOIN role_permissions ON role_permissions.role_id = user_roles.role_id").
+			Joins("JOIN permissions ON permissions.id = role_permissions.permission_id").
+			Where("permissions.code = ?", permission)
+		return db.Where("users.id IN (?)", holders)
+	}
+}
+
+// SetUserRoles заменяет роли пользователя ролями с указанными именами
+func SetUserRoles(db *gorm.DB, user *models.User, names []string) error {
+	var roles []models.Role
+	if len(names) > 0 {
+		if err := db.Where("name IN ?", names).Find(&roles).Error; err != nil {
+			return err
+		}
+	}
+	return db.Model(user).Association("Roles").Replace(roles)
+}
+
+// Seed создает недостающие разрешения и встроенные роли
+func Seed(db *gorm.DB) error {
+	permissions := make(map[string]models.Permission, len(Permissions))
+	for _, p := range Permissions {
+		permission := p
+		if err := db.Where(models.Permission{Code: p.Code}).
+			Assign(models.Permission{Description: p.Description}).
+			FirstOrCreate(&permission).Error; err != nil {
+			return err
+		}
+		permissions[p.Code] = permission
+	}
+
+	for _, def := range defaultRoles {
+		var role models.Role
+		err := db.Where(models.Role{Name: def.Name}).Attrs(models.Role{Title: def.Title}).FirstOrCreate(&role).Error
+		if err != nil {
+			return err
+		}
+
+		codes := def.Permissions
+		if def.Name == RoleAdmin {
+			codes = make([]string, 0, len(Permissions))
+			for _, p := range Permissions {
+				codes = append(codes, p.Code)
+			}
+		} else {
+			// Разрешения уже существующей роли мог изменить администратор
+			count := db.Model(&role).Association("Permissions").Count()
+			if count > 0 {
+				continue
+			}
+		}
+
+		granted := make([]models.Permission, 0, len(codes))
+		for _, code := range codes {
+			granted = append(granted, permissions[code])
+		}
+		if err := db.Model(&role).Association("Permissions").Append(granted); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrateLegacyFlags назначает роли по прежним булевым столбцам users
+// и удаляет эти столбцы. Повторный запуск ничего не делает
+func MigrateLegacyFlags(db *gorm.DB) error {
+	migrator := db.Migrator()
+	for _, flag := range legacyFlags {
+		if !migrator.HasColumn(&models.User{}, flag.Column) {
+			continue
+		}
+
+		var role models.Role
+		if err := db.Where("name = ?", flag.Role).First(&role).Error; err != nil {
+			return err
+		}
+
+		var userIDs []uint
+		if err := db.Table("users").Where(flag.Column+" = ?", true).Pluck("id", &userIDs).Error; err != nil {
+			return err
+		}
+		for _, id := range userIDs {
+			if err := db.Model(&models.User{ID: id}).Association("Roles").Append(&role); err != nil {
+				return err
+			}
+		}
+
+		if err := migrator.DropColumn(&models.User{}, flag.Column); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package router
+
+import (
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"itsm/api/account"
+	"itsm/api/admin"
+	"itsm/api/auth"
+	"itsm/api/dashboard"
+	"itsm/api/incidents"
+	"itsm/api/messenger"
+	"itsm/api/services"
+	"itsm/listener"
+	"itsm/middleware"
+	"itsm/openapi"
+	"net/http"
+	"sync"
+)
+
+// setupMu упорядочивает сборку маршрутизаторов: SetupRoutes пакетов
+// обработчиков сохраняют подключение к базе в переменной пакета
+var setupMu sync.Mutex
+
+// New создает маршрутизатор с обязательными разделами и разделами из списка modules.
+// Маршрутизаторы можно собирать одновременно
+func New(db *gorm.DB, modules []string) *mux.Router {
+	setupMu.Lock()
+	defer setupMu.Unlock()
+
+	r := mux.NewRouter()
+	r.Use(middleware.Authenticate(db))
+	r.Use(middleware.CSRF)
+	auth.SetupRoutes(r, db)
+	dashboard.SetupRoutes(r, db)
+	account.SetupRoutes(r, db)
+
+	for _, module := range modules {
+		switch module {
+		case listener.ModuleServices:
+			services.SetupRoutes(r, db)
+		case listener.ModuleIncidents:
+			incidents.SetupRoutes(r, db)
+		case listener.ModuleMessenger:
+			messenger.SetupRoutes(r, db)
+		case listener.ModuleAdmin:
+			admin.SetupRoutes(r, db)
+		case listener.ModuleAPIDocs:
+			openapi.SetupRoutes(r)
+			middleware.Public(r.Get(openapi.SpecPath))
+		}
+	}
+
+	fs := http.FileServer(http.Dir("./templates"))
+	middleware.Public(r.PathPrefix("/templates/").Handler(http.StripPrefix("/templates/", fs)))
+	return r
+}
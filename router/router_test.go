@@ -0,0 +1,47 @@
+package router
+
+import (
+	"github.com/gorilla/mux"
+	"itsm/listener"
+	"itsm/openapi"
+	"itsm/testenv"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// Слушатели собирают маршрутизаторы одновременно; тест имеет смысл с -race
+func TestNewConcurrently(t *testing.T) {
+	db := testenv.Open(t)
+
+	modules := [][]string{{listener.ModuleAPIDocs}, {listener.ModuleIncidents}}
+	routers := make([]*mux.Router, len(modules))
+	var wg sync.WaitGroup
+	for i := range modules {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			routers[i] = New(db, modules[i])
+		}()
+	}
+	wg.Wait()
+
+	for _, tc := range []struct {
+		router int
+		path   string
+		code   int
+	}{
+		{0, openapi.SpecPath, http.StatusOK},
+		{0, "/api/v1/incidents", http.StatusNotFound},
+		{1, openapi.SpecPath, http.StatusNotFound},
+		// Маршрут API закрыт и отвечает JSON-ошибкой, а не перенаправлением на вход
+		{1, "/api/v1/incidents", http.StatusUnauthorized},
+	} {
+		rec := httptest.NewRecorder()
+		routers[tc.router].ServeHTTP(rec, httptest.NewRequest("GET", tc.path, nil))
+		if rec.Code != tc.code {
+			t.Errorf("router %d: GET %s = %d, want %d", tc.router, tc.path, rec.Code, tc.code)
+		}
+	}
+}
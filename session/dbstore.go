@@ -0,0 +1,187 @@
+package session
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"itsm/audit"
+	"itsm/models"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Длина случайного токена сессии в байтах
+const tokenLength = 32
+
+// Размер поля user_agent
+const maxUserAgent = 255
+
+// dbStore хранит сессии в таблице user_sessions. Удаление строки
+// немедленно завершает сессию
+type dbStore struct {
+	db      *gorm.DB
+	codecs  []securecookie.Codec
+	options *sessions.Options
+}
+
+func newDBStore(db *gorm.DB, pairs [][]byte, options *sessions.Options) *dbStore {
+	return &dbStore{db: db, codecs: codecs(pairs, options.MaxAge), options: options}
+}
+
+func (s *dbStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New загружает сессию по токену из cookie. Неизвестный или истекший токен
+// дает новую пустую сессию
+func (s *dbStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	options := *s.options
+	session.Options = &options
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	var token string
+	if err := securecookie.DecodeMulti(name, cookie.Value, &token, s.codecs...); err != nil {
+		return session, err
+	}
+
+	var record models.UserSession
+	err = s.db.Where("token_hash = ? AND expires_at > ?", hashToken(token), time.Now()).First(&record).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return session, nil
+		}
+		return session, err
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(record.Data)).Decode(&session.Values); err != nil {
+		return session, err
+	}
+	session.ID = token
+	session.IsNew = false
+	return session, nil
+}
+
+// Save сохраняет данные сессии в базе и отправляет cookie с токеном.
+// Отрицательный MaxAge удаляет сессию
+func (s *dbStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.db.Where("token_hash = ?", hashToken(session.ID)).Delete(&models.UserSession{}).Error; err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		token, err := newToken()
+		if err != nil {
+			return err
+		}
+		session.ID = token
+	}
+
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(session.Values); err != nil {
+		return err
+	}
+
+	record := models.UserSession{
+		TokenHash: hashToken(session.ID),
+		Data:      data.Bytes(),
+		IP:        audit.ClientIP(r),
+		UserAgent: truncate(r.UserAgent(), maxUserAgent),
+		ExpiresAt: time.Now().Add(time.Duration(session.Options.MaxAge) * time.Second),
+	}
+	if userID, ok := session.Values["userID"].(uint); ok {
+		record.UserID = &userID
+	}
+
+	err := s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "token_hash"}},
+		DoUpdates: clause.AssignmentColumns([]string{"user_id", "data", "ip", "user_agent", "updated_at", "expires_at"}),
+	}).Create(&record).Error
+	if err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+func newToken() (string, error) {
+	buf := make([]byte, tokenLength)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
+
+// ListUserSessions возвращает действующие сессии пользователя, новые первыми
+func ListUserSessions(db *gorm.DB, userID uint) ([]models.UserSession, error) {
+	var list []models.UserSession
+	err := db.Where("user_id = ? AND expires_at > ?", userID, time.Now()).
+		Order("updated_at DESC").Find(&list).Error
+	return list, err
+}
+
+// RevokeUserSession завершает сессию пользователя по ID записи.
+// false - сессия не найдена
+func RevokeUserSession(db *gorm.DB, userID, sessionID uint) (bool, error) {
+	result := db.Where("id = ? AND user_id = ?", sessionID, userID).Delete(&models.UserSession{})
+	return result.RowsAffected > 0, result.Error
+}
+
+// RevokeUserSessions завершает все сессии пользователя и возвращает их число
+func RevokeUserSessions(db *gorm.DB, userID uint) (int64, error) {
+	result := db.Where("user_id = ?", userID).Delete(&models.UserSession{})
+	return result.RowsAffected, result.Error
+}
+
+// RevokeOtherSessions завершает все сессии пользователя, кроме сессии с токеном current
+func RevokeOtherSessions(db *gorm.DB, userID uint, current string) error {
+	return db.Where("user_id = ? AND token_hash <> ?", userID, hashToken(current)).
+		Delete(&models.UserSession{}).Error
+}
+
+// PurgeExpired периодически удаляет истекшие сессии из базы
+func PurgeExpired(db *gorm.DB, interval time.Duration) {
+	for {
+		if err := db.Where("expires_at <= ?", time.Now()).Delete(&models.UserSession{}).Error; err != nil {
+			log.Println("Ошибка при удалении истекших сессий:", err)
+		}
+		time.Sleep(interval)
+	}
+}
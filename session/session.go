@@ -1,7 +1,170 @@
 package session
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
+	"gorm.io/gorm"
+	"net/http"
+	"strings"
 )
 
-var Store = sessions.NewCookieStore([]byte("secret-key"))
+// Хранилище сессий. Ключи подписи и шифрования задаются в конфигурации списком
+// секретов: первым подписываются новые cookie, остальные принимаются при чтении.
+// Для смены ключа новый секрет добавляется в начало списка, а старый удаляется,
+// когда истекут выданные им сессии
+
+// Виды хранилища
+const (
+	BackendCookie = "cookie" // данные сессии в зашифрованной cookie
+	BackendDB     = "db"     // данные в таблице user_sessions, в cookie - только токен
+)
+
+// MinKeyLength - минимальная длина секрета
+const MinKeyLength = 32
+
+// Store - хранилище сессий, настраивается через Configure
+var Store sessions.Store
+
+// backend - выбранный вид хранилища
+var backend string
+
+// defaultSecure - флаг Secure cookie, если слушатель не задал свой
+var defaultSecure bool
+
+// Config - настройки сессий
+type Config struct {
+	Keys    []string // секреты, текущий - первый
+	Backend string   // BackendCookie или BackendDB
+	MaxAge  int      // время жизни сессии в секундах
+	Secure  bool     // передавать cookie только по HTTPS, если слушатель не задал иное
+}
+
+// ParseKeys разбирает список секретов через запятую
+func ParseKeys(value string) ([]string, error) {
+	var keys []string
+	for _, key := range strings.Split(value, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		if len(key) < MinKeyLength {
+			return nil, fmt.Errorf("секрет сессий короче %d символов", MinKeyLength)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("не задан ни один секрет сессий")
+	}
+	return keys, nil
+}
+
+// Configure создает хранилище сессий по настройкам
+func Configure(database *gorm.DB, cfg Config) error {
+	if len(cfg.Keys) == 0 {
+		return errors.New("не задан ни один секрет сессий")
+	}
+
+	options := &sessions.Options{
+		Path:     "/",
+		MaxAge:   cfg.MaxAge,
+		Secure:   cfg.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	pairs := keyPairs(cfg.Keys)
+
+	switch cfg.Backend {
+	case BackendCookie:
+		store := sessions.NewCookieStore(pairs...)
+		store.Options = options
+		store.MaxAge(cfg.MaxAge)
+		Store = store
+	case BackendDB:
+		Store = newDBStore(database, pairs, options)
+	default:
+		return fmt.Errorf("неизвестное хранилище сессий %q", cfg.Backend)
+	}
+	backend = cfg.Backend
+	defaultSecure = cfg.Secure
+	return nil
+}
+
+// Cookie - параметры cookie сессии. Каждый слушатель выдает свою cookie,
+// поэтому вход через один слушатель не открывает сессию на другом
+type Cookie struct {
+	Name   string
+	Domain string
+	Path   string
+	Secure bool
+}
+
+// DefaultCookieName - имя cookie для запросов вне слушателя
+const DefaultCookieName = "session"
+
+type contextKey struct{}
+
+var cookieKey contextKey
+
+// WithCookie задает cookie сессии для запросов с контекстом ctx
+func WithCookie(ctx context.Context, cookie Cookie) context.Context {
+	return context.WithValue(ctx, cookieKey, cookie)
+}
+
+// CurrentCookie возвращает параметры cookie сессии слушателя, принявшего запрос
+func CurrentCookie(r *http.Request) Cookie {
+	cookie, ok := r.Context().Value(cookieKey).(Cookie)
+	if !ok {
+		cookie = Cookie{Name: DefaultCookieName, Path: "/", Secure: defaultSecure}
+	}
+	return cookie
+}
+
+// Get возвращает сессию запроса из cookie слушателя. Если cookie не удалось
+// прочитать, например после смены ключей, вместе с ошибкой возвращается новая
+// пустая сессия
+func Get(r *http.Request) (*sessions.Session, error) {
+	cookie := CurrentCookie(r)
+	s, err := Store.Get(r, cookie.Name)
+	if s != nil {
+		// Срок жизни не меняется: при выходе его уже могли сделать отрицательным
+		s.Options.Domain = cookie.Domain
+		s.Options.Path = cookie.Path
+		s.Options.Secure = cookie.Secure
+	}
+	return s, err
+}
+
+// Revocable сообщает, можно ли просматривать и отзывать сессии на сервере
+func Revocable() bool {
+	return backend == BackendDB
+}
+
+// keyPairs получает из каждого секрета ключ подписи и ключ шифрования AES-256
+func keyPairs(keys []string) [][]byte {
+	pairs := make([][]byte, 0, len(keys)*2)
+	for _, key := range keys {
+		hashKey := hmac.New(sha512.New, []byte(key))
+		hashKey.Write([]byte("session hash key"))
+		blockKey := hmac.New(sha256.New, []byte(key))
+		blockKey.Write([]byte("session block key"))
+		pairs = append(pairs, hashKey.Sum(nil), blockKey.Sum(nil))
+	}
+	return pairs
+}
+
+// codecs создает кодеки cookie с тем же сроком действия, что и у сессии
+func codecs(pairs [][]byte, maxAge int) []securecookie.Codec {
+	result := securecookie.CodecsFromPairs(pairs...)
+	for _, codec := range result {
+		if cookie, ok := codec.(*securecookie.SecureCookie); ok {
+			cookie.MaxAge(maxAge)
+		}
+	}
+	return result
+}
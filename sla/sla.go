@@ -0,0 +1,367 @@
+package sla
+
+import (
+	"fmt"
+	"gorm.io/gorm"
+	"itsm/calendar"
+	"itsm/models"
+	"sort"
+	"time"
+)
+
+// NearBreachRatio - доля оставшегося времени, при которой срок считается близким к нарушению
+const NearBreachRatio = 0.2
+
+// Состояния таймера для вывода в шаблонах
+const (
+	StateOK       = "ok"
+	StateNear     = "near"
+	StateBreached = "breached"
+	StatePaused   = "paused"
+	StateMet      = "met"
+)
+
+// DefaultPolicies - политики по умолчанию для всех услуг, по приоритетам P1-P5
+var DefaultPolicies = []models.SLAPolicy{
+	{Priority: 1, ResponseMinutes: 15, ResolutionMinutes: 4 * 60},
+	{Priority: 2, ResponseMinutes: 30, ResolutionMinutes: 8 * 60},
+	{Priority: 3, ResponseMinutes: 2 * 60, ResolutionMinutes: 24 * 60},
+	{Priority: 4, ResponseMinutes: 4 * 60, ResolutionMinutes: 72 * 60},
+	{Priority: 5, ResponseMinutes: 8 * 60, ResolutionMinutes: 120 * 60},
+}
+
+// fallbackPolicy применяется, если в базе нет ни одной подходящей политики
+var fallbackPolicy = models.SLAPolicy{ResponseMinutes: 8 * 60, ResolutionMinutes: 120 * 60}
+
+// Timer - состояние одного таймера SLA (реакции или решения)
+type Timer struct {
+	Target    time.Duration
+	Elapsed   time.Duration
+	Remaining time.Duration
+	DueAt     *time.Time // nil, если таймер остановлен или приостановлен
+	Stopped   bool
+	Paused    bool
+	Breached  bool
+}
+
+// State возвращает состояние таймера: ok, near, breached, paused или met
+func (t Timer) State() string {
+	switch {
+	case t.Breached:
+		return StateBreached
+	case t.Stopped:
+		return StateMet
+	case t.Paused:
+		return StatePaused
+	case float64(t.Remaining) < float64(t.Target)*NearBreachRatio:
+		return StateNear
+	default:
+		return StateOK
+	}
+}
+
+// RemainingText - оставшееся (или просроченное) время в виде "1ч 20м"
+func (t Timer) RemainingText() string {
+	if t.Stopped {
+		return "-"
+	}
+	if t.Remaining < 0 {
+		return "просрочено на " + formatDuration(-t.Remaining)
+	}
+	return formatDuration(t.Remaining)
+}
+
+// Status - состояние SLA инцидента
+type Status struct {
+	Response   Timer
+	Resolution Timer
+}
+
+// Breached сообщает, нарушен ли хотя бы один из сроков
+func (s Status) Breached() bool {
+	return s.Response.Breached || s.Resolution.Breached
+}
+
+// NearBreach сообщает, близок ли к нарушению хотя бы один из сроков
+func (s Status) NearBreach() bool {
+	return s.Response.State() == StateNear || s.Resolution.State() == StateNear
+}
+
+// State - наиболее критичное состояние из двух таймеров
+func (s Status) State() string {
+	if s.Breached() {
+		return StateBreached
+	}
+	if s.NearBreach() {
+		return StateNear
+	}
+	if !s.Resolution.Stopped && !s.Response.Stopped {
+		return s.Response.State()
+	}
+	return s.Resolution.State()
+}
+
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	days := int(d.Hours()) / 24
+	hours := int(d.Hours()) % 24
+	minutes := int(d.Minutes()) % 60
+
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dд %dч", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dч %dм", hours, minutes)
+	default:
+		return fmt.Sprintf("%dм", minutes)
+	}
+}
+
+// responseRunning - статусы, в которых идет таймер реакции
+func responseRunning(status string) bool {
+	return status == models.StatusNew
+}
+
+// resolutionRunning - статусы, в которых идет таймер решения
+func resolutionRunning(status string) bool {
+	switch status {
+	case models.StatusNew, models.StatusAssigned, models.StatusInProgress, models.StatusReopened:
+		return true
+	}
+	return false
+}
+
+func resolutionStopped(status string) bool {
+	switch status {
+	case models.StatusResolved, models.StatusClosed, models.StatusCancelled:
+		return true
+	}
+	return false
+}
+
+// segment - интервал времени, в течение которого инцидент находился в одном статусе
+type segment struct {
+	status   string
+	from, to time.Time
+}
+
+func buildSegments(incident *models.Incident, history []models.IncidentStatusChange, now time.Time) []segment {
+	// Для инцидентов без истории считаем, что статус сменился при последнем обновлении
+	if len(history) == 0 && incident.Status != models.StatusNew {
+		history = []models.IncidentStatusChange{{
+			FromStatus: models.StatusNew,
+			ToStatus:   incident.Status,
+			CreatedAt:  incident.UpdatedAt,
+		}}
+	}
+
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].CreatedAt.Before(history[j].CreatedAt)
+	})
+
+	var segments []segment
+	status, from := models.StatusNew, incident.CreatedAt
+	for _, change := range history {
+		segments = append(segments, segment{status, from, change.CreatedAt})
+		status, from = change.ToStatus, change.CreatedAt
+	}
+	return append(segments, segment{status, from, now})
+}
+
+// Evaluate вычисляет состояние SLA инцидента по истории статусов на момент now.
+// Таймер реакции идет, пока инцидент в статусе "Новый", таймер решения
+// приостанавливается в статусе "Приостановлен" и останавливается после решения.
+// Учитывается только рабочее время по календарю schedule
+func Evaluate(incident *models.Incident, history []models.IncidentStatusChange,
+	policy models.SLAPolicy, schedule *calendar.Schedule, now time.Time) Status {
+	segments := buildSegments(incident, history, now)
+	last := segments[len(segments)-1]
+
+	response := Timer{Target: time.Duration(policy.ResponseMinutes) * time.Minute}
+	for _, s := range segments {
+		if !responseRunning(s.status) {
+			response.Stopped = true
+			break
+		}
+		response.Elapsed += schedule.BusinessDuration(s.from, s.to)
+	}
+
+	resolution := Timer{Target: time.Duration(policy.ResolutionMinutes) * time.Minute}
+	for _, s := range segments {
+		if resolutionRunning(s.status) {
+			resolution.Elapsed += schedule.BusinessDuration(s.from, s.to)
+		}
+	}
+	resolution.Stopped = resolutionStopped(last.status)
+	resolution.Paused = last.status == models.StatusOnHold
+
+	for _, t := range []*Timer{&response, &resolution} {
+		t.Remaining = t.Target - t.Elapsed
+		t.Breached = t.Remaining < 0
+		if !t.Stopped && !t.Paused {
+			due := schedule.AddBusinessDuration(now, t.Remaining)
+			t.DueAt = &due
+		}
+	}
+
+	return Status{Response: response, Resolution: resolution}
+}
+
+// SelectPolicy выбирает наиболее специфичную политику для услуг и приоритета инцидента:
+// совпадение по услуге важнее совпадения по приоритету. Среди равных выбирается самая строгая
+func SelectPolicy(policies []models.SLAPolicy, serviceIDs []uint, priority int) models.SLAPolicy {
+	best, bestScore := fallbackPolicy, -1
+	for _, p := range policies {
+		score := 0
+		if p.ServiceID != nil {
+			if !containsID(serviceIDs, *p.ServiceID) {
+				continue
+			}
+			score += 2
+		}
+		if p.Priority != 0 {
+			if p.Priority != priority {
+				continue
+			}
+			score++
+		}
+
+		if score > bestScore || (score == bestScore && p.ResolutionMinutes < best.ResolutionMinutes) {
+			best, bestScore = p, score
+		}
+	}
+	return best
+}
+
+func containsID(ids []uint, id uint) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// SeedDefaultPolicies создает политики по умолчанию, если таблица политик пуста
+func SeedDefaultPolicies(db *gorm.DB) error {
+	var count int64
+	if err := db.Model(&models.SLAPolicy{}).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	policies := make([]models.SLAPolicy, len(DefaultPolicies))
+	copy(policies, DefaultPolicies)
+	return db.Create(&policies).Error
+}
+
+// EvaluateMany вычисляет состояние SLA для списка инцидентов, загружая
+// историю, услуги и политики одним запросом на каждую таблицу
+func EvaluateMany(db *gorm.DB, incidents []models.Incident, now time.Time) (map[uint]Status, error) {
+	result := make(map[uint]Status, len(incidents))
+	if len(incidents) == 0 {
+		return result, nil
+	}
+
+	ids := make([]uint, len(incidents))
+	for i, incident := range incidents {
+		ids[i] = incident.ID
+	}
+
+	var policies []models.SLAPolicy
+	if err := db.Find(&policies).Error; err != nil {
+		return nil, err
+	}
+
+	schedules, err := calendar.LoadAll(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var history []models.IncidentStatusChange
+	if err := db.Where("incident_id IN ?", ids).Order("created_at").Find(&history).Error; err != nil {
+		return nil, err
+	}
+	historyByIncident := make(map[uint][]models.IncidentStatusChange)
+	for _, change := range history {
+		historyByIncident[change.IncidentID] = append(historyByIncident[change.IncidentID], change)
+	}
+
+	var links []struct {
+		IncidentID uint
+		ServiceID  uint
+	}
+	if err := db.Table("incident_services").Where("incident_id IN ?", ids).Scan(&links).Error; err != nil {
+		return nil, err
+	}
+	servicesByIncident := make(map[uint][]uint)
+	for _, link := range links {
+		servicesByIncident[link.IncidentID] = append(servicesByIncident[link.IncidentID], link.ServiceID)
+	}
+
+	for i := range incidents {
+		incident := &incidents[i]
+		policy := SelectPolicy(policies, servicesByIncident[incident.ID], incident.Priority)
+		schedule := schedules[0]
+		if policy.CalendarID != nil && schedules[*policy.CalendarID] != nil {
+			schedule = schedules[*policy.CalendarID]
+		}
+		result[incident.ID] = Evaluate(incident, historyByIncident[incident.ID], policy, schedule, now)
+	}
+
+	return result, nil
+}
+
+// Refresh пересчитывает SLA инцидента и сохраняет сроки и признак нарушения,
+// по которым нарушения можно искать запросами к базе
+func Refresh(db *gorm.DB, incident *models.Incident) error {
+	now := time.Now()
+	statuses, err := EvaluateMany(db, []models.Incident{*incident}, now)
+	if err != nil {
+		return err
+	}
+	status := statuses[incident.ID]
+
+	respondedAt := incident.RespondedAt
+	if status.Response.Stopped && respondedAt == nil {
+		respondedAt = &now
+	}
+	var resolvedAt *time.Time
+	if status.Resolution.Stopped {
+		resolvedAt = incident.ResolvedAt
+		if resolvedAt == nil {
+			resolvedAt = &now
+		}
+	}
+
+	// Срок реакции после ответа не меняется, поэтому сохраняем рассчитанный ранее
+	responseDueAt := status.Response.DueAt
+	if status.Response.Stopped {
+		responseDueAt = incident.ResponseDueAt
+	}
+
+	incident.RespondedAt = respondedAt
+	incident.ResolvedAt = resolvedAt
+	incident.ResponseDueAt = responseDueAt
+	incident.ResolutionDueAt = status.Resolution.DueAt
+	incident.SLABreached = status.Breached()
+
+	return db.Model(incident).UpdateColumns(map[string]interface{}{
+		"responded_at":      incident.RespondedAt,
+		"resolved_at":       incident.ResolvedAt,
+		"response_due_at":   incident.ResponseDueAt,
+		"resolution_due_at": incident.ResolutionDueAt,
+		"sla_breached":      incident.SLABreached,
+	}).Error
+}
+
+// Breached - условие выборки инцидентов с нарушенным SLA на момент now
+func Breached(now time.Time) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("incidents.sla_breached = ? "+
+			"OR (incidents.responded_at IS NULL AND incidents.response_due_at < ?) "+
+			"OR (incidents.resolved_at IS NULL AND incidents.resolution_due_at < ?)", true, now, now)
+	}
+}
@@ -0,0 +1,195 @@
+package sla
+
+import (
+	"itsm/calendar"
+	"itsm/models"
+	"itsm/testenv"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2024, time.March, 4, 10, 0, 0, 0, time.UTC)
+
+// at - момент через minutes минут после создания инцидента
+func at(minutes int) time.Time {
+	return start.Add(time.Duration(minutes) * time.Minute)
+}
+
+// history - смены статусов; каждая пара - минута после создания и новый статус
+func history(changes ...interface{}) []models.IncidentStatusChange {
+	var result []models.IncidentStatusChange
+	from := models.StatusNew
+	for i := 0; i < len(changes); i += 2 {
+		to := changes[i+1].(string)
+		result = append(result, models.IncidentStatusChange{FromStatus: from, ToStatus: to, CreatedAt: at(changes[i].(int))})
+		from = to
+	}
+	return result
+}
+
+func TestEvaluate(t *testing.T) {
+	policy := models.SLAPolicy{ResponseMinutes: 15, ResolutionMinutes: 60}
+
+	for _, tc := range []struct {
+		name       string
+		status     string
+		history    []models.IncidentStatusChange
+		now        int
+		response   Timer
+		resolution Timer
+		state      string
+	}{
+		{
+			name:       "response running",
+			status:     models.StatusNew,
+			now:        10,
+			response:   Timer{Elapsed: 10 * time.Minute, Remaining: 5 * time.Minute},
+			resolution: Timer{Elapsed: 10 * time.Minute, Remaining: 50 * time.Minute},
+			state:      StateOK,
+		},
+		{
+			name:       "response breached",
+			status:     models.StatusNew,
+			now:        30,
+			response:   Timer{Elapsed: 30 * time.Minute, Remaining: -15 * time.Minute, Breached: true},
+			resolution: Timer{Elapsed: 30 * time.Minute, Remaining: 30 * time.Minute},
+			state:      StateBreached,
+		},
+		{
+			name:       "response met",
+			status:     models.StatusAssigned,
+			history:    history(10, models.StatusAssigned),
+			now:        30,
+			response:   Timer{Elapsed: 10 * time.Minute, Remaining: 5 * time.Minute, Stopped: true},
+			resolution: Timer{Elapsed: 30 * time.Minute, Remaining: 30 * time.Minute},
+			state:      StateOK,
+		},
+		{
+			// Время в статусе "Приостановлен" не входит в срок решения
+			name:       "paused",
+			status:     models.StatusOnHold,
+			history:    history(10, models.StatusInProgress, 20, models.StatusOnHold),
+			now:        200,
+			response:   Timer{Elapsed: 10 * time.Minute, Remaining: 5 * time.Minute, Stopped: true},
+			resolution: Timer{Elapsed: 20 * time.Minute, Remaining: 40 * time.Minute, Paused: true},
+			state:      StatePaused,
+		},
+		{
+			name:       "resumed after pause",
+			status:     models.StatusInProgress,
+			history:    history(10, models.StatusInProgress, 20, models.StatusOnHold, 200, models.StatusInProgress),
+			now:        250,
+			response:   Timer{Elapsed: 10 * time.Minute, Remaining: 5 * time.Minute, Stopped: true},
+			resolution: Timer{Elapsed: 70 * time.Minute, Remaining: -10 * time.Minute, Breached: true},
+			state:      StateBreached,
+		},
+		{
+			name:       "resolved",
+			status:     models.StatusResolved,
+			history:    history(10, models.StatusInProgress, 30, models.StatusResolved),
+			now:        500,
+			response:   Timer{Elapsed: 10 * time.Minute, Remaining: 5 * time.Minute, Stopped: true},
+			resolution: Timer{Elapsed: 30 * time.Minute, Remaining: 30 * time.Minute, Stopped: true},
+			state:      StateMet,
+		},
+		{
+			// После переоткрытия срок решения продолжается с учетом времени до решения
+			name:       "reopened",
+			status:     models.StatusReopened,
+			history:    history(10, models.StatusInProgress, 30, models.StatusResolved, 90, models.StatusReopened),
+			now:        100,
+			response:   Timer{Elapsed: 10 * time.Minute, Remaining: 5 * time.Minute, Stopped: true},
+			resolution: Timer{Elapsed: 40 * time.Minute, Remaining: 20 * time.Minute},
+			state:      StateOK,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			incident := &models.Incident{Status: tc.status, CreatedAt: start, UpdatedAt: start}
+			status := Evaluate(incident, tc.history, policy, calendar.AlwaysOpen, at(tc.now))
+
+			for _, timer := range []struct {
+				name      string
+				got, want Timer
+			}{{"response", status.Response, tc.response}, {"resolution", status.Resolution, tc.resolution}} {
+				got, want := timer.got, timer.want
+				if got.Elapsed != want.Elapsed || got.Remaining != want.Remaining || got.Stopped != want.Stopped ||
+					got.Paused != want.Paused || got.Breached != want.Breached {
+					t.Errorf("%s = %+v, want %+v", timer.name, got, want)
+				}
+				if running := !got.Stopped && !got.Paused; running != (got.DueAt != nil) {
+					t.Errorf("%s due at %v, running %v", timer.name, got.DueAt, running)
+				} else if running && !got.DueAt.Equal(at(tc.now).Add(got.Remaining)) {
+					t.Errorf("%s due at %v, want %v", timer.name, got.DueAt, at(tc.now).Add(got.Remaining))
+				}
+			}
+			if state := status.State(); state != tc.state {
+				t.Errorf("state = %s, want %s", state, tc.state)
+			}
+		})
+	}
+}
+
+func TestSelectPolicy(t *testing.T) {
+	service, other := uint(1), uint(2)
+	policies := []models.SLAPolicy{
+		{ID: 1, Priority: 2, ResponseMinutes: 30, ResolutionMinutes: 60},
+		{ID: 2, ServiceID: &service, ResponseMinutes: 60, ResolutionMinutes: 600},
+		{ID: 3, ServiceID: &service, Priority: 1, ResponseMinutes: 5, ResolutionMinutes: 120},
+		{ID: 4, ServiceID: &other, ResponseMinutes: 60, ResolutionMinutes: 300},
+		{ID: 5, Priority: 3, ResponseMinutes: 60, ResolutionMinutes: 480},
+		{ID: 6, Priority: 3, ResponseMinutes: 60, ResolutionMinutes: 240},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		services []uint
+		priority int
+		want     uint
+	}{
+		{"service wins over priority", []uint{service}, 2, 2},
+		{"service and priority", []uint{service}, 1, 3},
+		{"priority only", nil, 2, 1},
+		{"strictest of equal", nil, 3, 6},
+		{"strictest of two services", []uint{service, other}, 2, 4},
+		{"fallback", []uint{3}, 5, 0},
+	} {
+		if got := SelectPolicy(policies, tc.services, tc.priority); got.ID != tc.want {
+			t.Errorf("%s: policy %d, want %d", tc.name, got.ID, tc.want)
+		}
+	}
+}
+
+func TestRefreshStoresBreach(t *testing.T) {
+	db := testenv.Open(t)
+	if err := SeedDefaultPolicies(db); err != nil {
+		t.Fatal(err)
+	}
+	user := testenv.User(t, db, "ivanov")
+
+	// Срок реакции P1 - 15 минут, инцидент ждет ответа час
+	created := time.Now().Add(-time.Hour)
+	incident := models.Incident{Title: "Почта", Status: models.StatusNew, UserID: user.ID, Priority: 1,
+		CreatedAt: created, UpdatedAt: created}
+	if err := db.Create(&incident).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Refresh(db, &incident); err != nil {
+		t.Fatal(err)
+	}
+	var stored models.Incident
+	if err := db.First(&stored, incident.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !stored.SLABreached || stored.ResponseDueAt == nil || stored.RespondedAt != nil {
+		t.Errorf("stored incident = %+v", stored)
+	}
+
+	var breached []models.Incident
+	if err := db.Scopes(Breached(time.Now())).Find(&breached).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(breached) != 1 || breached[0].ID != incident.ID {
+		t.Errorf("breached incidents = %v, want [%d]", breached, incident.ID)
+	}
+}
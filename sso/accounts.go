@@ -0,0 +1,109 @@
+package sso
+
+import (
+	"errors"
+	"gorm.io/gorm"
+	"itsm/audit"
+	"itsm/authn"
+	"itsm/models"
+	"itsm/rbac"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// LoginError - причина отказа во входе, о которой сообщается пользователю
+type LoginError struct {
+	Message string
+}
+
+func (e *LoginError) Error() string {
+	return e.Message
+}
+
+// Resolve находит пользователя, вошедшего через провайдера, и обновляет его роли.
+// Учетная запись провайдера ищется по subject. При первом входе она привязывается
+// к пользователю с тем же подтвержденным адресом почты, если это разрешено
+// настройками, иначе создается новый пользователь
+func (p *Provider) Resolve(db *gorm.DB, r *http.Request, claims Claims) (models.User, error) {
+	var user models.User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var identity models.UserIdentity
+		err := tx.Where("provider = ? AND subject = ?", p.config.Name, claims.Subject).First(&identity).Error
+		switch {
+		case err == nil:
+			if err := rbac.PreloadRoles(tx).First(&user, identity.UserID).Error; err != nil {
+				return err
+			}
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			if user, err = p.link(tx, r, claims); err != nil {
+				return err
+			}
+			identity = models.UserIdentity{Provider: p.config.Name, Subject: claims.Subject, UserID: user.ID}
+		default:
+			return err
+		}
+
+		identity.Email = claims.Email
+		identity.LastLoginAt = time.Now()
+		if err := tx.Save(&identity).Error; err != nil {
+			return err
+		}
+		return authn.SyncRoles(tx, r, &user, p.ManagedRoles(), claims.Roles, "провайдера "+p.config.Name)
+	})
+	return user, err
+}
+
+// link выбирает пользователя для новой учетной записи провайдера
+func (p *Provider) link(tx *gorm.DB, r *http.Request, claims Claims) (models.User, error) {
+	var user models.User
+	if p.config.LinkByEmail && claims.Email != "" && claims.EmailVerified {
+		err := rbac.PreloadRoles(tx).Where("email = ?", claims.Email).First(&user).Error
+		if err == nil {
+			return user, audit.Record(tx, r, audit.Event{
+				Action:   audit.ActionUserIdentityLink,
+				TargetID: user.ID,
+				Details:  "Провайдер " + p.config.Name + ", адрес " + claims.Email,
+			})
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return user, err
+		}
+	}
+	return p.create(tx, r, claims)
+}
+
+// create создает пользователя при первом входе. Занятый логин не привязывается
+// автоматически: иначе учетная запись у провайдера дала бы доступ к чужой
+func (p *Provider) create(tx *gorm.DB, r *http.Request, claims Claims) (models.User, error) {
+	username := strings.TrimSpace(claims.Username)
+	if username == "" {
+		return models.User{}, &LoginError{"Провайдер не передал логин пользователя. Обратитесь к администратору"}
+	}
+
+	var count int64
+	if err := tx.Model(&models.User{}).Where("username = ?", username).Count(&count).Error; err != nil {
+		return models.User{}, err
+	}
+	if count > 0 {
+		return models.User{}, &LoginError{"Логин " + username + " уже занят другим пользователем. Обратитесь к администратору"}
+	}
+
+	user := models.User{Username: username, AuthSource: authn.SourceOIDC}
+	if claims.Email != "" && claims.EmailVerified {
+		if err := tx.Model(&models.User{}).Where("email = ?", claims.Email).Count(&count).Error; err != nil {
+			return user, err
+		}
+		if count == 0 {
+			user.Email = &claims.Email
+		}
+	}
+	if err := tx.Create(&user).Error; err != nil {
+		return user, err
+	}
+	return user, audit.Record(tx, r, audit.Event{
+		Action:   audit.ActionUserCreate,
+		TargetID: user.ID,
+		Details:  "Первый вход через провайдер " + p.config.Name,
+	})
+}
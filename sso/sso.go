@@ -0,0 +1,286 @@
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Единый вход через провайдеров OpenID Connect по коду авторизации с PKCE.
+// Настройки провайдера загружаются по адресу издателя (discovery) при первом
+// входе, чтобы недоступный провайдер не мешал запуску системы
+
+// Время ожидания ответа провайдера
+const requestTimeout = 10 * time.Second
+
+// Config - настройки одного провайдера
+type Config struct {
+	Name          string // идентификатор в адресах /login/sso/{name}
+	Title         string // надпись на кнопке входа
+	Issuer        string
+	ClientID      string
+	ClientSecret  string
+	RedirectURL   string
+	Scopes        []string
+	UsernameClaim string // логин нового пользователя, например preferred_username
+	EmailClaim    string
+	RolesClaim    string              // claim со списком групп или ролей; вложенные через точку: realm_access.roles
+	ClaimRoles    map[string][]string // роль - значения RolesClaim, дающие ее
+	LinkByEmail   bool                // привязывать к пользователю с тем же подтвержденным адресом
+}
+
+// DefaultConfig - значения по умолчанию
+var DefaultConfig = Config{
+	Scopes:        []string{oidc.ScopeOpenID, "profile", "email"},
+	UsernameClaim: "preferred_username",
+	EmailClaim:    "email",
+}
+
+// Provider - провайдер единого входа
+type Provider struct {
+	config Config
+	client *http.Client
+
+	mu       sync.Mutex
+	oauth    *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+var providers []*Provider
+
+// Configure задает провайдеров в порядке вывода на странице входа
+func Configure(configs ...Config) {
+	providers = nil
+	for _, config := range configs {
+		providers = append(providers, &Provider{config: config, client: &http.Client{Timeout: requestTimeout}})
+	}
+}
+
+// Providers возвращает настроенных провайдеров
+func Providers() []*Provider {
+	return providers
+}
+
+// Find возвращает провайдера по имени
+func Find(name string) (*Provider, bool) {
+	for _, p := range providers {
+		if p.config.Name == name {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+func (p *Provider) Name() string {
+	return p.config.Name
+}
+
+func (p *Provider) Title() string {
+	return p.config.Title
+}
+
+// ManagedRoles - роли, которые назначаются по данным провайдера
+func (p *Provider) ManagedRoles() []string {
+	roles := make([]string, 0, len(p.config.ClaimRoles))
+	for role := range p.config.ClaimRoles {
+		roles = append(roles, role)
+	}
+	return roles
+}
+
+// Validate проверяет обязательные параметры
+func (c Config) Validate() error {
+	if c.Name == "" || c.Issuer == "" || c.ClientID == "" || c.RedirectURL == "" {
+		return errors.New("не указаны имя, издатель, ID клиента или адрес возврата")
+	}
+	if c.UsernameClaim == "" {
+		return errors.New("не указан claim с логином")
+	}
+	if len(c.ClaimRoles) > 0 && c.RolesClaim == "" {
+		return errors.New("для сопоставления ролей нужен claim с группами")
+	}
+	return nil
+}
+
+func (p *Provider) context(ctx context.Context) context.Context {
+	ctx = oidc.ClientContext(ctx, p.client)
+	return context.WithValue(ctx, oauth2.HTTPClient, p.client)
+}
+
+// discover загружает настройки провайдера. Удачный результат запоминается,
+// неудачный - повторяется при следующем входе
+func (p *Provider) discover(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.oauth != nil {
+		return p.oauth, p.verifier, nil
+	}
+
+	provider, err := oidc.NewProvider(p.context(ctx), p.config.Issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("discovery провайдера %s: %w", p.config.Name, err)
+	}
+	p.oauth = &oauth2.Config{
+		ClientID:     p.config.ClientID,
+		ClientSecret: p.config.ClientSecret,
+		RedirectURL:  p.config.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       p.config.Scopes,
+	}
+	p.verifier = provider.Verifier(&oidc.Config{ClientID: p.config.ClientID})
+	return p.oauth, p.verifier, nil
+}
+
+// Request - параметры запроса авторизации, которые хранятся в сессии
+// до возврата пользователя от провайдера
+type Request struct {
+	State       string
+	Nonce       string
+	Verifier    string
+	RedirectURL string
+}
+
+// AuthURL возвращает адрес страницы входа провайдера. redirectURL - адрес
+// возврата слушателя, через который начат вход; пусто - адрес из настроек.
+// Все адреса возврата должны быть зарегистрированы у провайдера
+func (p *Provider) AuthURL(ctx context.Context, redirectURL string) (string, Request, error) {
+	config, _, err := p.discover(ctx)
+	if err != nil {
+		return "", Request{}, err
+	}
+
+	req := Request{RedirectURL: redirectURL}
+	if req.RedirectURL == "" {
+		req.RedirectURL = config.RedirectURL
+	}
+	if req.State, err = randomString(); err != nil {
+		return "", req, err
+	}
+	if req.Nonce, err = randomString(); err != nil {
+		return "", req, err
+	}
+	req.Verifier = oauth2.GenerateVerifier()
+
+	url := config.AuthCodeURL(req.State, oidc.Nonce(req.Nonce), oauth2.S256ChallengeOption(req.Verifier),
+		oauth2.SetAuthURLParam("redirect_uri", req.RedirectURL))
+	return url, req, nil
+}
+
+// Claims - данные пользователя из проверенного ID-токена
+type Claims struct {
+	Subject       string
+	Username      string
+	Email         string
+	EmailVerified bool
+	Roles         []string // роли, сопоставленные значениям RolesClaim
+}
+
+// Exchange обменивает код авторизации на токены и проверяет ID-токен:
+// подпись, издателя, получателя, срок действия и nonce
+func (p *Provider) Exchange(ctx context.Context, code string, req Request) (Claims, error) {
+	var claims Claims
+	config, verifier, err := p.discover(ctx)
+	if err != nil {
+		return claims, err
+	}
+
+	ctx = p.context(ctx)
+	token, err := config.Exchange(ctx, code, oauth2.VerifierOption(req.Verifier),
+		oauth2.SetAuthURLParam("redirect_uri", req.RedirectURL))
+	if err != nil {
+		return claims, fmt.Errorf("обмен кода авторизации: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return claims, errors.New("провайдер не вернул ID-токен")
+	}
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return claims, fmt.Errorf("проверка ID-токена: %w", err)
+	}
+	if idToken.Nonce != req.Nonce {
+		return claims, errors.New("nonce ID-токена не совпадает с запросом")
+	}
+
+	var values map[string]interface{}
+	if err := idToken.Claims(&values); err != nil {
+		return claims, err
+	}
+	claims.Subject = idToken.Subject
+	claims.Username, _ = lookup(values, p.config.UsernameClaim).(string)
+	claims.Email, _ = lookup(values, p.config.EmailClaim).(string)
+	claims.EmailVerified, _ = lookup(values, "email_verified").(bool)
+	claims.Roles = p.roles(stringList(lookup(values, p.config.RolesClaim)))
+	return claims, nil
+}
+
+// lookup возвращает значение claim; путь через точку обращается к вложенным объектам
+func lookup(values map[string]interface{}, path string) interface{} {
+	if path == "" {
+		return nil
+	}
+	var current interface{} = values
+	for _, key := range strings.Split(path, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = object[key]
+	}
+	return current
+}
+
+// stringList приводит claim к списку строк: claim может быть строкой или массивом
+func stringList(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func (p *Provider) roles(values []string) []string {
+	var roles []string
+	for role, roleValues := range p.config.ClaimRoles {
+		for _, value := range roleValues {
+			if containsFold(values, value) {
+				roles = append(roles, role)
+				break
+			}
+		}
+	}
+	return roles
+}
+
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func randomString() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
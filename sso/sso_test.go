@@ -0,0 +1,245 @@
+package sso
+
+import (
+	"context"
+	"errors"
+	"gorm.io/gorm"
+	"itsm/authn"
+	"itsm/models"
+	"itsm/rbac"
+	"itsm/sso/ssotest"
+	"itsm/testenv"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const (
+	testClientID    = "itsm"
+	testRedirectURL = "https://itsm.example.com/login/sso/corp/callback"
+)
+
+func newTestProvider(t *testing.T, configure func(*Config)) (*Provider, *ssotest.IdP) {
+	idp := ssotest.New(t, testClientID)
+	config := DefaultConfig
+	config.Name = "corp"
+	config.Title = "Corp"
+	config.Issuer = idp.Issuer()
+	config.ClientID = testClientID
+	config.ClientSecret = "secret"
+	config.RedirectURL = testRedirectURL
+	config.RolesClaim = "realm_access.roles"
+	config.ClaimRoles = map[string][]string{rbac.RoleTechOfficer: {"itsm-engineers"}}
+	if configure != nil {
+		configure(&config)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	Configure(config)
+	t.Cleanup(func() { Configure() })
+
+	provider, _ := Find("corp")
+	idp.Claims = map[string]interface{}{
+		"sub":                "subject-1",
+		"preferred_username": "ivanov",
+		"email":              "ivanov@example.com",
+		"email_verified":     true,
+		"realm_access":       map[string]interface{}{"roles": []string{"ITSM-Engineers", "offline_access"}},
+	}
+	return provider, idp
+}
+
+// login проходит вход у провайдера и обменивает код на claims
+func login(t *testing.T, provider *Provider, idp *ssotest.IdP) (Claims, error) {
+	t.Helper()
+	authURL, req, err := provider.AuthURL(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback := idp.Authorize(t, authURL)
+	if callback.Query().Get("state") != req.State {
+		t.Fatalf("state = %q, want %q", callback.Query().Get("state"), req.State)
+	}
+	return provider.Exchange(context.Background(), callback.Query().Get("code"), req)
+}
+
+func TestExchange(t *testing.T) {
+	provider, idp := newTestProvider(t, nil)
+
+	claims, err := login(t, provider, idp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "subject-1" || claims.Username != "ivanov" || claims.Email != "ivanov@example.com" ||
+		!claims.EmailVerified {
+		t.Errorf("claims = %+v", claims)
+	}
+	if !slices.Equal(claims.Roles, []string{rbac.RoleTechOfficer}) {
+		t.Errorf("roles = %v, want [%s]", claims.Roles, rbac.RoleTechOfficer)
+	}
+}
+
+func TestExchangeSendsVerifier(t *testing.T) {
+	provider, idp := newTestProvider(t, nil)
+
+	authURL, req, err := provider.AuthURL(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(authURL, req.Verifier) {
+		t.Error("authorization URL contains the PKCE verifier")
+	}
+	code := idp.Authorize(t, authURL).Query().Get("code")
+
+	// Провайдер отклоняет код без verifier, хеш которого передан при авторизации
+	stolen := req
+	stolen.Verifier = "wrong-verifier-0123456789-0123456789-0123456789"
+	if _, err := provider.Exchange(context.Background(), code, stolen); err == nil {
+		t.Error("exchange with wrong verifier succeeded")
+	}
+	// После отказа oauth2 повторяет запрос с другим способом передачи секрета клиента
+	if verifiers := idp.Verifiers(); len(verifiers) == 0 || slices.ContainsFunc(verifiers, func(v string) bool {
+		return v != stolen.Verifier
+	}) {
+		t.Errorf("verifiers = %v, want only %s", verifiers, stolen.Verifier)
+	}
+
+	code = idp.Authorize(t, authURL).Query().Get("code")
+	if _, err := provider.Exchange(context.Background(), code, req); err != nil {
+		t.Fatal(err)
+	}
+	if verifiers := idp.Verifiers(); verifiers[len(verifiers)-1] != req.Verifier {
+		t.Errorf("verifiers = %v, want %s last", verifiers, req.Verifier)
+	}
+}
+
+func TestExchangeRejectsToken(t *testing.T) {
+	for name, tamper := range map[string]func(*testing.T, *ssotest.IdP){
+		"nonce mismatch": func(t *testing.T, idp *ssotest.IdP) { idp.Nonce = "other-nonce" },
+		"wrong audience": func(t *testing.T, idp *ssotest.IdP) { idp.Audience = "other-client" },
+		"bad signature":  func(t *testing.T, idp *ssotest.IdP) { idp.SignWith = ssotest.NewKey(t) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			provider, idp := newTestProvider(t, nil)
+			tamper(t, idp)
+			if claims, err := login(t, provider, idp); err == nil {
+				t.Errorf("exchange succeeded with claims %+v", claims)
+			}
+		})
+	}
+}
+
+func resolve(t *testing.T, db *gorm.DB, provider *Provider, claims Claims) (models.User, error) {
+	t.Helper()
+	return provider.Resolve(db, httptest.NewRequest("GET", "/login/sso/corp/callback", nil), claims)
+}
+
+func identityCount(t *testing.T, db *gorm.DB, userID uint) int64 {
+	t.Helper()
+	var count int64
+	if err := db.Model(&models.UserIdentity{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestResolveCreatesAndLinksBySubject(t *testing.T) {
+	db := testenv.Open(t)
+	provider, idp := newTestProvider(t, nil)
+
+	claims, err := login(t, provider, idp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := resolve(t, db, provider, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "ivanov" || user.AuthSource != authn.SourceOIDC || user.Email == nil {
+		t.Errorf("created user = %+v", user)
+	}
+	if len(user.Roles) != 1 || user.Roles[0].Name != rbac.RoleTechOfficer {
+		t.Errorf("roles = %v, want [%s]", user.Roles, rbac.RoleTechOfficer)
+	}
+
+	// Следующий вход находит пользователя по subject, даже если логин у провайдера сменился
+	idp.Claims["preferred_username"] = "ivanov.i"
+	idp.Claims["realm_access"] = map[string]interface{}{"roles": []string{}}
+	claims, err = login(t, provider, idp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := resolve(t, db, provider, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != user.ID {
+		t.Errorf("second login resolved to user %d, want %d", again.ID, user.ID)
+	}
+	if len(again.Roles) != 0 {
+		t.Errorf("roles after group removal = %v, want none", again.Roles)
+	}
+	if count := identityCount(t, db, user.ID); count != 1 {
+		t.Errorf("identities = %d, want 1", count)
+	}
+}
+
+func TestResolveLinkByEmail(t *testing.T) {
+	db := testenv.Open(t)
+	provider, idp := newTestProvider(t, func(c *Config) { c.LinkByEmail = true })
+	existing := testenv.User(t, db, "i.ivanov")
+	if err := db.Model(&existing).Update("email", "ivanov@example.com").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// Неподтвержденный адрес не дает доступа к чужой учетной записи
+	idp.Claims["email_verified"] = false
+	claims, err := login(t, provider, idp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := resolve(t, db, provider, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID == existing.ID || user.Email != nil {
+		t.Errorf("unverified email linked or copied: %+v", user)
+	}
+	if count := identityCount(t, db, existing.ID); count != 0 {
+		t.Errorf("identities of existing user = %d, want 0", count)
+	}
+
+	idp.Claims["sub"] = "subject-2"
+	idp.Claims["email_verified"] = true
+	claims, err = login(t, provider, idp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err = resolve(t, db, provider, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != existing.ID {
+		t.Errorf("verified email resolved to user %d, want %d", user.ID, existing.ID)
+	}
+}
+
+func TestResolveUsernameTaken(t *testing.T) {
+	db := testenv.Open(t)
+	provider, idp := newTestProvider(t, nil)
+	existing := testenv.User(t, db, "ivanov")
+
+	claims, err := login(t, provider, idp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loginErr *LoginError
+	if _, err := resolve(t, db, provider, claims); !errors.As(err, &loginErr) {
+		t.Fatalf("resolve = %v, want LoginError", err)
+	}
+	if count := identityCount(t, db, existing.ID); count != 0 {
+		t.Errorf("identities of existing user = %d, want 0", count)
+	}
+}
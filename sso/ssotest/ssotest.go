@@ -0,0 +1,217 @@
+// Package ssotest - провайдер OpenID Connect для тестов единого входа.
+// Отдает discovery, JWKS и выдает ID-токены по коду авторизации с проверкой PKCE
+package ssotest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// keyID - идентификатор ключа подписи в JWKS
+const keyID = "test-key"
+
+// IdP - провайдер. Поля, заданные тестом, действуют на следующие выданные токены
+type IdP struct {
+	Server   *httptest.Server
+	ClientID string
+	Claims   map[string]interface{} // claims ID-токена сверх iss, aud, exp, iat и nonce
+	Audience string                 // получатель токена; пустой - ClientID
+	Nonce    string                 // nonce токена; пустой - из запроса авторизации
+	SignWith *rsa.PrivateKey        // ключ подписи; nil - ключ из JWKS
+
+	key   *rsa.PrivateKey
+	mu    sync.Mutex
+	codes map[string]authorization
+	// verifiers - code_verifier из запросов токена
+	verifiers []string
+}
+
+// authorization - запрос авторизации, по которому выдан код
+type authorization struct {
+	redirectURI string
+	nonce       string
+	challenge   string
+}
+
+// New запускает провайдера; он останавливается после завершения теста
+func New(t testing.TB, clientID string) *IdP {
+	t.Helper()
+	idp := &IdP{ClientID: clientID, key: NewKey(t), codes: map[string]authorization{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("GET /jwks", idp.jwks)
+	mux.HandleFunc("POST /token", idp.token)
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Server.Close)
+	return idp
+}
+
+// NewKey создает ключ RSA, например для подписи токена ключом не из JWKS
+func NewKey(t testing.TB) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// Issuer - адрес издателя для sso.Config
+func (idp *IdP) Issuer() string {
+	return idp.Server.URL
+}
+
+// Authorize принимает адрес страницы входа, как если бы пользователь вошел
+// у провайдера, и возвращает адрес возврата с кодом и state
+func (idp *IdP) Authorize(t testing.TB, authURL string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("client_id") != idp.ClientID || query.Get("response_type") != "code" {
+		t.Fatalf("unexpected authorization request %s", authURL)
+	}
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		t.Fatalf("authorization request without PKCE: %s", authURL)
+	}
+
+	code := randomCode()
+	idp.mu.Lock()
+	idp.codes[code] = authorization{
+		redirectURI: query.Get("redirect_uri"),
+		nonce:       query.Get("nonce"),
+		challenge:   query.Get("code_challenge"),
+	}
+	idp.mu.Unlock()
+
+	callback, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback.RawQuery = url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+	return callback
+}
+
+// Verifiers возвращает code_verifier из запросов токена
+func (idp *IdP) Verifiers() []string {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	return append([]string(nil), idp.verifiers...)
+}
+
+func (idp *IdP) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                idp.Issuer(),
+		"authorization_endpoint":                idp.Issuer() + "/authorize",
+		"token_endpoint":                        idp.Issuer() + "/token",
+		"jwks_uri":                              idp.Issuer() + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (idp *IdP) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &idp.key.PublicKey, KeyID: keyID, Algorithm: string(jose.RS256), Use: "sig"},
+	}})
+}
+
+// token выдает ID-токен по коду. Код одноразовый и требует verifier,
+// хеш которого передан в запросе авторизации
+func (idp *IdP) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request")
+		return
+	}
+	verifier := r.PostForm.Get("code_verifier")
+
+	idp.mu.Lock()
+	idp.verifiers = append(idp.verifiers, verifier)
+	auth, ok := idp.codes[r.PostForm.Get("code")]
+	delete(idp.codes, r.PostForm.Get("code"))
+	idp.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(verifier))
+	if r.PostForm.Get("grant_type") != "authorization_code" || !ok ||
+		r.PostForm.Get("redirect_uri") != auth.redirectURI ||
+		base64.RawURLEncoding.EncodeToString(sum[:]) != auth.challenge {
+		tokenError(w, "invalid_grant")
+		return
+	}
+
+	idToken, err := idp.idToken(auth.nonce)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomCode(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func (idp *IdP) idToken(nonce string) (string, error) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	key := idp.key
+	if idp.SignWith != nil {
+		key = idp.SignWith
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", keyID))
+	if err != nil {
+		return "", err
+	}
+
+	claims := map[string]interface{}{}
+	for name, value := range idp.Claims {
+		claims[name] = value
+	}
+	claims["iss"] = idp.Issuer()
+	claims["aud"] = idp.ClientID
+	if idp.Audience != "" {
+		claims["aud"] = idp.Audience
+	}
+	claims["nonce"] = nonce
+	if idp.Nonce != "" {
+		claims["nonce"] = idp.Nonce
+	}
+	claims["iat"] = time.Now().Unix()
+	claims["exp"] = time.Now().Add(5 * time.Minute).Unix()
+	return jwt.Signed(signer).Claims(claims).Serialize()
+}
+
+func randomCode() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code})
+}
+
+func writeJSON(w http.ResponseWriter, code int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(data)
+}
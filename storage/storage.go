@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Storage - хранилище файлов вложений. Файл идентифицируется ключом,
+// который возвращает Save; реализации не должны зависеть от исходного имени файла
+type Storage interface {
+	Save(name string, r io.Reader) (string, error)
+	Open(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+var ErrInvalidKey = errors.New("некорректный ключ файла")
+
+// Local хранит файлы в каталоге на локальном диске
+type Local struct {
+	root string
+}
+
+// NewLocal создает хранилище в каталоге root, создавая его при необходимости
+func NewLocal(root string) (*Local, error) {
+	if err := os.MkdirAll(root, 0o750); err != nil {
+		return nil, err
+	}
+	return &Local{root: root}, nil
+}
+
+// newKey генерирует случайный ключ, сохраняя расширение исходного файла
+func newKey(name string) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	ext := strings.ToLower(filepath.Ext(name))
+	if len(ext) > 10 || strings.ContainsAny(ext, `/\`) {
+		ext = ""
+	}
+
+	id := hex.EncodeToString(buf)
+	return id[:2] + "/" + id + ext, nil
+}
+
+func (l *Local) path(key string) (string, error) {
+	if key == "" || strings.Contains(key, "..") || filepath.IsAbs(key) {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(l.root, filepath.FromSlash(key)), nil
+}
+
+func (l *Local) Save(name string, r io.Reader) (string, error) {
+	key, err := newKey(name)
+	if err != nil {
+		return "", err
+	}
+
+	path, err := l.path(key)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return "", err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		os.Remove(path)
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+
+	return key, nil
+}
+
+func (l *Local) Open(key string) (io.ReadCloser, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (l *Local) Delete(key string) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
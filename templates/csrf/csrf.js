@@ -0,0 +1,82 @@
+// Подстановка CSRF-токена из cookie в формы и запросы fetch.
+// Сервер отклоняет POST, PUT, PATCH и DELETE без токена
+(function () {
+  if (window.csrfProtected) {
+    return;
+  }
+  window.csrfProtected = true;
+
+  const cookieName = 'csrf_token';
+  const fieldName = 'csrf_token';
+  const headerName = 'X-CSRF-Token';
+  const safeMethods = ['GET', 'HEAD', 'OPTIONS', 'TRACE'];
+
+  function csrfToken() {
+    const prefix = cookieName + '=';
+    const cookie = document.cookie.split('; ').find(c => c.startsWith(prefix));
+    return cookie ? decodeURIComponent(cookie.substring(prefix.length)) : '';
+  }
+
+  function isSameOrigin(url) {
+    return new URL(url, window.location.href).origin === window.location.origin;
+  }
+
+  // Multipart-формы передают токен в строке запроса: сервер не разбирает
+  // их тело до обработчика, который ограничивает размер вложений
+  function protectForm(form, token) {
+    const method = (form.getAttribute('method') || 'GET').toUpperCase();
+    if (safeMethods.includes(method) || !isSameOrigin(form.action)) {
+      return;
+    }
+
+    if (form.enctype === 'multipart/form-data') {
+      const url = new URL(form.action, window.location.href);
+      url.searchParams.set(fieldName, token);
+      form.action = url.toString();
+      return;
+    }
+
+    let input = form.querySelector('input[name="' + fieldName + '"]');
+    if (!input) {
+      input = document.createElement('input');
+      input.type = 'hidden';
+      input.name = fieldName;
+      form.appendChild(input);
+    }
+    input.value = token;
+  }
+
+  document.addEventListener('DOMContentLoaded', function () {
+    const token = csrfToken();
+    document.querySelectorAll('form').forEach(form => protectForm(form, token));
+  });
+
+  const originalFetch = window.fetch;
+  window.fetch = function (resource, options) {
+    options = options || {};
+    const request = resource instanceof Request ? resource : null;
+    const method = (options.method || (request ? request.method : 'GET')).toUpperCase();
+    const url = request ? request.url : String(resource);
+
+    if (!safeMethods.includes(method) && isSameOrigin(url)) {
+      const headers = new Headers(options.headers || (request ? request.headers : undefined));
+      headers.set(headerName, csrfToken());
+      options = Object.assign({}, options, {headers: headers});
+    }
+    return originalFetch.call(this, resource, options);
+  };
+
+  // XMLHttpRequest используется в том числе в $.ajax
+  const originalOpen = XMLHttpRequest.prototype.open;
+  const originalSend = XMLHttpRequest.prototype.send;
+  XMLHttpRequest.prototype.open = function (method, url) {
+    this.csrfRequired = !safeMethods.includes(String(method).toUpperCase()) && isSameOrigin(url);
+    return originalOpen.apply(this, arguments);
+  };
+  XMLHttpRequest.prototype.send = function () {
+    if (this.csrfRequired) {
+      this.setRequestHeader(headerName, csrfToken());
+    }
+    return originalSend.apply(this, arguments);
+  };
+})();
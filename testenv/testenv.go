@@ -0,0 +1,78 @@
+// Package testenv подготавливает окружение для тестов обработчиков:
+// базу данных в памяти и хранилище сессий
+package testenv
+
+import (
+	"fmt"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"itsm/apitoken"
+	"itsm/models"
+	"itsm/rbac"
+	"itsm/session"
+	"sync/atomic"
+	"testing"
+)
+
+var counter atomic.Int64
+
+// sessionKey - секрет cookie сессий в тестах
+const sessionKey = "test-session-key-0123456789abcdef"
+
+// Open создает пустую базу со схемой и встроенными ролями и настраивает
+// сессии в cookie. База удаляется после завершения теста
+func Open(t testing.TB) *gorm.DB {
+	t.Helper()
+	dsn := fmt.Sprintf("file:test%d?mode=memory&cache=shared&_pragma=foreign_keys(1)", counter.Add(1))
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// SQLite допускает одного писателя: одно соединение исключает ошибки блокировки
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	if err := db.AutoMigrate(models.All()...); err != nil {
+		t.Fatal(err)
+	}
+	if err := rbac.Seed(db); err != nil {
+		t.Fatal(err)
+	}
+	err = session.Configure(db, session.Config{Keys: []string{sessionKey}, Backend: session.BackendCookie, MaxAge: 3600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// User создает пользователя с ролями
+func User(t testing.TB, db *gorm.DB, username string, roles ...string) models.User {
+	t.Helper()
+	user := models.User{Username: username, Password: "-"}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := rbac.SetUserRoles(db, &user, roles); err != nil {
+		t.Fatal(err)
+	}
+	if err := rbac.PreloadRoles(db).First(&user, user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// Token выпускает пользователю API-токен с правом изменения для запросов
+// с заголовком Authorization: Bearer
+func Token(t testing.TB, db *gorm.DB, user models.User) string {
+	t.Helper()
+	token, _, err := apitoken.Create(db, user.ID, "test", apitoken.ScopeWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
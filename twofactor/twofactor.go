@@ -0,0 +1,259 @@
+package twofactor
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/skip2/go-qrcode"
+	"gorm.io/gorm"
+	"itsm/models"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Двухфакторная аутентификация: одноразовые коды TOTP (RFC 6238) из приложения
+// и резервные коды на случай потери телефона. После проверки пароля пользователь
+// с включенной защитой вводит один из этих кодов
+
+// Параметры TOTP. Их поддерживают все распространенные приложения
+const (
+	secretLength = 20 // байт, как рекомендует RFC 4226
+	period       = 30 * time.Second
+	digits       = 6
+	skew         = 1 // сколько соседних шагов принимается из-за расхождения часов
+	issuer       = "GMD studio"
+)
+
+// Число резервных кодов и их длина в символах
+const (
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10
+)
+
+// SetupPath - страница настройки, доступная пользователю, который обязан
+// включить защиту, но еще не сделал этого
+const SetupPath = "/account/2fa"
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// ErrInvalidCode - код не подошел
+var ErrInvalidCode = errors.New("Неверный код")
+
+var requiredRoles []string
+
+// Configure задает роли, для которых двухфакторная аутентификация обязательна
+func Configure(roles []string) {
+	requiredRoles = roles
+}
+
+// Required сообщает, обязана ли у пользователя быть включена защита.
+// Роли пользователя должны быть загружены
+func Required(user models.User) bool {
+	return slices.ContainsFunc(user.Roles, func(r models.Role) bool { return slices.Contains(requiredRoles, r.Name) })
+}
+
+// Enabled сообщает, включена ли у пользователя защита
+func Enabled(user models.User) bool {
+	return user.TOTPEnabledAt != nil
+}
+
+// NewSecret создает случайный секрет в кодировке base32
+func NewSecret() (string, error) {
+	buf := make([]byte, secretLength)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(buf), nil
+}
+
+// ProvisioningURI - ссылка otpauth:// для добавления учетной записи в приложение
+func ProvisioningURI(secret, username string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(digits))
+	params.Set("period", fmt.Sprint(int(period.Seconds())))
+
+	label := url.PathEscape(issuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// QRCode возвращает PNG с QR-кодом ссылки для сканирования приложением
+func QRCode(uri string) ([]byte, error) {
+	return qrcode.Encode(uri, qrcode.Medium, 256)
+}
+
+// hotp вычисляет код для значения счетчика по RFC 4226
+func hotp(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulus := uint32(1)
+	for range digits {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%modulus)
+}
+
+// matchTOTP ищет шаг времени, для которого код верен. Возвращает номер шага
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != digits {
+		return 0, false
+	}
+
+	current := now.Unix() / int64(period.Seconds())
+	for step := current - skew; step <= current+skew; step++ {
+		if subtle.ConstantTimeCompare([]byte(hotp(key, uint64(step))), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// normalize убирает из введенного кода пробелы и дефисы
+func normalize(code string) string {
+	code = strings.ReplaceAll(code, " ", "")
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ToLower(code)
+}
+
+// Enable проверяет код из приложения для нового секрета, включает защиту
+// и возвращает резервные коды, которые показываются пользователю один раз
+func Enable(tx *gorm.DB, user *models.User, secret, code string) ([]string, error) {
+	step, ok := matchTOTP(secret, normalize(code), time.Now())
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	now := time.Now()
+	err := tx.Model(user).Updates(map[string]interface{}{
+		"totp_secret":       secret,
+		"totp_enabled_at":   now,
+		"totp_last_counter": step,
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+	user.TOTPSecret = secret
+	user.TOTPEnabledAt = &now
+	user.TOTPLastCounter = step
+
+	return RegenerateRecoveryCodes(tx, user.ID)
+}
+
+// Disable выключает защиту и удаляет резервные коды
+func Disable(tx *gorm.DB, user *models.User) error {
+	err := tx.Model(user).Updates(map[string]interface{}{
+		"totp_secret":       "",
+		"totp_enabled_at":   nil,
+		"totp_last_counter": 0,
+	}).Error
+	if err != nil {
+		return err
+	}
+	user.TOTPSecret = ""
+	user.TOTPEnabledAt = nil
+	user.TOTPLastCounter = 0
+
+	return tx.Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{}).Error
+}
+
+// Verify проверяет код из приложения или резервный код. Каждый код принимается
+// только один раз: использованный шаг TOTP запоминается, резервный код помечается
+func Verify(db *gorm.DB, user *models.User, code string) error {
+	if !Enabled(*user) {
+		return ErrInvalidCode
+	}
+	code = normalize(code)
+
+	if step, ok := matchTOTP(user.TOTPSecret, code, time.Now()); ok {
+		// Условие в запросе не дает двум параллельным запросам принять один код
+		result := db.Model(&models.User{}).
+			Where("id = ? AND totp_last_counter < ?", user.ID, step).
+			Update("totp_last_counter", step)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidCode
+		}
+		user.TOTPLastCounter = step
+		return nil
+	}
+
+	if len(code) != recoveryCodeLength {
+		return ErrInvalidCode
+	}
+	result := db.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, hashCode(code)).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// RegenerateRecoveryCodes заменяет резервные коды пользователя новыми
+func RegenerateRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	records := make([]models.RecoveryCode, 0, recoveryCodeCount)
+	for range recoveryCodeCount {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		half := recoveryCodeLength / 2
+		codes = append(codes, code[:half]+"-"+code[half:])
+		records = append(records, models.RecoveryCode{UserID: userID, CodeHash: hashCode(code)})
+	}
+	if err := tx.Create(&records).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// RemainingRecoveryCodes возвращает число неиспользованных резервных кодов
+func RemainingRecoveryCodes(db *gorm.DB, userID uint) (int64, error) {
+	var count int64
+	err := db.Model(&models.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count).Error
+	return count, err
+}
+
+// newRecoveryCode создает код из строчных букв и цифр base32
+func newRecoveryCode() (string, error) {
+	buf := make([]byte, recoveryCodeLength*5/8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return strings.ToLower(encoding.EncodeToString(buf)), nil
+}
+
+// Резервные коды случайны и достаточно длинны, поэтому для хранения хватает sha256
+func hashCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
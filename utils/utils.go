@@ -2,67 +2,131 @@ package utils
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/gorilla/sessions"
+	"html/template"
+	"itsm/listener"
 	"itsm/session"
+	"log"
 	"net/http"
+	"path/filepath"
 	"strings"
 )
 
+// GetCurSession возвращает сессию запроса. Если cookie не удалось прочитать,
+// например после смены ключей, вместе с ошибкой возвращается новая пустая сессия
 func GetCurSession(r *http.Request) (*sessions.Session, error) {
-	hostParts := strings.Split(r.Host, ":")
-	var port string
-	if len(hostParts) > 1 {
-		port = hostParts[1]
-	} else {
-		port = "8080"
-	}
+	return session.Get(r)
+}
+
+// headerFile - шаблон шапки, общей для страниц системы
+const headerFile = "templates/header/header.html"
+
+// ParsePage загружает шаблон страницы page вместе с шапкой. Функция шаблона
+// mounted сообщает, подключен ли раздел к слушателю, принявшему запрос r:
+// шапка ссылается только на подключенные разделы. funcs - дополнительные
+// функции шаблона страницы
+func ParsePage(r *http.Request, page string, funcs template.FuncMap) (*template.Template, error) {
+	t := template.New(filepath.Base(page)).Funcs(template.FuncMap{
+		"mounted": func(module string) bool { return listener.Mounted(r, module) },
+	})
+	return t.Funcs(funcs).ParseFiles(page, headerFile)
+}
 
-	sessionName := "session-" + port
-	curSession, err := session.Store.Get(r, sessionName)
+func SendJSON(w http.ResponseWriter, dataStruct interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(dataStruct)
 	if err != nil {
-		return nil, err
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+}
 
-	return curSession, nil
+// JSONError - тело ответа JSON API с ошибкой
+type JSONError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
 }
 
-func GetCurUserID(w http.ResponseWriter, r *http.Request) (uint, error) {
-	curSession, err := GetCurSession(r)
+// SendJSONError отправляет ошибку в формате JSON с указанным HTTP-кодом
+func SendJSONError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(JSONError{
+		Error:   strings.ToLower(strings.ReplaceAll(http.StatusText(code), " ", "_")),
+		Message: message,
+	})
 	if err != nil {
-		http.Error(w, "Ошибка получения сессии: "+err.Error(), http.StatusUnauthorized)
-		return 0, err
+		log.Println("Ошибка при отправке ответа:", err)
 	}
+}
+
+// MaxJSONBody - максимальный размер тела JSON-запроса
+const MaxJSONBody = 1 << 20
+
+// RequestError - ошибка обработки запроса с HTTP-кодом ответа, текст которой
+// показывается пользователю
+type RequestError struct {
+	Code    int
+	Message string
+}
+
+func (e *RequestError) Error() string {
+	return e.Message
+}
 
-	userID := curSession.Values["userID"]
+func NewRequestError(code int, format string, args ...interface{}) error {
+	return &RequestError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
 
-	var curUserID uint
-	if value, ok := userID.(uint); ok {
-		curUserID = value
-	} else {
-		http.Error(w, "ID текущего пользователя не найден", http.StatusNotFound)
+// ErrorStatus возвращает HTTP-код и текст ошибки. Внутренние ошибки
+// записываются в лог и не раскрываются пользователю
+func ErrorStatus(err error) (int, string) {
+	var reqErr *RequestError
+	if errors.As(err, &reqErr) {
+		return reqErr.Code, reqErr.Message
 	}
+	log.Println("Ошибка при обработке запроса:", err)
+	return http.StatusInternalServerError, "Ошибка сервера. Попробуйте позже"
+}
 
-	return curUserID, err
+// WriteError отправляет ошибку текстом, как принято в HTML-обработчиках
+func WriteError(w http.ResponseWriter, err error) {
+	code, message := ErrorStatus(err)
+	http.Error(w, message, code)
 }
 
-func SendJSON(w http.ResponseWriter, dataStruct interface{}) {
+// WriteJSONError отправляет ошибку в формате JSON
+func WriteJSONError(w http.ResponseWriter, err error) {
+	code, message := ErrorStatus(err)
+	SendJSONError(w, code, message)
+}
+
+// WriteJSON отправляет ответ JSON с указанным HTTP-кодом
+func WriteJSON(w http.ResponseWriter, code int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
-	err := json.NewEncoder(w).Encode(dataStruct)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Println("Ошибка при отправке ответа:", err)
 	}
 }
 
-func IsClientUser(r *http.Request) (bool, error) {
-	curSession, err := GetCurSession(r)
-	if err != nil {
-		return false, err
+// DecodeJSON разбирает тело запроса не больше MaxJSONBody, запрещая неизвестные поля
+func DecodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxJSONBody))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(dst); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return NewRequestError(http.StatusRequestEntityTooLarge, "Превышен допустимый размер запроса")
+		}
+		return NewRequestError(http.StatusBadRequest, "Некорректный JSON: %s", err.Error())
 	}
+	return nil
+}
 
-	isAdmin := curSession.Values["isAdmin"].(bool)
-	isTechOfficer := curSession.Values["isTechOfficer"].(bool)
-	isDefaultOfficer := curSession.Values["isDefaultOfficer"].(bool)
-
-	return !isAdmin && !isTechOfficer && !isDefaultOfficer, nil
+// EscapeLike экранирует спецсимволы шаблона LIKE
+func EscapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
 }